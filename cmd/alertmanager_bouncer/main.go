@@ -1,19 +1,22 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
-	"os/signal"
-	"syscall"
 	"time"
 
+	"github.com/alecthomas/units"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
 	johari "github.com/sinkingpoint/johari-go/lib"
+	"go.opentelemetry.io/contrib/propagators/b3"
+	"go.opentelemetry.io/otel/propagation"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -28,21 +31,28 @@ type config struct {
 	tlsCertFile           string
 	tlsKeyFile            string
 	bouncersConfigFile    string
+	metricsURL            *net.TCPAddr
+	maxBodySize           units.Base2Bytes
+	errorFormat           string
+	evaluation            string
+	decodeGzip            bool
+	diagnosticHeaders     bool
+	trustedProxies        []string
+	backendErrorStatus    int
+	backendErrorMessage   string
+	checkConfig           bool
+	backendTLS            bouncer.BackendTLSConfig
 }
 
-func loadBouncersFromFile(conf config) ([]bouncer.Bouncer, error) {
-	jsonFile, err := os.Open(conf.bouncersConfigFile)
-	defer jsonFile.Close()
-	if err != nil {
-		return nil, err
-	}
-
-	bytes, err := ioutil.ReadAll(jsonFile)
-	if err != nil {
-		return nil, err
+// checkConfig validates the bouncers file, exiting with a non zero status if it's invalid
+func checkConfig(conf config) {
+	if _, err := bouncer.ParseBouncersFromFile(conf.bouncersConfigFile); err != nil {
+		fmt.Fprintf(os.Stderr, "%s is invalid: %s\n", conf.bouncersConfigFile, err.Error())
+		os.Exit(1)
 	}
 
-	return bouncer.ParseBouncers(bytes)
+	fmt.Printf("%s is valid\n", conf.bouncersConfigFile)
+	os.Exit(0)
 }
 
 func main() {
@@ -51,30 +61,115 @@ func main() {
 		ServiceName:  "alertmanager-bouncer",
 		CollectorURL: "http://jaeger:14268/api/traces",
 		SamplingRate: 1,
+		// Propagate W3C trace context to the backend (as Alertmanager and most other OTel services expect), alongside johari's default of B3
+		Propagator: propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, b3.B3{}),
 	})
 
 	app := kingpin.New("alertmanager_bouncer", "A Business Logic Reverse Proxy for Alertmanager")
-	app.Flag("backend.addr", "The URL of the backend to upstream to").Required().URLVar(&config.backendURL)
-	app.Flag("listen.addr", "The URL for the reverse proxy to listen on").Required().TCPVar(&config.listenURL)
+	app.Flag("backend.addr", "The URL of the backend to upstream to. Required unless checking the config").URLVar(&config.backendURL)
+	app.Flag("listen.addr", "The URL for the reverse proxy to listen on. Required unless checking the config").TCPVar(&config.listenURL)
 	app.Flag("config.bouncersfile", "The file containing the list of bouncers to create").Required().ExistingFileVar(&config.bouncersConfigFile)
 	app.Flag("timeout.dial", "The timeout of the initial connection to the backend").Default("30s").DurationVar(&config.dialTimeout)
 	app.Flag("timeout.tlshandshake", "The timeout of the TLS handshake to the backend, after a connection is established").Default("10s").DurationVar(&config.tlsHandshakeTimeout)
 	app.Flag("timeout.responseheader", "The timeout of the receive of the initial headers from the backend").Default("10s").DurationVar(&config.responseHeaderTimeout)
 	app.Flag("timeout.serverread", "The timeout of the reverse proxy to read requests").Default("5s").DurationVar(&config.serverReadTimeout)
 	app.Flag("timeout.serverwrite", "The timeout of the reverse proxy to write the response to the upstream client").Default("10s").DurationVar(&config.serverWriteTimeout)
+	app.Flag("backend.tls.cafile", "The file path of the CA certs (PEM) to trust for the backend's TLS cert, if it isn't signed by a system CA").ExistingFileVar(&config.backendTLS.CAFile)
+	app.Flag("backend.tls.certfile", "The file path of the client cert to present to the backend, if it wants one").ExistingFileVar(&config.backendTLS.CertFile)
+	app.Flag("backend.tls.keyfile", "The file path of the key of the client cert to present to the backend").ExistingFileVar(&config.backendTLS.KeyFile)
+	app.Flag("backend.tls.servername", "The name to check the backend's TLS cert against, if it isn't the host of backend.addr").StringVar(&config.backendTLS.ServerName)
+	app.Flag("backend.tls.insecureskipverify", "Don't check the backend's TLS cert. Only use this for testing").BoolVar(&config.backendTLS.InsecureSkipVerify)
+	app.Flag("backend.errormessage", "The message sent to clients (in the errors.format) when the backend can't be reached. If it isn't set, clients get a bare 502").StringVar(&config.backendErrorMessage)
+	app.Flag("backend.errorstatus", "The status code sent to clients with backend.errormessage").Default("502").IntVar(&config.backendErrorStatus)
 	app.Flag("tls.certfile", "The file path of the TLS cert file on disk, if you want to serve TLS").ExistingFileVar(&config.tlsCertFile)
 	app.Flag("tls.keyfile", "The file path of the TLS key file on disk, if you want to serve TLS").ExistingFileVar(&config.tlsKeyFile)
+	app.Flag("limit.bodysize", "The largest request body that bouncers will read. Larger requests are rejected with a 413").Default("10MiB").BytesVar(&config.maxBodySize)
+	app.Flag("decode.gzip", "Decompress gzipped request bodies, so that deciders can read them. They're forwarded to the backend decompressed").BoolVar(&config.decodeGzip)
+	app.Flag("metrics.addr", "The address to serve Prometheus metrics on, if you want them. This is separate from listen.addr so that the backend's own /metrics is still proxied").TCPVar(&config.metricsURL)
+	app.Flag("errors.format", "The format of the bodies of rejected requests, either text or json ({\"status\":\"error\",\"error\":\"...\"}, like the Alertmanager API)").Default("text").EnumVar(&config.errorFormat, "text", "json")
+	app.Flag("errors.diagnosticheaders", "Name the bouncer and decider that rejected a request in X-Bouncer-Name and X-Bouncer-Decider headers. This tells clients about the rules, so only use it for debugging").BoolVar(&config.diagnosticHeaders)
+	app.Flag("clientip.trustedproxies", "A CIDR of proxies in front of the bouncer, e.g. a load balancer, whose X-Forwarded-For entries are believed when working out the client's IP. Can be repeated").StringsVar(&config.trustedProxies)
+	app.Flag("bouncers.evaluation", "Which matching bouncers run: untilRejected (every one, until one rejects), firstMatch (only the first that isn't in dry run mode), or allMatch (every one, even after one rejects)").Default("untilRejected").EnumVar(&config.evaluation, "untilRejected", "firstMatch", "allMatch")
+	app.Flag("check-config", "Check that the bouncers file is valid, and exit without starting the proxy").BoolVar(&config.checkConfig)
 	kingpin.MustParse(app.Parse(os.Args[1:]))
+	if config.checkConfig {
+		checkConfig(config)
+	}
+
+	if config.backendURL == nil {
+		app.Fatalf("required flag --backend.addr not provided")
+	}
+
+	if config.listenURL == nil {
+		app.Fatalf("required flag --listen.addr not provided")
+	}
+
+	options := bouncer.ProxyOptions{
+		MaxBodySize:       int64(config.maxBodySize),
+		DecodeGzip:        config.decodeGzip,
+		DiagnosticHeaders: config.diagnosticHeaders,
+		ResponseFormat:    bouncer.ErrorFormat(config.errorFormat),
+		Evaluation:        bouncer.EvaluationMode(config.evaluation),
+	}
+
+	var trustedProxies []*net.IPNet
+	for _, cidr := range config.trustedProxies {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			app.Fatalf("Failed to parse clientip.trustedproxies: %s", err)
+		}
+
+		trustedProxies = append(trustedProxies, network)
+	}
+	if config.backendErrorMessage != "" {
+		if config.backendErrorStatus < 400 || config.backendErrorStatus > 599 {
+			app.Fatalf("backend.errorstatus must be a 4xx or 5xx status code, got %d", config.backendErrorStatus)
+		}
+
+		options.BackendErrorResponse = &bouncer.HTTPError{
+			Status: config.backendErrorStatus,
+			Err:    errors.New(config.backendErrorMessage),
+		}
+	}
 
 	var err error
-	bouncers, err := loadBouncersFromFile(config)
+	bouncers, err := bouncer.ParseBouncersFromFile(config.bouncersConfigFile)
 	if err != nil {
 		log.Panicf("Failed to parse bouncers from %s: %s", config.bouncersConfigFile, err.Error())
 	}
 
 	fmt.Printf("Loaded %d bouncers\n", len(bouncers))
 
-	proxy := bouncer.NewBouncingReverseProxy(config.backendURL, bouncers, nil)
+	if config.metricsURL != nil {
+		if err := bouncer.RegisterMetrics(prometheus.DefaultRegisterer); err != nil {
+			log.Panicf("Failed to register metrics: %s", err.Error())
+		}
+
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			log.Fatalf("Got an error while serving metrics: %s\n", http.ListenAndServe(config.metricsURL.String(), mux))
+		}()
+	}
+
+	proxy, err := bouncer.NewBouncingReverseProxyWithConfig(config.backendURL, bouncers, bouncer.BackendConfig{
+		TLS:                   config.backendTLS,
+		DialTimeout:           config.dialTimeout,
+		TLSHandshakeTimeout:   config.tlsHandshakeTimeout,
+		ResponseHeaderTimeout: config.responseHeaderTimeout,
+	})
+	if err != nil {
+		log.Panicf("Failed to configure the connection to the backend: %s", err.Error())
+	}
+
+	if err := bouncer.SetTrustedProxies(trustedProxies, proxy); err != nil {
+		log.Panicf("Failed to set the trusted proxies: %s", err.Error())
+	}
+
+	if err := bouncer.SetProxyOptions(options, proxy); err != nil {
+		log.Panicf("Failed to set the proxy options: %s", err.Error())
+	}
+
 	server := http.Server{
 		ReadTimeout:  config.serverReadTimeout,
 		WriteTimeout: config.serverWriteTimeout,
@@ -82,20 +177,8 @@ func main() {
 		Addr:         config.listenURL.String(),
 	}
 
-	sigChan := make(chan os.Signal, 1)
-	signal.Notify(sigChan, syscall.SIGHUP)
-	go func() {
-		for {
-			<-sigChan
-			log.Printf("Received a SIGHUP. Reloading Bouncers from %s", config.bouncersConfigFile)
-			bouncers, err := loadBouncersFromFile(config)
-			if err != nil {
-				log.Printf("Failed to parse bouncers from %s: %s. Aboring Reload.", config.bouncersConfigFile, err.Error())
-			}
-
-			bouncer.SetBouncers(bouncers, proxy)
-		}
-	}()
+	stopWatching := bouncer.WatchConfig(config.bouncersConfigFile, proxy)
+	defer stopWatching()
 
 	if config.tlsCertFile != "" && config.tlsKeyFile != "" {
 		err = server.ListenAndServeTLS(config.tlsCertFile, config.tlsKeyFile)
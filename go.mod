@@ -3,10 +3,14 @@ module github.com/sinkingpoint/alertmanager_bouncer
 go 1.13
 
 require (
-	github.com/alecthomas/template v0.0.0-20190718012654-fb15b899a751 // indirect
-	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d // indirect
-	github.com/sinkingpoint/johari-go v0.0.0-20210705232502-81bf24b7db37 // indirect
-	go.opentelemetry.io/otel v1.0.0-RC1 // indirect
+	github.com/alecthomas/units v0.0.0-20190924025748-f65c72e2690d
+	github.com/go-ldap/ldap/v3 v3.2.4
+	github.com/prometheus/client_golang v1.11.1
+	github.com/sinkingpoint/johari-go v0.0.0-20210705232502-81bf24b7db37
+	go.opentelemetry.io/contrib/propagators v0.21.0
+	go.opentelemetry.io/otel v1.0.0-RC1
+	go.opentelemetry.io/otel/trace v1.0.0-RC1
+	golang.org/x/time v0.0.0-20210220033141-f8bda1e9f3ba
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
-	gopkg.in/yaml.v2 v2.2.2
+	gopkg.in/yaml.v2 v2.3.0
 )
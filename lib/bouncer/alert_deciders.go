@@ -0,0 +1,852 @@
+package bouncer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// alertmanagerAlertSerialized represents a single alert, as POSTed to the Alertmanager API.
+// Alerts are sent as a JSON array of these, e.g.
+// [
+//   {
+//     "labels": {
+//       "alertname": "InstanceDown",
+//       "instance": "localhost:9100"
+//     },
+//     "annotations": {
+//       "summary": "The instance is down"
+//     },
+//     "startsAt": "2020-01-13T15:34:49.444Z",
+//     "endsAt": "2020-01-13T16:34:49.444Z",
+//     "generatorURL": "http://prometheus:9090/graph"
+//   }
+// ]
+type alertmanagerAlertSerialized struct {
+	Labels       map[string]string `json:"labels"`
+	Annotations  map[string]string `json:"annotations"`
+	StartsAt     string            `json:"startsAt"`
+	EndsAt       string            `json:"endsAt"`
+	GeneratorURL string            `json:"generatorURL"`
+}
+
+// AlertmanagerAlert represents an Alert being pushed to Alertmanager.
+// StartsAt and EndsAt are the zero time if they weren't given
+type AlertmanagerAlert struct {
+	Labels       map[string]string
+	Annotations  map[string]string
+	StartsAt     time.Time
+	EndsAt       time.Time
+	GeneratorURL string
+}
+
+// IsResolved returns whether the given alert is being pushed as resolved as of the given time,
+// i.e. it has an endsAt that isn't in the future. Alerts without an endsAt are firing
+func (a AlertmanagerAlert) IsResolved(now time.Time) bool {
+	return !a.EndsAt.IsZero() && !a.EndsAt.After(now)
+}
+
+func parseAlertTime(name string, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	parsed, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("%s %s is not a valid RFC3339 time string", name, value)
+	}
+
+	return parsed, nil
+}
+
+func parseAlertmanagerAlerts(body io.ReadCloser) ([]AlertmanagerAlert, error) {
+	bodyBytes, err := ioutil.ReadAll(body)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read body")
+	}
+
+	serialized := []alertmanagerAlertSerialized{}
+	if err := json.Unmarshal(bodyBytes, &serialized); err != nil {
+		return nil, fmt.Errorf("Body is not a valid list of alerts: %s", err)
+	}
+
+	alerts := make([]AlertmanagerAlert, len(serialized))
+	for i, alert := range serialized {
+		startsAt, err := parseAlertTime("Start Time", alert.StartsAt)
+		if err != nil {
+			return nil, fmt.Errorf("Alert %d: %s", i, err)
+		}
+
+		endsAt, err := parseAlertTime("End Time", alert.EndsAt)
+		if err != nil {
+			return nil, fmt.Errorf("Alert %d: %s", i, err)
+		}
+
+		alerts[i] = AlertmanagerAlert{
+			Labels:       alert.Labels,
+			Annotations:  alert.Annotations,
+			StartsAt:     startsAt,
+			EndsAt:       endsAt,
+			GeneratorURL: alert.GeneratorURL,
+		}
+	}
+
+	return alerts, nil
+}
+
+// parseLabelSelector parses a comma separated list of label matchers, e.g. `severity=critical,team=~infra.*`
+// into the matchers it represents. Each matcher can use any of the Alertmanager operators (=, !=, =~, !~)
+func parseLabelSelector(selector string) ([]matcher, error) {
+	matchers := []matcher{}
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		index := strings.IndexAny(part, "=!")
+		if index <= 0 {
+			return nil, fmt.Errorf("Invalid label matcher %q. Expected name=value", part)
+		}
+
+		name, operator := strings.TrimSpace(part[:index]), ""
+		for _, op := range []string{"=~", "!~", "!=", "="} {
+			if strings.HasPrefix(part[index:], op) {
+				operator = op
+				break
+			}
+		}
+
+		if operator == "" {
+			return nil, fmt.Errorf("Invalid label matcher %q. Expected name=value", part)
+		}
+
+		isEqual := operator == "=" || operator == "=~"
+		m := matcher{
+			Name:    name,
+			Value:   strings.TrimSpace(part[index+len(operator):]),
+			IsRegex: operator == "=~" || operator == "!~",
+			IsEqual: &isEqual,
+		}
+
+		if m.IsRegex {
+			if _, err := regexp.Compile(m.Value); err != nil {
+				return nil, fmt.Errorf("Invalid regex in label matcher %q: %s", part, err)
+			}
+		}
+
+		matchers = append(matchers, m)
+	}
+
+	if len(matchers) == 0 {
+		return nil, fmt.Errorf("Label selector %q has no matchers", selector)
+	}
+
+	return matchers, nil
+}
+
+// parseLabelSelectors parses a semicolon separated list of label selectors,
+// e.g. `job=bouncer;alertname=BouncerDown,severity=page`
+func parseLabelSelectors(selectors string) ([][]matcher, error) {
+	parsed := [][]matcher{}
+	for _, selector := range strings.Split(selectors, ";") {
+		if strings.TrimSpace(selector) == "" {
+			continue
+		}
+
+		matchers, err := parseLabelSelector(selector)
+		if err != nil {
+			return nil, err
+		}
+
+		parsed = append(parsed, matchers)
+	}
+
+	if len(parsed) == 0 {
+		return nil, fmt.Errorf("No label selectors given")
+	}
+
+	return parsed, nil
+}
+
+// selectorMatches returns whether every matcher in the given selector matches the label set
+func selectorMatches(selector []matcher, labels map[string]string) bool {
+	for _, m := range selector {
+		if matches, err := m.MatchesLabels(labels); err != nil || !matches {
+			return false
+		}
+	}
+
+	return true
+}
+
+// labelsFingerprint computes a stable hash of the given label set,
+// independent of the order the labels were sent in
+func labelsFingerprint(labels map[string]string) uint64 {
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	hash := fnv.New64a()
+	for _, name := range names {
+		hash.Write([]byte(name))
+		hash.Write([]byte{255})
+		hash.Write([]byte(labels[name]))
+		hash.Write([]byte{255})
+	}
+
+	return hash.Sum64()
+}
+
+// NormalizeAlertBatchDecider returns a mutating Decider which rewrites a batch of alerts into
+// a canonical order, for downstream tooling that expects one. "sortBy" can be "fingerprint" (the default),
+// "startsAt", or "label:<name>" to sort by the value of a given label. If "sortLabels" is "true", the keys
+// of every alert are re-encoded in sorted order as well. Bodies that aren't a JSON array of alerts, or that are already
+// normalized, are left untouched, so validating the alerts is left to the backend
+func NormalizeAlertBatchDecider(config map[string]string) Decider {
+	return deciderOrNil("normalize_alert_batch", newNormalizeAlertBatchDecider, config)
+}
+
+func newNormalizeAlertBatchDecider(config DeciderConfig) (Decider, error) {
+	sortBy := config["sortBy"]
+	if sortBy == "" {
+		sortBy = "fingerprint"
+	}
+
+	if sortBy != "fingerprint" && sortBy != "startsAt" && !strings.HasPrefix(sortBy, "label:") {
+		return nil, fmt.Errorf("sortBy: %s is not one of fingerprint, startsAt or label:<name>", sortBy)
+	}
+
+	sortLabels := config["sortLabels"] == "true"
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Failed to read body"),
+			}
+		}
+
+		var rawAlerts []json.RawMessage
+		if err := json.Unmarshal(bodyBytes, &rawAlerts); err != nil {
+			// Not an array of alerts, so there's nothing for us to normalize
+			return nil
+		}
+
+		type sortableAlert struct {
+			raw      []byte
+			key      string
+			startsAt time.Time
+			fp       uint64
+		}
+
+		alerts := make([]sortableAlert, len(rawAlerts))
+		for i, raw := range rawAlerts {
+			alert := alertmanagerAlertSerialized{}
+			if err := json.Unmarshal(raw, &alert); err != nil {
+				// Not something we know how to order, so the backend can reject it
+				return nil
+			}
+
+			alerts[i] = sortableAlert{
+				raw: raw,
+				fp:  labelsFingerprint(alert.Labels),
+			}
+
+			if sortBy == "startsAt" {
+				// Timestamps are compared as times, as RFC3339 strings with different precisions or offsets don't sort as text.
+				// Alerts without one have the zero time, so sort first
+				alerts[i].startsAt, err = parseAlertTime("startsAt", alert.StartsAt)
+				if err != nil {
+					return nil
+				}
+			} else if strings.HasPrefix(sortBy, "label:") {
+				alerts[i].key = alert.Labels[strings.TrimPrefix(sortBy, "label:")]
+			}
+
+			if sortLabels {
+				// Go encodes maps with sorted keys, so a round trip through a generic map is enough to sort every level
+				var generic map[string]interface{}
+				if err := json.Unmarshal(raw, &generic); err != nil {
+					return nil
+				}
+
+				alerts[i].raw, _ = json.Marshal(generic)
+			}
+		}
+
+		// Ties are broken by the fingerprint so that the order is fully deterministic
+		sort.SliceStable(alerts, func(i, j int) bool {
+			if !alerts[i].startsAt.Equal(alerts[j].startsAt) {
+				return alerts[i].startsAt.Before(alerts[j].startsAt)
+			}
+
+			if alerts[i].key != alerts[j].key {
+				return alerts[i].key < alerts[j].key
+			}
+
+			return alerts[i].fp < alerts[j].fp
+		})
+
+		changed := false
+		for i := range alerts {
+			if !bytes.Equal(rawAlerts[i], alerts[i].raw) {
+				rawAlerts[i] = alerts[i].raw
+				changed = true
+			}
+		}
+
+		if !changed {
+			return nil
+		}
+
+		normalized, err := json.Marshal(rawAlerts)
+		if err != nil {
+			return &HTTPError{
+				Status: 500,
+				Err:    fmt.Errorf("Failed to encode normalized alerts: %s", err),
+			}
+		}
+
+		RewriteBody(req, normalized)
+		return nil
+	}, nil
+}
+
+// ScopedResolutionDecider returns a Decider which stops clients from resolving other teams' alerts.
+// Alerts pushed with an endsAt that isn't in the future are resolutions, and those must have a
+// "teamLabel" (default "team") that equals the caller's team, taken from the "teamHeader" (default X-Team).
+// Firing alerts (no endsAt, or one in the future) are left alone
+func ScopedResolutionDecider(config map[string]string) Decider {
+	teamLabel := config["teamLabel"]
+	if teamLabel == "" {
+		teamLabel = "team"
+	}
+
+	teamHeader := config["teamHeader"]
+	if teamHeader == "" {
+		teamHeader = "X-Team"
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		alerts, err := parseAlertmanagerAlerts(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		team := requestIdentity(req, teamHeader)
+		now := time.Now()
+		for i, alert := range alerts {
+			if !alert.IsResolved(now) {
+				continue
+			}
+
+			if team == "" {
+				return &HTTPError{
+					Status: 403,
+					Err:    fmt.Errorf("Resolving alerts requires a team in the %s header", teamHeader),
+				}
+			}
+
+			if alert.Labels[teamLabel] != team {
+				return &HTTPError{
+					Status: 403,
+					Err:    fmt.Errorf("Alert %d belongs to %s %q, so can't be resolved by %q", i, teamLabel, alert.Labels[teamLabel], team),
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// TeamSeverityAllowlistDecider returns a Decider which checks that every alert has a "severityLabel" (default "severity")
+// that the caller's team, taken from the "teamHeader" (default X-Team), is allowed to use. "teams" is a semicolon separated list of
+// `<team>=<severities>` pairs, where severities is a comma separated list, e.g. `payments=critical,warning;batch=warning,info`.
+// Teams that aren't listed are allowed the "default" severities if they're set, and can't push alerts otherwise
+func TeamSeverityAllowlistDecider(config map[string]string) Decider {
+	return deciderOrNil("team_severity_allowlist", newTeamSeverityAllowlistDecider, config)
+}
+
+func newTeamSeverityAllowlistDecider(config DeciderConfig) (Decider, error) {
+	severityLabel := config["severityLabel"]
+	if severityLabel == "" {
+		severityLabel = "severity"
+	}
+
+	teamHeader := config["teamHeader"]
+	if teamHeader == "" {
+		teamHeader = "X-Team"
+	}
+
+	allowed := map[string]map[string]bool{}
+	for _, pair := range strings.Split(config["teams"], ";") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+
+		index := strings.Index(pair, "=")
+		if index == -1 {
+			return nil, fmt.Errorf("teams: %q is not of the form <team>=<severities>", pair)
+		}
+
+		severities := map[string]bool{}
+		for _, severity := range parseConfigList(pair[index+1:]) {
+			severities[severity] = true
+		}
+		allowed[strings.TrimSpace(pair[:index])] = severities
+	}
+
+	var defaultSeverities map[string]bool
+	if config["default"] != "" {
+		defaultSeverities = map[string]bool{}
+		for _, severity := range parseConfigList(config["default"]) {
+			defaultSeverities[severity] = true
+		}
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		alerts, err := parseAlertmanagerAlerts(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		team := requestIdentity(req, teamHeader)
+		severities, ok := allowed[team]
+		if !ok {
+			severities = defaultSeverities
+		}
+
+		for i, alert := range alerts {
+			severity, ok := alert.Labels[severityLabel]
+			if !ok {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("Alert %d (%s) is missing the %s label", i, alert.Labels["alertname"], severityLabel),
+				}
+			}
+
+			if !severities[severity] {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("Alert %d (%s) has %s %q, which team %q isn't allowed to use", i, alert.Labels["alertname"], severityLabel, severity, team),
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// ClockSkewGuardDecider returns a Decider which catches clients with skewed clocks, by checking each alert's startsAt against our
+// time. Alerts starting more than "tolerance" (e.g. 30s) in the future are rejected. As Prometheus keeps re-sending firing alerts with
+// their original startsAt, alerts starting in the past are only checked if a "pastTolerance" is set. If "mode" is "warn", skewed alerts
+// are logged but let through, which is useful to find skewed clients before enforcing. Alerts without a startsAt are skipped
+func ClockSkewGuardDecider(config map[string]string) Decider {
+	return deciderOrNil("clock_skew_guard", newClockSkewGuardDecider, config)
+}
+
+func newClockSkewGuardDecider(config DeciderConfig) (Decider, error) {
+	tolerance, err := time.ParseDuration(config["tolerance"])
+	if err != nil {
+		return nil, fmt.Errorf("tolerance: %s", err)
+	}
+
+	pastTolerance := time.Duration(-1)
+	if config["pastTolerance"] != "" {
+		pastTolerance, err = time.ParseDuration(config["pastTolerance"])
+		if err != nil {
+			return nil, fmt.Errorf("pastTolerance: %s", err)
+		}
+	}
+
+	mode := config["mode"]
+	if mode == "" {
+		mode = "reject"
+	}
+
+	if mode != "reject" && mode != "warn" {
+		return nil, fmt.Errorf("mode: %s is not one of reject or warn", mode)
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		alerts, err := parseAlertmanagerAlerts(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		now := time.Now()
+		for i, alert := range alerts {
+			if alert.StartsAt.IsZero() {
+				continue
+			}
+
+			var skewErr error
+			if skew := alert.StartsAt.Sub(now); skew > tolerance {
+				skewErr = fmt.Errorf("Alert %d (%s) starts %s in the future, more than the allowed %s. Check the sender's clock", i, alert.Labels["alertname"], skew.Round(time.Millisecond), tolerance)
+			} else if pastTolerance >= 0 && -skew > pastTolerance {
+				skewErr = fmt.Errorf("Alert %d (%s) started %s ago, more than the allowed %s. Check the sender's clock", i, alert.Labels["alertname"], (-skew).Round(time.Millisecond), pastTolerance)
+			}
+
+			if skewErr == nil {
+				continue
+			}
+
+			if mode == "warn" {
+				currentLogger().Warn("Alert timestamp is skewed", "decider", "clock_skew_guard", "error", skewErr.Error())
+				continue
+			}
+
+			return &HTTPError{
+				Status: 400,
+				Err:    skewErr,
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// defaultSecretPatterns are the regexes of well known secret formats that annotation_secret_scan looks for by default
+var defaultSecretPatterns = []string{
+	`AKIA[0-9A-Z]{16}`,                                     // AWS access key IDs
+	`gh[pousr]_[A-Za-z0-9]{36}`,                            // GitHub tokens
+	`xox[abposr]-[A-Za-z0-9-]{10,}`,                        // Slack tokens
+	`-----BEGIN [A-Z ]*PRIVATE KEY-----`,                   // PEM private keys
+	`eyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+`, // JWTs
+	`(?i)bearer [A-Za-z0-9._~+/-]{20,}=*`,                  // Bearer tokens in headers
+}
+
+// shannonEntropy returns the entropy of the given string, in bits per character
+func shannonEntropy(s string) float64 {
+	if len(s) == 0 {
+		return 0
+	}
+
+	counts := map[rune]int{}
+	total := 0
+	for _, r := range s {
+		counts[r]++
+		total++
+	}
+
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(total)
+		entropy -= p * math.Log2(p)
+	}
+
+	return entropy
+}
+
+// AnnotationSecretScanDecider returns a Decider which rejects alerts whose annotations look like they contain
+// secrets, to stop tokens leaking into the UI and notifications. An annotation value is a likely secret if it
+// matches any of the "patterns" (newline separated regexes, defaulting to defaultSecretPatterns), or if it contains
+// a word at least "minTokenLength" (default 20) characters long with an entropy above "entropyThreshold" (default 4.5 bits
+// per character, 0 disables it). Only the annotation name is reported, so the secret isn't echoed back
+func AnnotationSecretScanDecider(config map[string]string) Decider {
+	return deciderOrNil("annotation_secret_scan", newAnnotationSecretScanDecider, config)
+}
+
+func newAnnotationSecretScanDecider(config DeciderConfig) (Decider, error) {
+	patternStrs := defaultSecretPatterns
+	if config["patterns"] != "" {
+		patternStrs = []string{}
+		for _, pattern := range strings.Split(config["patterns"], "\n") {
+			if pattern = strings.TrimSpace(pattern); pattern != "" {
+				patternStrs = append(patternStrs, pattern)
+			}
+		}
+	}
+
+	patterns := make([]*regexp.Regexp, len(patternStrs))
+	for i, pattern := range patternStrs {
+		regex, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("pattern: %s", err)
+		}
+		patterns[i] = regex
+	}
+
+	entropyThreshold := 4.5
+	if config["entropyThreshold"] != "" {
+		threshold, err := strconv.ParseFloat(config["entropyThreshold"], 64)
+		if err != nil {
+			return nil, fmt.Errorf("entropyThreshold: %s", err)
+		}
+		entropyThreshold = threshold
+	}
+
+	minTokenLength := 20
+	if config["minTokenLength"] != "" {
+		length, err := strconv.Atoi(config["minTokenLength"])
+		if err != nil {
+			return nil, fmt.Errorf("minTokenLength: %s", err)
+		}
+		minTokenLength = length
+	}
+
+	looksSecret := func(value string) bool {
+		for _, pattern := range patterns {
+			if pattern.MatchString(value) {
+				return true
+			}
+		}
+
+		if entropyThreshold <= 0 {
+			return false
+		}
+
+		for _, token := range strings.Fields(value) {
+			if len(token) >= minTokenLength && shannonEntropy(token) > entropyThreshold {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		alerts, err := parseAlertmanagerAlerts(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		for i, alert := range alerts {
+			for name, value := range alert.Annotations {
+				if looksSecret(value) {
+					return &HTTPError{
+						Status: 400,
+						Err:    fmt.Errorf("Alert %d's %s annotation looks like it contains a secret. Secrets shouldn't be put in annotations", i, name),
+					}
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// RequireTargetLabelDecider returns a Decider which rejects alerts matching the "selector" (e.g. `category=infra`)
+// that don't have at least one of the comma separated "labels" (e.g. `instance,pod`) identifying their target
+func RequireTargetLabelDecider(config map[string]string) Decider {
+	return deciderOrNil("require_target_label", newRequireTargetLabelDecider, config)
+}
+
+func newRequireTargetLabelDecider(config DeciderConfig) (Decider, error) {
+	selector, err := parseLabelSelector(config["selector"])
+	if err != nil {
+		return nil, fmt.Errorf("selector: %s", err)
+	}
+
+	targetLabels := parseConfigList(config["labels"])
+	if len(targetLabels) == 0 {
+		return nil, fmt.Errorf("labels: no labels given")
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		alerts, err := parseAlertmanagerAlerts(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		for i, alert := range alerts {
+			if !selectorMatches(selector, alert.Labels) {
+				continue
+			}
+
+			hasTarget := false
+			for _, label := range targetLabels {
+				if alert.Labels[label] != "" {
+					hasTarget = true
+					break
+				}
+			}
+
+			if !hasTarget {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("Alert %d (%v) must have at least one of the labels %s", i, alert.Labels, strings.Join(targetLabels, ", ")),
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// RequireResolveTimeoutDecider returns a Decider which rejects alerts matching the "selector" that don't have
+// an "annotation" (default resolve_timeout) holding a valid, positive, duration (e.g. `72h`), which governs how
+// long the alert stays firing without being re-sent
+func RequireResolveTimeoutDecider(config map[string]string) Decider {
+	return deciderOrNil("require_resolve_timeout", newRequireResolveTimeoutDecider, config)
+}
+
+func newRequireResolveTimeoutDecider(config DeciderConfig) (Decider, error) {
+	selector, err := parseLabelSelector(config["selector"])
+	if err != nil {
+		return nil, fmt.Errorf("selector: %s", err)
+	}
+
+	annotation := config["annotation"]
+	if annotation == "" {
+		annotation = "resolve_timeout"
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		alerts, err := parseAlertmanagerAlerts(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		for i, alert := range alerts {
+			if !selectorMatches(selector, alert.Labels) {
+				continue
+			}
+
+			value, ok := alert.Annotations[annotation]
+			if !ok {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("Alert %d (%v) must have a %s annotation", i, alert.Labels, annotation),
+				}
+			}
+
+			if timeout, err := time.ParseDuration(value); err != nil || timeout <= 0 {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("Alert %d (%v) has a %s annotation of %q, which isn't a valid duration", i, alert.Labels, annotation, value),
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// ResolveStateConsistencyDecider returns a Decider which rejects alerts whose state is contradictory. Exactly, an alert is
+// rejected if it is resolved (its endsAt isn't in the future) while one of its labels or annotations named in "stateKeys"
+// (default state,status) has one of the "firingValues" (default firing,active, case insensitive), claiming it is still active.
+// Alerts which end before they start are rejected too
+func ResolveStateConsistencyDecider(config map[string]string) Decider {
+	stateKeysStr, ok := config["stateKeys"]
+	if !ok {
+		stateKeysStr = "state,status"
+	}
+	stateKeys := parseConfigList(stateKeysStr)
+
+	firingValuesStr, ok := config["firingValues"]
+	if !ok {
+		firingValuesStr = "firing,active"
+	}
+
+	firingValues := map[string]bool{}
+	for _, value := range parseConfigList(firingValuesStr) {
+		firingValues[strings.ToLower(value)] = true
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		alerts, err := parseAlertmanagerAlerts(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		now := time.Now()
+		for i, alert := range alerts {
+			if !alert.StartsAt.IsZero() && !alert.EndsAt.IsZero() && alert.EndsAt.Before(alert.StartsAt) {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("Alert %d (%v) ends at %s, before it starts at %s", i, alert.Labels, alert.EndsAt, alert.StartsAt),
+				}
+			}
+
+			if !alert.IsResolved(now) {
+				continue
+			}
+
+			for _, key := range stateKeys {
+				for kind, values := range map[string]map[string]string{"label": alert.Labels, "annotation": alert.Annotations} {
+					if value, ok := values[key]; ok && firingValues[strings.ToLower(value)] {
+						return &HTTPError{
+							Status: 400,
+							Err:    fmt.Errorf("Alert %d (%v) is resolved (endsAt %s), but its %s %s says it is %s", i, alert.Labels, alert.EndsAt, key, kind, value),
+						}
+					}
+				}
+			}
+		}
+
+		return nil
+	}
+}
+
+// RequireAlertLabelsDecider returns a Decider which rejects batches of alerts where any alert is missing one of the "labels"
+// (a comma separated list, e.g. `severity,team`). Labels with an empty value count as missing, as Alertmanager drops them
+func RequireAlertLabelsDecider(config map[string]string) Decider {
+	return deciderOrNil("require_alert_labels", newRequireAlertLabelsDecider, config)
+}
+
+func newRequireAlertLabelsDecider(config DeciderConfig) (Decider, error) {
+	labels := config.GetStringSlice("labels")
+	if len(labels) == 0 {
+		return nil, fmt.Errorf("labels: at least one label is required")
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		alerts, err := parseAlertmanagerAlerts(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		for i, alert := range alerts {
+			for _, label := range labels {
+				if alert.Labels[label] == "" {
+					return &HTTPError{
+						Status: 400,
+						Err:    fmt.Errorf("Alert %d (%s) is missing the required %s label", i, alert.Labels["alertname"], label),
+					}
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
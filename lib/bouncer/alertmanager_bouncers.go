@@ -6,52 +6,391 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
-	"log"
 	"net/http"
 	"regexp"
 	"strings"
+	"sync"
 	"time"
 
 	johari "github.com/sinkingpoint/johari-go/lib"
 )
 
+// DeciderTemplate builds a Decider from its config, returning an error saying what's wrong if the config is invalid
+type DeciderTemplate func(config DeciderConfig) (Decider, error)
+
 type deciderTemplate struct {
 	requiredConfigVars []string
-	templateFunc       func(map[string]string) Decider
+	templateFunc       DeciderTemplate
+}
+
+// templateFromDecider adapts a decider constructor that returns nil for invalid config into a DeciderTemplate
+func templateFromDecider(templateFunc func(config map[string]string) Decider) DeciderTemplate {
+	return func(config DeciderConfig) (Decider, error) {
+		decider := templateFunc(config)
+		if decider == nil {
+			return nil, fmt.Errorf("the config was rejected")
+		}
+
+		return decider, nil
+	}
+}
+
+// deciderOrNil builds a decider with the given template, for the constructors that return nil for invalid config. The reason
+// the config is invalid is logged, as the caller can't get it
+func deciderOrNil(name string, template DeciderTemplate, config map[string]string) Decider {
+	decider, err := template(config)
+	if err != nil {
+		currentLogger().Warn("Failed to parse decider config", "decider", name, "error", err.Error())
+		return nil
+	}
+
+	return decider
 }
 
 var deciderTemplates map[string]deciderTemplate
 
+// customDeciderTemplates are the deciders registered with RegisterDecider, which are
+// kept separately so that they survive InitDeciderTemplates resetting the built in ones
+var customDeciderTemplates = map[string]deciderTemplate{}
+
+// deciderTemplatesLock guards deciderTemplates and customDeciderTemplates
+var deciderTemplatesLock sync.Mutex
+
 // InitDeciderTemplates sets up the bouncerTemplates map
 // allowing finding a bouncerTemplate by a given name. Used to
 // deserialize a list of bouncers
 func InitDeciderTemplates() {
+	deciderTemplatesLock.Lock()
+	defer deciderTemplatesLock.Unlock()
+
+	initDeciderTemplates()
+}
+
+// RegisterDecider makes a custom decider available to ParseBouncers under the given name, alongside the built in ones.
+// ParseBouncers checks that every name in requiredConfigVars is set before calling templateFunc, which should log and return
+// nil if the config is invalid. Returns an error if a decider with the name already exists, so that deciders can't clobber each other.
+// Use RegisterDeciderTemplate for deciders that can say what's wrong with their config
+func RegisterDecider(name string, requiredConfigVars []string, templateFunc func(config map[string]string) Decider) error {
+	return RegisterDeciderTemplate(name, requiredConfigVars, templateFromDecider(templateFunc))
+}
+
+// RegisterDeciderTemplate is like RegisterDecider, but the template returns an error if its config is invalid, which is
+// reported by ParseBouncers (and --check-config) alongside the bouncer and decider it's for
+func RegisterDeciderTemplate(name string, requiredConfigVars []string, templateFunc DeciderTemplate) error {
+	deciderTemplatesLock.Lock()
+	defer deciderTemplatesLock.Unlock()
+
+	if deciderTemplates == nil {
+		initDeciderTemplates()
+	}
+
+	if _, exists := deciderTemplates[name]; exists {
+		return fmt.Errorf("A decider named %s is already registered", name)
+	}
+
+	template := deciderTemplate{
+		requiredConfigVars: requiredConfigVars,
+		templateFunc:       templateFunc,
+	}
+
+	customDeciderTemplates[name] = template
+	deciderTemplates[name] = template
+	return nil
+}
+
+// UnregisterDecider removes a decider registered with RegisterDecider, e.g. to clean up after tests
+func UnregisterDecider(name string) {
+	deciderTemplatesLock.Lock()
+	defer deciderTemplatesLock.Unlock()
+
+	if _, exists := customDeciderTemplates[name]; !exists {
+		return
+	}
+
+	delete(customDeciderTemplates, name)
+	delete(deciderTemplates, name)
+}
+
+// lookupDeciderTemplate returns the decider template with the given name, if there is one
+func lookupDeciderTemplate(name string) (deciderTemplate, bool) {
+	deciderTemplatesLock.Lock()
+	defer deciderTemplatesLock.Unlock()
+
+	if deciderTemplates == nil {
+		initDeciderTemplates()
+	}
+
+	template, exists := deciderTemplates[name]
+	return template, exists
+}
+
+// initDeciderTemplates resets deciderTemplates to the built in deciders, plus the custom ones.
+// deciderTemplatesLock must be held
+func initDeciderTemplates() {
 	deciderTemplates = map[string]deciderTemplate{
 		"AllSilencesHaveAuthor": {
 			requiredConfigVars: []string{"domain"},
-			templateFunc:       AllSilencesHaveAuthorDecider,
+			templateFunc:       templateFromDecider(AllSilencesHaveAuthorDecider),
 		},
 		"Mirror": {
 			requiredConfigVars: []string{"destination"},
-			templateFunc:       MirrorDecider,
+			templateFunc:       templateFromDecider(MirrorDecider),
 		},
 		"SilencesDontExpireOnWeekends": {
 			requiredConfigVars: []string{},
-			templateFunc:       SilencesDontExpireOnWeekendsDecider,
+			templateFunc:       templateFromDecider(SilencesDontExpireOnWeekendsDecider),
 		},
 		"LongSilencesHaveTicket": {
 			requiredConfigVars: []string{"maxLength"},
-			templateFunc:       LongSilencesHaveTicketDecider,
+			templateFunc:       newLongSilencesHaveTicketDecider,
+		},
+		"normalize_alert_batch": {
+			requiredConfigVars: []string{},
+			templateFunc:       newNormalizeAlertBatchDecider,
+		},
+		"protect_self_monitoring": {
+			requiredConfigVars: []string{"selectors"},
+			templateFunc:       newProtectSelfMonitoringDecider,
+		},
+		"env_guard": {
+			requiredConfigVars: []string{"environment"},
+			templateFunc:       templateFromDecider(EnvGuardDecider),
+		},
+		"scoped_resolution": {
+			requiredConfigVars: []string{},
+			templateFunc:       templateFromDecider(ScopedResolutionDecider),
+		},
+		"enum_field": {
+			requiredConfigVars: []string{"path", "values"},
+			templateFunc:       newEnumFieldDecider,
+		},
+		"path_body_limit": {
+			requiredConfigVars: []string{"limits"},
+			templateFunc:       newPathBodyLimitDecider,
+		},
+		"annotation_secret_scan": {
+			requiredConfigVars: []string{},
+			templateFunc:       newAnnotationSecretScanDecider,
+		},
+		"body_required_for_method": {
+			requiredConfigVars: []string{},
+			templateFunc:       newBodyRequiredForMethodDecider,
+		},
+		"matcher_operator_allowlist": {
+			requiredConfigVars: []string{"allowed"},
+			templateFunc:       newMatcherOperatorAllowlistDecider,
+		},
+		"idempotent_replay": {
+			requiredConfigVars: []string{},
+			templateFunc:       newIdempotentReplayDecider,
+		},
+		"require_target_label": {
+			requiredConfigVars: []string{"selector", "labels"},
+			templateFunc:       newRequireTargetLabelDecider,
+		},
+		"anti_replay": {
+			requiredConfigVars: []string{"maxAge"},
+			templateFunc:       newAntiReplayDecider,
+		},
+		"require_resolve_timeout": {
+			requiredConfigVars: []string{"selector"},
+			templateFunc:       newRequireResolveTimeoutDecider,
+		},
+		"require_fresh_config": {
+			requiredConfigVars: []string{"maxAge"},
+			templateFunc:       newRequireFreshConfigDecider,
+		},
+		"resolve_state_consistency": {
+			requiredConfigVars: []string{},
+			templateFunc:       templateFromDecider(ResolveStateConsistencyDecider),
+		},
+		"matcher_label_pattern": {
+			requiredConfigVars: []string{"pattern"},
+			templateFunc:       newMatcherLabelPatternDecider,
+		},
+		"complexity_budget": {
+			requiredConfigVars: []string{"budget"},
+			templateFunc:       newComplexityBudgetDecider,
+		},
+		"silence_renewal_guard": {
+			requiredConfigVars: []string{"alertmanagerURL"},
+			templateFunc:       newSilenceRenewalGuardDecider,
 		},
+		"require_upstream_chain": {
+			requiredConfigVars: []string{"secret"},
+			templateFunc:       newRequireUpstreamChainDecider,
+		},
+		"clean_label_chars": {
+			requiredConfigVars: []string{},
+			templateFunc:       newCleanLabelCharsDecider,
+		},
+		"require_anchor_matcher": {
+			requiredConfigVars: []string{"anchors"},
+			templateFunc:       newRequireAnchorMatcherDecider,
+		},
+		"feature_flag_gate": {
+			requiredConfigVars: []string{"flag", "decider"},
+			templateFunc:       newFeatureFlagGateDecider,
+		},
+		"matcher_fingerprint_rate": {
+			requiredConfigVars: []string{"limit", "window"},
+			templateFunc:       newMatcherFingerprintRateDecider,
+		},
+		"backend_preflight": {
+			requiredConfigVars: []string{"healthURL"},
+			templateFunc:       newBackendPreflightDecider,
+		},
+		"team_severity_allowlist": {
+			requiredConfigVars: []string{"teams"},
+			templateFunc:       newTeamSeverityAllowlistDecider,
+		},
+		"matcher_regex_ratio": {
+			requiredConfigVars: []string{"maxRatio"},
+			templateFunc:       newMatcherRegexRatioDecider,
+		},
+		"reject_duplicate_json_keys": {
+			requiredConfigVars: []string{},
+			templateFunc:       templateFromDecider(RejectDuplicateJSONKeysDecider),
+		},
+		"clock_skew_guard": {
+			requiredConfigVars: []string{"tolerance"},
+			templateFunc:       newClockSkewGuardDecider,
+		},
+		"ldap_group_gate": {
+			requiredConfigVars: []string{"url", "bindDN", "bindPassword", "baseDN", "allowedGroups"},
+			templateFunc:       newLDAPGroupGateDecider,
+		},
+		"max_array_length": {
+			requiredConfigVars: []string{"path", "max"},
+			templateFunc:       newMaxArrayLengthDecider,
+		},
+		"require_update_reason": {
+			requiredConfigVars: []string{},
+			templateFunc:       newRequireUpdateReasonDecider,
+		},
+		"max_silence_duration": {
+			requiredConfigVars: []string{"maxDuration"},
+			templateFunc:       newMaxSilenceDurationDecider,
+		},
+		"require_silence_metadata": {
+			requiredConfigVars: []string{},
+			templateFunc:       newRequireSilenceMetadataDecider,
+		},
+		"silence_matcher_policy": {
+			requiredConfigVars: []string{},
+			templateFunc:       newSilenceMatcherPolicyDecider,
+		},
+		"ip_allowlist": {
+			requiredConfigVars: []string{"cidrs"},
+			templateFunc:       newIPAllowlistDecider,
+		},
+		"require_token": {
+			requiredConfigVars: []string{},
+			templateFunc:       newRequireTokenDecider,
+		},
+		"rate_limit": {
+			requiredConfigVars: []string{"rate", "burst"},
+			templateFunc:       newRateLimitDecider,
+		},
+		"time_window": {
+			requiredConfigVars: []string{"allow"},
+			templateFunc:       newTimeWindowDecider,
+		},
+		"external_auth": {
+			requiredConfigVars: []string{"url"},
+			templateFunc:       newExternalAuthDecider,
+		},
+		"require_alert_labels": {
+			requiredConfigVars: []string{"labels"},
+			templateFunc:       newRequireAlertLabelsDecider,
+		},
+		"silence_owner_guard": {
+			requiredConfigVars: []string{"alertmanagerURL"},
+			templateFunc:       newSilenceOwnerGuardDecider,
+		},
+		"max_active_silences": {
+			requiredConfigVars: []string{"alertmanagerURL", "max"},
+			templateFunc:       newMaxActiveSilencesDecider,
+		},
+		"validate_silence_regex": {
+			requiredConfigVars: []string{},
+			templateFunc:       templateFromDecider(ValidateSilenceRegexDecider),
+		},
+	}
+
+	for name, template := range customDeciderTemplates {
+		deciderTemplates[name] = template
+	}
+}
+
+// parseConfigList splits a comma separated config value into its (trimmed, non empty) parts
+func parseConfigList(value string) []string {
+	list := []string{}
+	for _, part := range strings.Split(value, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			list = append(list, part)
+		}
 	}
+
+	return list
 }
 
 type matcher struct {
 	IsRegex bool   `json:"isRegex"`
+	IsEqual *bool  `json:"isEqual,omitempty"`
 	Name    string `json:"name"`
 	Value   string `json:"value"`
 }
 
+// isEqual returns whether the matcher is a positive (= or =~) matcher. The v1 API
+// has no isEqual field, so matchers without one are positive
+func (m matcher) isEqual() bool {
+	return m.IsEqual == nil || *m.IsEqual
+}
+
+// operator returns the Alertmanager operator this matcher represents, one of =, !=, =~ or !~
+func (m matcher) operator() string {
+	switch {
+	case m.isEqual() && !m.IsRegex:
+		return "="
+	case !m.isEqual() && !m.IsRegex:
+		return "!="
+	case m.isEqual() && m.IsRegex:
+		return "=~"
+	default:
+		return "!~"
+	}
+}
+
+// String returns the matcher as it would be written in amtool, e.g. `alertname=~"Instance.*"`
+func (m matcher) String() string {
+	return fmt.Sprintf("%s%s%q", m.Name, m.operator(), m.Value)
+}
+
+// Matches returns whether the given label value would be matched by this matcher,
+// following Alertmanager semantics where regexes are fully anchored, and a missing
+// label behaves as if it has an empty value
+func (m matcher) Matches(value string) (bool, error) {
+	var matches bool
+	if m.IsRegex {
+		regex, err := regexp.Compile("^(?:" + m.Value + ")$")
+		if err != nil {
+			return false, err
+		}
+
+		matches = regex.MatchString(value)
+	} else {
+		matches = m.Value == value
+	}
+
+	return matches == m.isEqual(), nil
+}
+
+// MatchesLabels returns whether this matcher matches the given label set
+func (m matcher) MatchesLabels(labels map[string]string) (bool, error) {
+	return m.Matches(labels[m.Name])
+}
+
 // alertmanagerSilenceSerialized represents a serialized silence from amtool in JSON
 // e.g.
 // {
@@ -68,6 +407,7 @@ type matcher struct {
 //   "startsAt": "2020-01-13T15:34:49.444Z"
 // }
 type alertmanagerSilenceSerialized struct {
+	ID       string    `json:"id,omitempty"`
 	Comment  string    `json:"comment"`
 	Author   string    `json:"createdBy"`
 	StartsAt string    `json:"startsAt"`
@@ -75,8 +415,10 @@ type alertmanagerSilenceSerialized struct {
 	Matchers []matcher `json:"matchers"`
 }
 
-// AlertmanagerSilence represents a Silence to be applied to Alertmanager
+// AlertmanagerSilence represents a Silence to be applied to Alertmanager.
+// ID is only set when an existing silence is being updated
 type AlertmanagerSilence struct {
+	ID       string
 	Comment  string
 	Author   string
 	StartsAt time.Time
@@ -101,6 +443,7 @@ func parseAlertmanagerSilence(body io.ReadCloser) (AlertmanagerSilence, error) {
 	}
 
 	return AlertmanagerSilence{
+		ID:       serialized.ID,
 		Comment:  serialized.Comment,
 		Author:   serialized.Author,
 		StartsAt: startTime,
@@ -160,7 +503,7 @@ func MirrorDecider(config map[string]string) Decider {
 			}
 		}
 
-		log.Printf("Mirroring request to %s\n", destination)
+		currentLogger().Info("Mirroring request", "decider", "Mirror", "destination", destination)
 
 		johari.NewHTTPClientWrapper(http.DefaultClient).Do(request)
 		return nil
@@ -195,10 +538,13 @@ func SilencesDontExpireOnWeekendsDecider(config map[string]string) Decider {
 // the given duration, which don't have a comment matching the "ticket_regex" (defaults to a JIRA ticket format)
 // This allows us to not have long running throwaway silences without a ticket to track ongoing work
 func LongSilencesHaveTicketDecider(config map[string]string) Decider {
+	return deciderOrNil("LongSilencesHaveTicket", newLongSilencesHaveTicketDecider, config)
+}
+
+func newLongSilencesHaveTicketDecider(config DeciderConfig) (Decider, error) {
 	maxLengthWithoutTicket, err := time.ParseDuration(config["maxLength"])
 	if err != nil {
-		log.Printf("Failed to parse LongSilencesHaveTicket duration: %s", err)
-		return nil
+		return nil, fmt.Errorf("maxLength: %s", err)
 	}
 
 	var ticketRegexStr string
@@ -210,8 +556,7 @@ func LongSilencesHaveTicketDecider(config map[string]string) Decider {
 
 	ticketRegex, err := regexp.Compile(ticketRegexStr)
 	if err != nil {
-		log.Printf("Failed to parse LongSilencesHaveTicket ticket regex: %s", err)
-		return nil
+		return nil, fmt.Errorf("ticket_regex: %s", err)
 	}
 
 	return func(req *http.Request, context context.Context) *HTTPError {
@@ -234,5 +579,5 @@ func LongSilencesHaveTicketDecider(config map[string]string) Decider {
 		}
 
 		return nil
-	}
+	}, nil
 }
@@ -2,6 +2,7 @@ package bouncer_test
 
 import (
 	"bytes"
+	"context"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -50,7 +51,7 @@ func TestAllSilencesHaveAuthorDecider(t *testing.T) {
 	}
 
 	for _, testCase := range testCases {
-		response := testCase.decider(mustBuildRequest(testCase.input, t))
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
 		if (response == nil) != testCase.expectedSuccess {
 			var errorText string
 			if response != nil {
@@ -78,7 +79,7 @@ func TestMirrorDecider(t *testing.T) {
 	defer backend.Close()
 
 	decider := bouncer.MirrorDecider(map[string]string{"destination": backend.URL})
-	err := decider(mustBuildRequest("", t))
+	err := decider(mustBuildRequest("", t), context.Background())
 	if err != nil {
 		t.Fatalf("Got error mirroring reqest: %s", err.Err.Error())
 	}
@@ -111,7 +112,7 @@ func TestSilencesDontExpireOnWeekendsDecider(t *testing.T) {
 	}
 
 	for _, testCase := range testCases {
-		response := testCase.decider(mustBuildRequest(testCase.input, t))
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
 		if (response == nil) != testCase.expectedSuccess {
 			var errorText string
 			if response != nil {
@@ -164,7 +165,7 @@ func TestLongSilencesHaveTicketDecider(t *testing.T) {
 	}
 
 	for _, testCase := range testCases {
-		response := testCase.decider(mustBuildRequest(testCase.input, t))
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
 		if (response == nil) != testCase.expectedSuccess {
 			var errorText string
 			if response != nil {
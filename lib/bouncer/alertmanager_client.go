@@ -0,0 +1,118 @@
+package bouncer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	johari "github.com/sinkingpoint/johari-go/lib"
+)
+
+// gettableSilence is a silence as returned by the Alertmanager v2 API, which
+// extends what's POSTed with its ID and current state
+type gettableSilence struct {
+	alertmanagerSilenceSerialized
+	Status struct {
+		State string `json:"state"`
+	} `json:"status"`
+}
+
+// fetchAlertmanager GETs the given path from the Alertmanager at alertmanagerURL, decoding the JSON response
+// into out. Returns the status code of the response, which isn't treated as an error so that callers can handle 404s
+func fetchAlertmanager(ctx context.Context, alertmanagerURL string, path string, timeout time.Duration, out interface{}) (int, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	url := strings.TrimSuffix(alertmanagerURL, "/") + path
+	request, err := johari.NewChildRequest(ctx, "GET", url, nil)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to create request to %s: %s", url, err)
+	}
+
+	// NewChildRequest may have swapped in the parent span's context, so reapply our timeout on top of it
+	request = request.WithContext(ctx)
+	response, err := johari.NewHTTPClientWrapper(http.DefaultClient).Do(request)
+	if err != nil {
+		return 0, fmt.Errorf("Failed to query %s: %s", url, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, nil
+	}
+
+	body, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return response.StatusCode, fmt.Errorf("Failed to read response from %s: %s", url, err)
+	}
+
+	if err := json.Unmarshal(body, out); err != nil {
+		return response.StatusCode, fmt.Errorf("Invalid response from %s: %s", url, err)
+	}
+
+	return response.StatusCode, nil
+}
+
+// fetchSilences returns all the silences in the Alertmanager at alertmanagerURL
+func fetchSilences(ctx context.Context, alertmanagerURL string, timeout time.Duration) ([]gettableSilence, error) {
+	silences := []gettableSilence{}
+	status, err := fetchAlertmanager(ctx, alertmanagerURL, "/api/v2/silences", timeout, &silences)
+	if err != nil {
+		return nil, err
+	}
+
+	if status < 200 || status > 299 {
+		return nil, fmt.Errorf("Alertmanager returned a %d listing silences", status)
+	}
+
+	return silences, nil
+}
+
+// fetchSilence returns the silence with the given ID in the Alertmanager at alertmanagerURL, or nil if it doesn't exist
+func fetchSilence(ctx context.Context, alertmanagerURL string, id string, timeout time.Duration) (*gettableSilence, error) {
+	var silence gettableSilence
+	status, err := fetchAlertmanager(ctx, alertmanagerURL, "/api/v2/silence/"+url.PathEscape(id), timeout, &silence)
+	if err != nil {
+		return nil, err
+	}
+
+	if status == http.StatusNotFound {
+		return nil, nil
+	}
+
+	if status < 200 || status > 299 {
+		return nil, fmt.Errorf("Alertmanager returned a %d getting silence %s", status, id)
+	}
+
+	return &silence, nil
+}
+
+// checkHealth GETs the given health check URL, returning an error if it can't be reached
+// or doesn't respond with a 2xx within the timeout
+func checkHealth(ctx context.Context, healthURL string, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	request, err := johari.NewChildRequest(ctx, "GET", healthURL, nil)
+	if err != nil {
+		return fmt.Errorf("Failed to create request to %s: %s", healthURL, err)
+	}
+
+	request = request.WithContext(ctx)
+	response, err := johari.NewHTTPClientWrapper(http.DefaultClient).Do(request)
+	if err != nil {
+		return fmt.Errorf("Failed to query %s: %w", healthURL, err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("%s returned a %d", healthURL, response.StatusCode)
+	}
+
+	return nil
+}
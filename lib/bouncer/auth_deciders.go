@@ -0,0 +1,823 @@
+package bouncer
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+	johari "github.com/sinkingpoint/johari-go/lib"
+)
+
+// errTooManyNonces is returned by checkAndAdd when the nonceStore is full of nonces that haven't expired yet
+var errTooManyNonces = fmt.Errorf("Too many recent nonces to track")
+
+// nonceStore tracks recently seen nonces, forgetting each one once the request it came with would be rejected as too old anyway.
+// It holds at most maxEntries nonces, so that a flood of requests can't grow it without bound
+type nonceStore struct {
+	lock          sync.Mutex
+	pruneInterval time.Duration
+	maxEntries    int
+	seen          map[string]time.Time
+	lastPrune     time.Time
+}
+
+func newNonceStore(pruneInterval time.Duration, maxEntries int) *nonceStore {
+	return &nonceStore{
+		pruneInterval: pruneInterval,
+		maxEntries:    maxEntries,
+		seen:          map[string]time.Time{},
+	}
+}
+
+// prune removes the nonces that have expired by the given time
+func (n *nonceStore) prune(now time.Time) {
+	for seen, expires := range n.seen {
+		if !now.Before(expires) {
+			delete(n.seen, seen)
+		}
+	}
+	n.lastPrune = now
+}
+
+// checkAndAdd records the given nonce until it expires, returning false if it has already been seen and hasn't expired.
+// Returns errTooManyNonces if the store is full, rather than forgetting a nonce early, which would let it be replayed
+func (n *nonceStore) checkAndAdd(nonce string, expires, now time.Time) (bool, error) {
+	n.lock.Lock()
+	defer n.lock.Unlock()
+
+	// Expired nonces are swept out at most once per pruneInterval, so this stays cheap per request, unless the store fills up first
+	if now.Sub(n.lastPrune) > n.pruneInterval || len(n.seen) >= n.maxEntries {
+		n.prune(now)
+	}
+
+	if seenExpires, ok := n.seen[nonce]; ok && now.Before(seenExpires) {
+		return false, nil
+	}
+
+	if len(n.seen) >= n.maxEntries {
+		return false, errTooManyNonces
+	}
+
+	n.seen[nonce] = expires
+	return true, nil
+}
+
+// antiReplaySignature computes the signature anti_replay expects for the given request
+func antiReplaySignature(secret []byte, timestamp, nonce string, req *http.Request) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", timestamp, nonce, req.Method, req.URL.Path)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// AntiReplayDecider returns a Decider which rejects stale or replayed machine requests. Requests must
+// carry an X-Bouncer-Timestamp header, holding the unix time (in seconds) they were sent, which must be at most
+// "maxAge" old. To tolerate clock skew between the client and us, timestamps up to "clockSkew" (default 30s)
+// in the future are accepted too. If "trackNonces" is "true", requests must also carry a unique X-Bouncer-Nonce
+// header, and any nonce seen with a timestamp less than maxAge old (after which the timestamp check rejects it anyway) is rejected.
+// At most "maxNonces" (default 100000) nonces are remembered at once, and requests with new nonces are rejected with a 503
+// while it's full, rather than forgetting nonces that could then be replayed. Nonces are remembered by the decider, so they're
+// forgotten when the bouncers are reloaded, letting requests from before the reload be replayed until they're maxAge old.
+// If a "secret" is set, the timestamp and nonce must be signed with an X-Bouncer-Signature header, holding the hex encoded
+// HMAC-SHA256 of "<timestamp>\n<nonce>\n<method>\n<path>" so that they can't be forged
+func AntiReplayDecider(config map[string]string) Decider {
+	return deciderOrNil("anti_replay", newAntiReplayDecider, config)
+}
+
+func newAntiReplayDecider(config DeciderConfig) (Decider, error) {
+	maxAge, err := time.ParseDuration(config["maxAge"])
+	if err != nil {
+		return nil, fmt.Errorf("maxAge: %s", err)
+	}
+
+	clockSkew := 30 * time.Second
+	if config["clockSkew"] != "" {
+		clockSkew, err = time.ParseDuration(config["clockSkew"])
+		if err != nil {
+			return nil, fmt.Errorf("clockSkew: %s", err)
+		}
+	}
+
+	maxNonces, err := config.GetInt("maxNonces", 100000)
+	if err != nil || maxNonces <= 0 {
+		return nil, fmt.Errorf("maxNonces: %s is not a positive integer", config["maxNonces"])
+	}
+
+	var nonces *nonceStore
+	if config["trackNonces"] == "true" {
+		nonces = newNonceStore(maxAge+clockSkew, maxNonces)
+	}
+
+	secret := []byte(config["secret"])
+	return func(req *http.Request, context context.Context) *HTTPError {
+		timestamp := req.Header.Get("X-Bouncer-Timestamp")
+		nonce := req.Header.Get("X-Bouncer-Nonce")
+		unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return &HTTPError{
+				Status: 401,
+				Err:    fmt.Errorf("X-Bouncer-Timestamp must be a unix timestamp. Got %q", timestamp),
+			}
+		}
+
+		if len(secret) > 0 {
+			expected := antiReplaySignature(secret, timestamp, nonce, req)
+			if !hmac.Equal([]byte(expected), []byte(req.Header.Get("X-Bouncer-Signature"))) {
+				return &HTTPError{
+					Status: 401,
+					Err:    fmt.Errorf("Invalid X-Bouncer-Signature"),
+				}
+			}
+		}
+
+		now := clock()
+		sentAt := time.Unix(unixTime, 0)
+		age := now.Sub(sentAt)
+		if age > maxAge {
+			return &HTTPError{
+				Status: 401,
+				Err:    fmt.Errorf("Request is %s old, but must be at most %s", age, maxAge),
+			}
+		}
+
+		if -age > clockSkew {
+			return &HTTPError{
+				Status: 401,
+				Err:    fmt.Errorf("Request is %s in the future, more than the allowed clock skew of %s", -age, clockSkew),
+			}
+		}
+
+		if nonces != nil {
+			if nonce == "" {
+				return &HTTPError{
+					Status: 401,
+					Err:    fmt.Errorf("X-Bouncer-Nonce is required"),
+				}
+			}
+
+			// Once the request is maxAge old the timestamp check rejects it, so its nonce doesn't need remembering any longer
+			fresh, err := nonces.checkAndAdd(nonce, sentAt.Add(maxAge), now)
+			if err != nil {
+				return &HTTPError{
+					Status: 503,
+					Err:    fmt.Errorf("%s, try again later", err),
+				}
+			}
+
+			if !fresh {
+				return &HTTPError{
+					Status: 401,
+					Err:    fmt.Errorf("Nonce %s has already been used", nonce),
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// upstreamHopSignature computes the signature require_upstream_chain expects from the given gateway
+func upstreamHopSignature(secret []byte, gateway, timestamp string, req *http.Request) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%s\n%s\n%s\n%s", gateway, timestamp, req.Method, req.URL.RequestURI())
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// RequireUpstreamChainDecider returns a Decider which rejects requests that didn't come through our API gateway,
+// e.g. clients hitting the bouncer directly. The gateway proves a request went through it by adding a hop header
+// ("header", default X-Gateway-Hop) of the form `<gateway name>;<unix timestamp>;<signature>`, where the signature is the
+// hex encoded HMAC-SHA256, keyed with the shared "secret", of "<gateway name>\n<timestamp>\n<method>\n<request URI>".
+// Signatures older than "maxAge" (default 5m) are rejected, so captured headers can't be reused for long, and if
+// "gateways" (a comma separated list) is given, the gateway name must be one of them
+func RequireUpstreamChainDecider(config map[string]string) Decider {
+	return deciderOrNil("require_upstream_chain", newRequireUpstreamChainDecider, config)
+}
+
+func newRequireUpstreamChainDecider(config DeciderConfig) (Decider, error) {
+	secret := []byte(config["secret"])
+	if len(secret) == 0 {
+		return nil, fmt.Errorf("secret: it must not be empty")
+	}
+
+	header := config["header"]
+	if header == "" {
+		header = "X-Gateway-Hop"
+	}
+
+	maxAge := 5 * time.Minute
+	if config["maxAge"] != "" {
+		parsed, err := time.ParseDuration(config["maxAge"])
+		if err != nil {
+			return nil, fmt.Errorf("maxAge: %s", err)
+		}
+		maxAge = parsed
+	}
+
+	gateways := map[string]bool{}
+	for _, gateway := range parseConfigList(config["gateways"]) {
+		gateways[gateway] = true
+	}
+
+	reject := func(reason string, args ...interface{}) *HTTPError {
+		return &HTTPError{
+			Status: 403,
+			Err:    fmt.Errorf("Requests must come through the API gateway: "+reason, args...),
+		}
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		hop := req.Header.Get(header)
+		if hop == "" {
+			return reject("missing %s header", header)
+		}
+
+		parts := strings.Split(hop, ";")
+		if len(parts) != 3 {
+			return reject("malformed %s header", header)
+		}
+
+		gateway, timestamp, signature := parts[0], parts[1], parts[2]
+		if len(gateways) > 0 && !gateways[gateway] {
+			return reject("unknown gateway %s", gateway)
+		}
+
+		expected := upstreamHopSignature(secret, gateway, timestamp, req)
+		if !hmac.Equal([]byte(expected), []byte(signature)) {
+			return reject("invalid %s signature", header)
+		}
+
+		unixTime, err := strconv.ParseInt(timestamp, 10, 64)
+		if err != nil {
+			return reject("invalid %s timestamp", header)
+		}
+
+		if age := time.Since(time.Unix(unixTime, 0)); age > maxAge || -age > maxAge {
+			return reject("%s header is %s old", header, age.Round(time.Second))
+		}
+
+		return nil
+	}, nil
+}
+
+// ldapCacheEntry is the cached groups of a single user
+type ldapCacheEntry struct {
+	groups  []string
+	expires time.Time
+}
+
+// ldapGroupResolver looks up users' groups in LDAP over a single shared connection, which is
+// dialled (and bound) lazily, and redialled after any error. Lookups are cached for the cacheTTL
+type ldapGroupResolver struct {
+	url            string
+	bindDN         string
+	bindPassword   string
+	baseDN         string
+	userFilter     string
+	groupAttribute string
+	timeout        time.Duration
+	cacheTTL       time.Duration
+
+	// lock guards the cache and the lookups in flight. It's never held while talking to LDAP, so that
+	// one user's cache miss doesn't hold up requests from users whose groups are cached
+	lock     sync.Mutex
+	cache    map[string]ldapCacheEntry
+	inFlight map[string]*ldapLookup
+
+	// connLock guards conn, and is held while it's dialled, so that only one connection is made at a time
+	connLock sync.Mutex
+	conn     *ldap.Conn
+}
+
+// ldapLookup is a lookup of a user's groups, shared by every request for that user that's waiting on it
+type ldapLookup struct {
+	done   chan struct{}
+	groups []string
+	err    error
+}
+
+// connection returns the shared connection, dialling and binding a new one if there isn't one
+func (r *ldapGroupResolver) connection() (*ldap.Conn, error) {
+	r.connLock.Lock()
+	defer r.connLock.Unlock()
+
+	if r.conn != nil && !r.conn.IsClosing() {
+		return r.conn, nil
+	}
+
+	conn, err := ldap.DialURL(r.url, ldap.DialWithDialer(&net.Dialer{Timeout: r.timeout}))
+	if err != nil {
+		return nil, err
+	}
+
+	conn.SetTimeout(r.timeout)
+	if err := conn.Bind(r.bindDN, r.bindPassword); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	r.conn = conn
+	return conn, nil
+}
+
+// discard closes the given connection, and stops it being reused if it's still the shared one
+func (r *ldapGroupResolver) discard(conn *ldap.Conn) {
+	r.connLock.Lock()
+	defer r.connLock.Unlock()
+
+	conn.Close()
+	if r.conn == conn {
+		r.conn = nil
+	}
+}
+
+// search looks up the groups of the given user in LDAP, without consulting the cache
+func (r *ldapGroupResolver) search(user string) ([]string, error) {
+	conn, err := r.connection()
+	if err != nil {
+		return nil, err
+	}
+
+	search := ldap.NewSearchRequest(
+		r.baseDN, ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 2, int(r.timeout.Seconds()), false,
+		strings.Replace(r.userFilter, "{user}", ldap.EscapeFilter(user), -1),
+		[]string{r.groupAttribute}, nil,
+	)
+
+	result, err := conn.Search(search)
+	if err != nil {
+		// Don't reuse a connection that might be broken
+		r.discard(conn)
+		return nil, err
+	}
+
+	if len(result.Entries) > 1 {
+		return nil, fmt.Errorf("%s matches more than one LDAP entry", user)
+	}
+
+	groups := []string{}
+	if len(result.Entries) == 1 {
+		groups = result.Entries[0].GetAttributeValues(r.groupAttribute)
+	}
+
+	return groups, nil
+}
+
+// groups returns the DNs of the groups the given user is in, or none if the user doesn't exist. Concurrent
+// cache misses for the same user share a single lookup
+func (r *ldapGroupResolver) groups(user string, now time.Time) ([]string, error) {
+	r.lock.Lock()
+	if entry, ok := r.cache[user]; ok && now.Before(entry.expires) {
+		defer r.lock.Unlock()
+		return entry.groups, nil
+	}
+
+	if call, ok := r.inFlight[user]; ok {
+		r.lock.Unlock()
+		<-call.done
+		return call.groups, call.err
+	}
+
+	call := &ldapLookup{done: make(chan struct{})}
+	r.inFlight[user] = call
+	r.lock.Unlock()
+
+	call.groups, call.err = r.search(user)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	if call.err == nil {
+		// Expired entries are swept out whenever we go to LDAP anyway, so the cache stays bounded by the active users
+		for cached, entry := range r.cache {
+			if !now.Before(entry.expires) {
+				delete(r.cache, cached)
+			}
+		}
+
+		r.cache[user] = ldapCacheEntry{
+			groups:  call.groups,
+			expires: now.Add(r.cacheTTL),
+		}
+	}
+	delete(r.inFlight, user)
+	close(call.done)
+	return call.groups, call.err
+}
+
+// ldapGroupMatches returns whether the given group DN is the given allowed group, which can either be a full DN
+// or just the value of the first component of one, e.g. `oncall` for `CN=oncall,OU=Groups,DC=example,DC=com`
+func ldapGroupMatches(groupDN string, allowed string) bool {
+	if strings.EqualFold(groupDN, allowed) {
+		return true
+	}
+
+	dn, err := ldap.ParseDN(groupDN)
+	if err != nil || len(dn.RDNs) == 0 || len(dn.RDNs[0].Attributes) == 0 {
+		return false
+	}
+
+	return strings.EqualFold(dn.RDNs[0].Attributes[0].Value, allowed)
+}
+
+// LDAPGroupGateDecider returns a Decider which only lets through callers (identified by the "identityHeader", default X-Forwarded-User)
+// that are in one of the comma separated "allowedGroups" in LDAP (or AD). Groups can be given as full DNs, or just their names.
+// Users are found under the "baseDN" with the "userFilter" (default `(&(objectClass=person)(uid={user}))`, where {user} is replaced
+// with the escaped identity), and their groups are read from the "groupAttribute" (default memberOf). The decider holds one connection
+// to the LDAP server at "url" (e.g. `ldaps://ldap.example.com:636`), bound as "bindDN" with "bindPassword", which all requests share and
+// which is redialled if it breaks. Each user's groups are cached for the "cacheTTL" (default 5m) so that LDAP isn't queried on every request.
+// Requests are rejected with a 503 if LDAP can't be queried within the "timeout" (default 5s)
+func LDAPGroupGateDecider(config map[string]string) Decider {
+	return deciderOrNil("ldap_group_gate", newLDAPGroupGateDecider, config)
+}
+
+func newLDAPGroupGateDecider(config DeciderConfig) (Decider, error) {
+	allowedGroups := parseConfigList(config["allowedGroups"])
+	if len(allowedGroups) == 0 {
+		return nil, fmt.Errorf("allowedGroups: at least one group is required")
+	}
+
+	resolver := &ldapGroupResolver{
+		url:            config["url"],
+		bindDN:         config["bindDN"],
+		bindPassword:   config["bindPassword"],
+		baseDN:         config["baseDN"],
+		userFilter:     config["userFilter"],
+		groupAttribute: config["groupAttribute"],
+		timeout:        5 * time.Second,
+		cacheTTL:       5 * time.Minute,
+		cache:          map[string]ldapCacheEntry{},
+		inFlight:       map[string]*ldapLookup{},
+	}
+
+	if resolver.userFilter == "" {
+		resolver.userFilter = "(&(objectClass=person)(uid={user}))"
+	}
+
+	if resolver.groupAttribute == "" {
+		resolver.groupAttribute = "memberOf"
+	}
+
+	for name, value := range map[string]*time.Duration{"timeout": &resolver.timeout, "cacheTTL": &resolver.cacheTTL} {
+		if config[name] == "" {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(config[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		*value = parsed
+	}
+
+	identityHeader := config["identityHeader"]
+	if identityHeader == "" {
+		identityHeader = "X-Forwarded-User"
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		user := requestIdentity(req, identityHeader)
+		if user == "" {
+			return &HTTPError{
+				Status: 403,
+				Err:    fmt.Errorf("Requests must be authenticated with the %s header", identityHeader),
+			}
+		}
+
+		groups, err := resolver.groups(user, time.Now())
+		if err != nil {
+			currentLogger().Warn("Failed to look up LDAP groups", "decider", "ldap_group_gate", "user", user, "error", err.Error())
+			return &HTTPError{
+				Status: 503,
+				Err:    fmt.Errorf("Failed to look up your groups, try again later"),
+			}
+		}
+
+		for _, group := range groups {
+			for _, allowed := range allowedGroups {
+				if ldapGroupMatches(group, allowed) {
+					return nil
+				}
+			}
+		}
+
+		return &HTTPError{
+			Status: 403,
+			Err:    fmt.Errorf("%s must be in one of the groups %s", user, strings.Join(allowedGroups, ", ")),
+		}
+	}, nil
+}
+
+// parseCIDRList parses a comma separated list of CIDRs, e.g. `10.0.0.0/8,fd00::/8`
+func parseCIDRList(list string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, cidr := range parseConfigList(list) {
+		_, network, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+
+		networks = append(networks, network)
+	}
+
+	return networks, nil
+}
+
+// ipInNetworks returns whether the given IP is in any of the given networks
+func ipInNetworks(ip net.IP, networks []*net.IPNet) bool {
+	for _, network := range networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// IPAllowlistDecider returns a Decider which rejects requests from clients whose IP isn't in one of the comma separated "cidrs".
+// The client IP is the peer's address (the RemoteAddr) if "source" is "remoteAddr" (the default). If "source" is "header", it's
+// the rightmost address in the "header" (default X-Forwarded-For) that isn't one of the comma separated "trustedProxies" CIDRs
+// (default the proxy's TrustedProxies), falling back to the RemoteAddr when the header is missing, i.e. when the request didn't
+// come through a proxy
+func IPAllowlistDecider(config map[string]string) Decider {
+	return deciderOrNil("ip_allowlist", newIPAllowlistDecider, config)
+}
+
+func newIPAllowlistDecider(config DeciderConfig) (Decider, error) {
+	allowed, err := parseCIDRList(config["cidrs"])
+	if err != nil {
+		return nil, fmt.Errorf("cidrs: %s", err)
+	}
+
+	if len(allowed) == 0 {
+		return nil, fmt.Errorf("cidrs: at least one CIDR is required")
+	}
+
+	trustedProxies, err := parseCIDRList(config["trustedProxies"])
+	if err != nil {
+		return nil, fmt.Errorf("trustedProxies: %s", err)
+	}
+
+	source := config.GetString("source", "remoteAddr")
+
+	if source != "remoteAddr" && source != "header" {
+		return nil, fmt.Errorf("source: %s is not one of remoteAddr or header", source)
+	}
+
+	header := config.GetString("header", "X-Forwarded-For")
+	return func(req *http.Request, context context.Context) *HTTPError {
+		ip := remoteIP(req)
+		if source == "header" {
+			trusted := trustedProxies
+			if len(trusted) == 0 {
+				trusted = TrustedProxies(req)
+			}
+
+			ip = forwardedClientIP(req, header, trusted)
+		}
+
+		if ip == nil {
+			return &HTTPError{
+				Status: 403,
+				Err:    fmt.Errorf("Failed to work out the IP address of the client"),
+			}
+		}
+
+		if !ipInNetworks(ip, allowed) {
+			return &HTTPError{
+				Status: 403,
+				Err:    fmt.Errorf("Requests from %s aren't allowed", ip),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// bearerToken returns the token in the given request's `Authorization: Bearer <token>` header, if it has one
+func bearerToken(req *http.Request) (string, bool) {
+	parts := strings.SplitN(req.Header.Get("Authorization"), " ", 2)
+	if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") || strings.TrimSpace(parts[1]) == "" {
+		return "", false
+	}
+
+	return strings.TrimSpace(parts[1]), true
+}
+
+// RequireTokenDecider returns a Decider which rejects requests without an `Authorization: Bearer <token>` header
+// carrying one of the comma separated "tokens". So that the tokens don't have to be in the config in plaintext,
+// "tokenEnv" can name an environment variable holding another comma separated list of them. Tokens are
+// compared in constant time, and failures are rejected with a 401 and a WWW-Authenticate header for the "realm" (default alertmanager)
+func RequireTokenDecider(config map[string]string) Decider {
+	return deciderOrNil("require_token", newRequireTokenDecider, config)
+}
+
+func newRequireTokenDecider(config DeciderConfig) (Decider, error) {
+	tokens := parseConfigList(config["tokens"])
+	if config["tokenEnv"] != "" {
+		value, ok := os.LookupEnv(config["tokenEnv"])
+		if !ok {
+			return nil, fmt.Errorf("tokenEnv: %s isn't set", config["tokenEnv"])
+		}
+
+		tokens = append(tokens, parseConfigList(value)...)
+	}
+
+	if len(tokens) == 0 {
+		return nil, fmt.Errorf("at least one token is required in tokens or tokenEnv")
+	}
+
+	// Comparing digests rather than the tokens themselves means that the comparison doesn't leak the tokens' lengths either
+	digests := make([][]byte, 0, len(tokens))
+	for _, token := range tokens {
+		digest := sha256.Sum256([]byte(token))
+		digests = append(digests, digest[:])
+	}
+
+	realm := config["realm"]
+	if realm == "" {
+		realm = "alertmanager"
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		challenge := fmt.Sprintf("Bearer realm=%q", realm)
+		token, ok := bearerToken(req)
+		if !ok {
+			return &HTTPError{
+				Status: 401,
+				Err:    fmt.Errorf("Requests must have an Authorization: Bearer <token> header"),
+				Header: http.Header{"Www-Authenticate": []string{challenge}},
+			}
+		}
+
+		digest := sha256.Sum256([]byte(token))
+		matched := 0
+		// Every token is checked, so that the time taken doesn't depend on which of them matched
+		for _, allowed := range digests {
+			matched |= subtle.ConstantTimeCompare(digest[:], allowed)
+		}
+
+		if matched != 1 {
+			return &HTTPError{
+				Status: 401,
+				Err:    fmt.Errorf("Invalid token"),
+				Header: http.Header{"Www-Authenticate": []string{challenge + `, error="invalid_token"`}},
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// externalAuthRequest is what external_auth POSTs to its url. It's wrapped in an "input" so that it can be sent straight to
+// Open Policy Agent's data API
+type externalAuthRequest struct {
+	Input struct {
+		Method  string              `json:"method"`
+		Path    string              `json:"path"`
+		Query   map[string][]string `json:"query"`
+		Headers map[string][]string `json:"headers"`
+		Body    string              `json:"body"`
+	} `json:"input"`
+}
+
+// externalAuthDecision is the decision in the response to an externalAuthRequest
+type externalAuthDecision struct {
+	Allow  *bool  `json:"allow"`
+	Reason string `json:"reason"`
+}
+
+// externalAuthResponse is the response to an externalAuthRequest. The decision can either be at the top level,
+// or in a "result" as Open Policy Agent returns them
+type externalAuthResponse struct {
+	externalAuthDecision
+	Result *externalAuthDecision `json:"result"`
+}
+
+// ExternalAuthDecider returns a Decider which asks an external service, e.g. Open Policy Agent, whether requests should be let through.
+// The request's method, path, query, headers, and body (as a string) are POSTed as JSON to the "url" as an object under "input". The service
+// rejects the request by responding with a non 2xx, or with a JSON object (at the top level, or under "result") like `{"allow": false, "reason": "..."}`,
+// whose reason is passed on to the client. If the service can't be reached within the "timeout" (default 5s, or sooner if the request's
+// deadline is), or responds with something else, requests are rejected with a 503, unless "failOpen" is "true", in which case they're let through
+func ExternalAuthDecider(config map[string]string) Decider {
+	return deciderOrNil("external_auth", newExternalAuthDecider, config)
+}
+
+func newExternalAuthDecider(config DeciderConfig) (Decider, error) {
+	authURL := config["url"]
+	timeout, err := config.GetDuration("timeout", 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("timeout: %s", err)
+	}
+
+	failOpen, err := config.GetBool("failOpen", false)
+	if err != nil {
+		return nil, fmt.Errorf("failOpen: %s", err)
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		decision, err := askExternalAuth(context, authURL, timeout, req)
+		if err != nil {
+			if failOpen {
+				currentLogger().Warn("Failed to check with the auth service, letting the request through", "decider", "external_auth", "error", err.Error())
+				return nil
+			}
+
+			currentLogger().Warn("Failed to check with the auth service", "decider", "external_auth", "error", err.Error())
+			return &HTTPError{
+				Status: 503,
+				Err:    fmt.Errorf("Failed to check whether the request is allowed, try again later"),
+			}
+		}
+
+		if decision.Allow == nil || !*decision.Allow {
+			reason := decision.Reason
+			if reason == "" {
+				reason = "Request denied by policy"
+			}
+
+			return &HTTPError{
+				Status: 403,
+				Err:    fmt.Errorf("%s", reason),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// askExternalAuth sends the given request to the external_auth service at authURL, returning its decision.
+// Non 2xx responses are denials, and anything we can't get a decision out of is an error
+func askExternalAuth(ctx context.Context, authURL string, timeout time.Duration, req *http.Request) (externalAuthDecision, error) {
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return externalAuthDecision{}, fmt.Errorf("Failed to read body: %s", err)
+	}
+
+	var authRequest externalAuthRequest
+	authRequest.Input.Method = req.Method
+	authRequest.Input.Path = req.URL.Path
+	authRequest.Input.Query = req.URL.Query()
+	authRequest.Input.Headers = req.Header
+	authRequest.Input.Body = string(body)
+	payload, err := json.Marshal(authRequest)
+	if err != nil {
+		return externalAuthDecision{}, fmt.Errorf("Failed to encode request: %s", err)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	request, err := johari.NewChildRequest(ctx, "POST", authURL, ioutil.NopCloser(bytes.NewReader(payload)))
+	if err != nil {
+		return externalAuthDecision{}, fmt.Errorf("Failed to create request to %s: %s", authURL, err)
+	}
+
+	// NewChildRequest may have swapped in the parent span's context, so reapply our timeout on top of it
+	request = request.WithContext(ctx)
+	request.Header.Set("Content-Type", "application/json")
+	response, err := johari.NewHTTPClientWrapper(http.DefaultClient).Do(request)
+	if err != nil {
+		return externalAuthDecision{}, fmt.Errorf("Failed to query %s: %s", authURL, err)
+	}
+	defer response.Body.Close()
+
+	responseBody, err := ioutil.ReadAll(response.Body)
+	if err != nil {
+		return externalAuthDecision{}, fmt.Errorf("Failed to read response from %s: %s", authURL, err)
+	}
+
+	var authResponse externalAuthResponse
+	jsonErr := json.Unmarshal(responseBody, &authResponse)
+	if authResponse.Result != nil {
+		authResponse.externalAuthDecision = *authResponse.Result
+	}
+
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		// The service may still have given us a reason
+		allow := false
+		authResponse.Allow = &allow
+		return authResponse.externalAuthDecision, nil
+	}
+
+	if jsonErr != nil {
+		return externalAuthDecision{}, fmt.Errorf("Invalid response from %s: %s", authURL, jsonErr)
+	}
+
+	if authResponse.Allow == nil {
+		return externalAuthDecision{}, fmt.Errorf("%s didn't return a decision", authURL)
+	}
+
+	return authResponse.externalAuthDecision, nil
+}
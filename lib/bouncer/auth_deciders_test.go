@@ -0,0 +1,439 @@
+package bouncer_test
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+func TestAntiReplayDecider(t *testing.T) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	future := strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)
+	sign := func(timestamp, nonce string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		fmt.Fprintf(mac, "%s\n%s\n%s\n%s", timestamp, nonce, "POST", "/api/v2/silences")
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+
+	tracking := bouncer.AntiReplayDecider(map[string]string{"maxAge": "5m", "trackNonces": "true"})
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		headers         map[string]string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Fresh Request Passes",
+			decider:         bouncer.AntiReplayDecider(map[string]string{"maxAge": "5m"}),
+			headers:         map[string]string{"X-Bouncer-Timestamp": now},
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Missing Timestamp Fails",
+			decider:         bouncer.AntiReplayDecider(map[string]string{"maxAge": "5m"}),
+			headers:         map[string]string{},
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Old Request Fails",
+			decider:         bouncer.AntiReplayDecider(map[string]string{"maxAge": "5m"}),
+			headers:         map[string]string{"X-Bouncer-Timestamp": old},
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Future Request Fails",
+			decider:         bouncer.AntiReplayDecider(map[string]string{"maxAge": "5m"}),
+			headers:         map[string]string{"X-Bouncer-Timestamp": future},
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Large Clock Skew Passes",
+			decider:         bouncer.AntiReplayDecider(map[string]string{"maxAge": "5m", "clockSkew": "2h"}),
+			headers:         map[string]string{"X-Bouncer-Timestamp": future},
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Missing Nonce Fails",
+			decider:         tracking,
+			headers:         map[string]string{"X-Bouncer-Timestamp": now},
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test New Nonce Passes",
+			decider:         tracking,
+			headers:         map[string]string{"X-Bouncer-Timestamp": now, "X-Bouncer-Nonce": "a"},
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Replayed Nonce Fails",
+			decider:         tracking,
+			headers:         map[string]string{"X-Bouncer-Timestamp": now, "X-Bouncer-Nonce": "a"},
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Signed Request Passes",
+			decider:         bouncer.AntiReplayDecider(map[string]string{"maxAge": "5m", "secret": "secret"}),
+			headers:         map[string]string{"X-Bouncer-Timestamp": now, "X-Bouncer-Nonce": "b", "X-Bouncer-Signature": sign(now, "b")},
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Tampered Timestamp Fails",
+			decider:         bouncer.AntiReplayDecider(map[string]string{"maxAge": "5m", "secret": "secret"}),
+			headers:         map[string]string{"X-Bouncer-Timestamp": now, "X-Bouncer-Nonce": "b", "X-Bouncer-Signature": sign(old, "b")},
+			expectedSuccess: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		req := mustMakeRequest(t, "POST", "http://localhost/api/v2/silences", "")
+		req.Header = map[string][]string{}
+		for name, value := range testCase.headers {
+			req.Header.Set(name, value)
+		}
+
+		response := testCase.decider(req, context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+}
+
+func TestAntiReplayNoncesExpireAndAreCapped(t *testing.T) {
+	now := time.Now()
+	defer bouncer.SetClock(func() time.Time { return now })()
+
+	decider := bouncer.AntiReplayDecider(map[string]string{"maxAge": "5m", "trackNonces": "true", "maxNonces": "2"})
+	send := func(nonce string) int {
+		req := mustMakeRequest(t, "POST", "http://localhost/api/v2/silences", "")
+		req.Header = http.Header{}
+		req.Header.Set("X-Bouncer-Timestamp", strconv.FormatInt(now.Unix(), 10))
+		req.Header.Set("X-Bouncer-Nonce", nonce)
+		if err := decider(req, context.Background()); err != nil {
+			return err.Status
+		}
+
+		return 200
+	}
+
+	started := now
+	testCases := []struct {
+		name           string
+		at             time.Time
+		nonce          string
+		expectedStatus int
+	}{
+		{"Test First Nonce Passes", started, "a", 200},
+		{"Test Second Nonce Passes", started, "b", 200},
+		{"Test New Nonces Are Rejected While Full", started, "c", 503},
+		{"Test Replays Are Still Rejected While Full", started, "a", 401},
+		{"Test Nonces Are Forgotten Once Their Requests Are Too Old", started.Add(6 * time.Minute), "c", 200},
+		{"Test Expired Nonces Can Be Reused", started.Add(6 * time.Minute), "a", 200},
+		{"Test The Store Fills Up Again", started.Add(6 * time.Minute), "d", 503},
+	}
+
+	for _, testCase := range testCases {
+		now = testCase.at
+		if status := send(testCase.nonce); status != testCase.expectedStatus {
+			t.Errorf("Test '%s' failed - expected a %d, got a %d", testCase.name, testCase.expectedStatus, status)
+		}
+	}
+
+	if bouncer.AntiReplayDecider(map[string]string{"maxAge": "5m", "trackNonces": "true", "maxNonces": "0"}) != nil {
+		t.Errorf("Expected a maxNonces of 0 to be rejected")
+	}
+}
+
+func TestRequireUpstreamChainDecider(t *testing.T) {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	old := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	hop := func(gateway, timestamp, uri string) string {
+		mac := hmac.New(sha256.New, []byte("secret"))
+		fmt.Fprintf(mac, "%s\n%s\n%s\n%s", gateway, timestamp, "POST", uri)
+		return gateway + ";" + timestamp + ";" + hex.EncodeToString(mac.Sum(nil))
+	}
+
+	decider := bouncer.RequireUpstreamChainDecider(map[string]string{"secret": "secret", "gateways": "edge-1, edge-2"})
+	testCases := []struct {
+		name            string
+		hop             string
+		expectedSuccess bool
+	}{
+		{"Test Signed Hop Passes", hop("edge-1", now, "/api/v2/silences"), true},
+		{"Test Missing Hop Fails", "", false},
+		{"Test Malformed Hop Fails", "edge-1;" + now, false},
+		{"Test Unknown Gateway Fails", hop("edge-3", now, "/api/v2/silences"), false},
+		{"Test Signature For Another URI Fails", hop("edge-1", now, "/api/v2/alerts"), false},
+		{"Test Old Hop Fails", hop("edge-1", old, "/api/v2/silences"), false},
+	}
+
+	for _, testCase := range testCases {
+		req := mustMakeRequest(t, "POST", "http://localhost/api/v2/silences", "")
+		req.Header = map[string][]string{}
+		if testCase.hop != "" {
+			req.Header.Set("X-Gateway-Hop", testCase.hop)
+		}
+
+		response := decider(req, context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+}
+
+func TestLDAPGroupGateDecider(t *testing.T) {
+	config := map[string]string{
+		"url":           "ldap://127.0.0.1:1",
+		"bindDN":        "cn=bouncer,dc=example,dc=com",
+		"bindPassword":  "hunter2",
+		"baseDN":        "dc=example,dc=com",
+		"allowedGroups": "oncall",
+		"timeout":       "1s",
+	}
+
+	decider := bouncer.LDAPGroupGateDecider(config)
+	req := mustBuildRequest("", t)
+	if err := decider(req, context.Background()); err == nil || err.Status != 403 {
+		t.Errorf("Expected requests without an identity to be rejected with a 403, got %v", err)
+	}
+
+	req = mustBuildRequest("", t)
+	req.Header.Set("X-Forwarded-User", "alice")
+	if err := decider(req, context.Background()); err == nil || err.Status != 503 {
+		t.Errorf("Expected requests to be rejected with a 503 when LDAP is unreachable, got %v", err)
+	}
+
+	for _, invalid := range []map[string]string{{"allowedGroups": ""}, {"cacheTTL": "forever"}} {
+		invalidConfig := map[string]string{}
+		for key, value := range config {
+			invalidConfig[key] = value
+		}
+
+		for key, value := range invalid {
+			invalidConfig[key] = value
+		}
+
+		if bouncer.LDAPGroupGateDecider(invalidConfig) != nil {
+			t.Errorf("Expected %v to fail to construct a decider", invalid)
+		}
+	}
+}
+
+func TestIPAllowlistDecider(t *testing.T) {
+	headerConfig := map[string]string{"cidrs": "192.0.2.0/24,2001:db8::/32", "source": "header", "trustedProxies": "10.0.0.0/8"}
+	testCases := []struct {
+		name            string
+		config          map[string]string
+		remoteAddr      string
+		forwardedFor    []string
+		expectedSuccess bool
+	}{
+		{"Test Allowed RemoteAddr Passes", map[string]string{"cidrs": "192.0.2.0/24"}, "192.0.2.10:5000", nil, true},
+		{"Test Allowed IPv6 RemoteAddr Passes", map[string]string{"cidrs": "2001:db8::/32"}, "[2001:db8::1]:5000", nil, true},
+		{"Test Disallowed RemoteAddr Fails", map[string]string{"cidrs": "192.0.2.0/24"}, "198.51.100.1:5000", nil, false},
+		{"Test Header Ignored By Default", map[string]string{"cidrs": "192.0.2.0/24"}, "198.51.100.1:5000", []string{"192.0.2.10"}, false},
+		{"Test Forwarded Client Passes", headerConfig, "10.0.0.1:5000", []string{"192.0.2.10"}, true},
+		{"Test Forwarded Disallowed Client Fails", headerConfig, "10.0.0.1:5000", []string{"198.51.100.1"}, false},
+		{"Test Trusted Proxies Are Skipped", headerConfig, "10.0.0.1:5000", []string{"192.0.2.10, 10.0.0.2", "10.0.0.3"}, true},
+		{"Test Spoofed Addresses Are Ignored", headerConfig, "10.0.0.1:5000", []string{"192.0.2.10, 198.51.100.1"}, false},
+		{"Test Untrusted Peer's Header Is Ignored", headerConfig, "198.51.100.1:5000", []string{"192.0.2.10"}, false},
+		{"Test Missing Header Falls Back To RemoteAddr", headerConfig, "192.0.2.10:5000", nil, true},
+		{"Test Garbage Header Fails", headerConfig, "10.0.0.1:5000", []string{"cats"}, false},
+	}
+
+	for _, testCase := range testCases {
+		decider := bouncer.IPAllowlistDecider(testCase.config)
+		req := mustBuildRequest("", t)
+		req.RemoteAddr = testCase.remoteAddr
+		for _, value := range testCase.forwardedFor {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+
+		response := decider(req, context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			t.Errorf("Test '%s' failed - expected success to be %t, got %v", testCase.name, testCase.expectedSuccess, response)
+		}
+
+		if response != nil && response.Status != 403 {
+			t.Errorf("Test '%s' failed - expected a 403, got a %d", testCase.name, response.Status)
+		}
+	}
+
+	for _, config := range []map[string]string{
+		{"cidrs": "192.0.2.0/33"},
+		{"cidrs": "192.0.2.1"},
+		{"cidrs": ""},
+		{"cidrs": "192.0.2.0/24", "trustedProxies": "cats"},
+		{"cidrs": "192.0.2.0/24", "source": "cookie"},
+	} {
+		if bouncer.IPAllowlistDecider(config) != nil {
+			t.Errorf("Expected %v to fail to construct a decider", config)
+		}
+	}
+}
+
+func TestRequireTokenDecider(t *testing.T) {
+	os.Setenv("BOUNCER_TEST_TOKENS", "from-env")
+	defer os.Unsetenv("BOUNCER_TEST_TOKENS")
+
+	decider := bouncer.RequireTokenDecider(map[string]string{"tokens": "first,second", "tokenEnv": "BOUNCER_TEST_TOKENS"})
+	testCases := []struct {
+		name            string
+		authorization   string
+		expectedSuccess bool
+	}{
+		{"Test Valid Token Passes", "Bearer second", true},
+		{"Test Scheme Is Case Insensitive", "bearer first", true},
+		{"Test Token From The Environment Passes", "Bearer from-env", true},
+		{"Test Wrong Token Fails", "Bearer third", false},
+		{"Test Token Prefix Fails", "Bearer firs", false},
+		{"Test Basic Auth Fails", "Basic Zmlyc3Q6", false},
+		{"Test Missing Header Fails", "", false},
+	}
+
+	for _, testCase := range testCases {
+		req := mustBuildRequest("", t)
+		if testCase.authorization != "" {
+			req.Header.Set("Authorization", testCase.authorization)
+		}
+
+		response := decider(req, context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			t.Errorf("Test '%s' failed - expected success to be %t, got %v", testCase.name, testCase.expectedSuccess, response)
+		}
+
+		if response != nil && (response.Status != 401 || !strings.HasPrefix(response.Header.Get("WWW-Authenticate"), `Bearer realm="alertmanager"`)) {
+			t.Errorf("Test '%s' failed - expected a 401 with a WWW-Authenticate challenge, got %d %v", testCase.name, response.Status, response.Header)
+		}
+	}
+
+	for _, config := range []map[string]string{
+		{},
+		{"tokenEnv": "BOUNCER_TEST_TOKENS_MISSING"},
+	} {
+		if bouncer.RequireTokenDecider(config) != nil {
+			t.Errorf("Expected %v to fail to construct a decider", config)
+		}
+	}
+}
+
+func TestExternalAuthDecider(t *testing.T) {
+	var lock sync.Mutex
+	var lastInput map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var request struct {
+			Input map[string]interface{} `json:"input"`
+		}
+		json.NewDecoder(r.Body).Decode(&request)
+		lock.Lock()
+		lastInput = request.Input
+		lock.Unlock()
+
+		switch r.URL.Path {
+		case "/allow":
+			w.Write([]byte(`{"allow": true}`))
+		case "/deny":
+			w.Write([]byte(`{"allow": false, "reason": "Silences of prod need an on call approval"}`))
+		case "/opa":
+			w.Write([]byte(`{"result": {"allow": false, "reason": "Denied by OPA"}}`))
+		case "/forbidden":
+			w.WriteHeader(403)
+		case "/garbage":
+			w.Write([]byte(`cats`))
+		case "/slow":
+			time.Sleep(200 * time.Millisecond)
+			w.Write([]byte(`{"allow": true}`))
+		}
+	}))
+	defer server.Close()
+
+	testCases := []struct {
+		name           string
+		config         map[string]string
+		expectedStatus int
+		expectedReason string
+	}{
+		{"Test Allowed Requests Pass", map[string]string{"url": server.URL + "/allow"}, 0, ""},
+		{"Test Denials Pass On The Reason", map[string]string{"url": server.URL + "/deny"}, 403, "Silences of prod need an on call approval"},
+		{"Test OPA Results Are Understood", map[string]string{"url": server.URL + "/opa"}, 403, "Denied by OPA"},
+		{"Test Non 2xx Responses Deny", map[string]string{"url": server.URL + "/forbidden"}, 403, "Request denied by policy"},
+		{"Test Invalid Responses Fail Closed", map[string]string{"url": server.URL + "/garbage"}, 503, ""},
+		{"Test Timeouts Fail Closed", map[string]string{"url": server.URL + "/slow", "timeout": "50ms"}, 503, ""},
+		{"Test Timeouts Can Fail Open", map[string]string{"url": server.URL + "/slow", "timeout": "50ms", "failOpen": "true"}, 0, ""},
+	}
+
+	for _, testCase := range testCases {
+		decider := bouncer.ExternalAuthDecider(testCase.config)
+		req := mustMakeRequest(t, "POST", "http://localhost/api/v2/silences?dryRun=1", `{"comment":"test"}`)
+		req.Header = http.Header{"X-Forwarded-User": []string{"colin"}}
+		response := decider(req, context.Background())
+		if testCase.expectedStatus == 0 {
+			if response != nil {
+				t.Errorf("Test '%s' failed - expected the request to pass, got %s", testCase.name, response.Err)
+			}
+			continue
+		}
+
+		if response == nil || response.Status != testCase.expectedStatus {
+			t.Errorf("Test '%s' failed - expected a %d, got %v", testCase.name, testCase.expectedStatus, response)
+			continue
+		}
+
+		if testCase.expectedReason != "" && response.Err.Error() != testCase.expectedReason {
+			t.Errorf("Test '%s' failed - expected the reason %q, got %q", testCase.name, testCase.expectedReason, response.Err)
+		}
+	}
+
+	lock.Lock()
+	if lastInput["method"] != "POST" || lastInput["path"] != "/api/v2/silences" || lastInput["body"] != `{"comment":"test"}` {
+		t.Errorf("Expected the request to be described to the service, got %v", lastInput)
+	}
+	lock.Unlock()
+
+	// The request's own deadline should cut the call short, even when the timeout is longer
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	decider := bouncer.ExternalAuthDecider(map[string]string{"url": server.URL + "/slow", "timeout": "10s"})
+	if response := decider(mustMakeRequest(t, "POST", "http://localhost/api/v2/silences", ""), ctx); response == nil || response.Status != 503 {
+		t.Errorf("Expected a request past its deadline to fail closed, got %v", response)
+	}
+
+	if time.Since(start) > 150*time.Millisecond {
+		t.Errorf("Expected the request's deadline to be honoured, but it took %s", time.Since(start))
+	}
+
+	for _, config := range []map[string]string{
+		{"url": server.URL, "timeout": "soon"},
+		{"url": server.URL, "failOpen": "sometimes"},
+	} {
+		if bouncer.ExternalAuthDecider(config) != nil {
+			t.Errorf("Expected %v to fail to construct a decider", config)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package bouncer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"time"
+)
+
+// BackendTLSConfig configures TLS to the backend, e.g. for an Alertmanager served over HTTPS with a private CA
+type BackendTLSConfig struct {
+	// CAFile is a PEM file of the CAs to trust for the backend's certificate. The system's CAs are trusted if it's empty
+	CAFile string
+
+	// CertFile and KeyFile are the client certificate to present to the backend, if it wants one
+	CertFile string
+	KeyFile  string
+
+	// ServerName overrides the name the backend's certificate is checked against, which is the host of the backend URL by default
+	ServerName string
+
+	// InsecureSkipVerify turns off checking of the backend's certificate. Only use it for testing
+	InsecureSkipVerify bool
+}
+
+// BackendConfig configures the connection from a BouncingReverseProxy to its backend. Zero timeouts
+// get the same defaults as http.DefaultTransport
+type BackendConfig struct {
+	TLS BackendTLSConfig
+
+	// DialTimeout is the timeout of the initial connection to the backend
+	DialTimeout time.Duration
+
+	// TLSHandshakeTimeout is the timeout of the TLS handshake, after the connection is established
+	TLSHandshakeTimeout time.Duration
+
+	// ResponseHeaderTimeout is the timeout waiting for the backend's response headers, after the request is sent
+	ResponseHeaderTimeout time.Duration
+}
+
+// tlsConfig builds the tls.Config for connections to the backend
+func (b BackendTLSConfig) tlsConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         b.ServerName,
+		InsecureSkipVerify: b.InsecureSkipVerify,
+	}
+
+	if b.CAFile != "" {
+		pem, err := ioutil.ReadFile(b.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to read CA file %s: %s", b.CAFile, err)
+		}
+
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("No certificates found in CA file %s", b.CAFile)
+		}
+	}
+
+	if b.CertFile != "" || b.KeyFile != "" {
+		if b.CertFile == "" || b.KeyFile == "" {
+			return nil, fmt.Errorf("Client certificates need both a cert file and a key file")
+		}
+
+		certificate, err := tls.LoadX509KeyPair(b.CertFile, b.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("Failed to load client certificate: %s", err)
+		}
+
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// NewBackendTransport builds a Transport for connecting to a backend with the given config
+func NewBackendTransport(config BackendConfig) (*http.Transport, error) {
+	tlsConfig, err := config.TLS.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	if config.DialTimeout != 0 {
+		transport.DialContext = (&net.Dialer{
+			Timeout:   config.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+	}
+
+	if config.TLSHandshakeTimeout != 0 {
+		transport.TLSHandshakeTimeout = config.TLSHandshakeTimeout
+	}
+
+	if config.ResponseHeaderTimeout != 0 {
+		transport.ResponseHeaderTimeout = config.ResponseHeaderTimeout
+	}
+
+	return transport, nil
+}
+
+// NewBouncingReverseProxyWithConfig generates a ReverseProxy instance which runs the given set of bouncers
+// on every request that passes through it, connecting to the backend with the given config
+func NewBouncingReverseProxyWithConfig(backend *url.URL, bouncers []Bouncer, config BackendConfig) (*httputil.ReverseProxy, error) {
+	transport, err := NewBackendTransport(config)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewBouncingReverseProxy(backend, bouncers, transport), nil
+}
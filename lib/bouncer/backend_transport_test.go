@@ -0,0 +1,104 @@
+package bouncer_test
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+func TestNewBouncingReverseProxyWithConfig(t *testing.T) {
+	backend := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer backend.Close()
+
+	dir, err := ioutil.TempDir("", "backend_transport")
+	if err != nil {
+		t.Fatalf("Failed to create temp dir: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	caFile := filepath.Join(dir, "ca.pem")
+	caPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: backend.Certificate().Raw})
+	if err := ioutil.WriteFile(caFile, caPEM, 0644); err != nil {
+		t.Fatalf("Failed to write CA file: %s", err)
+	}
+
+	notPEMFile := filepath.Join(dir, "not_pem.pem")
+	if err := ioutil.WriteFile(notPEMFile, []byte("not a certificate"), 0644); err != nil {
+		t.Fatalf("Failed to write CA file: %s", err)
+	}
+
+	backendURL, _ := url.Parse(backend.URL)
+
+	tests := []struct {
+		name           string
+		config         bouncer.BackendConfig
+		expectedError  bool
+		expectedStatus int
+	}{
+		{
+			name:           "Default config doesn't trust the backend's cert",
+			config:         bouncer.BackendConfig{},
+			expectedStatus: http.StatusBadGateway,
+		},
+		{
+			name:           "CA file trusts the backend's cert",
+			config:         bouncer.BackendConfig{TLS: bouncer.BackendTLSConfig{CAFile: caFile}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:           "InsecureSkipVerify skips checking the backend's cert",
+			config:         bouncer.BackendConfig{TLS: bouncer.BackendTLSConfig{InsecureSkipVerify: true}},
+			expectedStatus: http.StatusOK,
+		},
+		{
+			name:          "Missing CA file errors",
+			config:        bouncer.BackendConfig{TLS: bouncer.BackendTLSConfig{CAFile: filepath.Join(dir, "missing.pem")}},
+			expectedError: true,
+		},
+		{
+			name:          "CA file without certificates errors",
+			config:        bouncer.BackendConfig{TLS: bouncer.BackendTLSConfig{CAFile: notPEMFile}},
+			expectedError: true,
+		},
+		{
+			name:          "Client cert without a key errors",
+			config:        bouncer.BackendConfig{TLS: bouncer.BackendTLSConfig{CertFile: caFile}},
+			expectedError: true,
+		},
+	}
+
+	for _, test := range tests {
+		proxy, err := bouncer.NewBouncingReverseProxyWithConfig(backendURL, nil, test.config)
+		if test.expectedError {
+			if err == nil {
+				t.Errorf("Test '%s' failed - expected an error, but didn't get one", test.name)
+			}
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Test '%s' failed - unexpected error: %s", test.name, err)
+			continue
+		}
+
+		proxy.ErrorLog = nil
+		proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, httptest.NewRequest("GET", "/api/v2/silences", nil))
+		if recorder.Code != test.expectedStatus {
+			t.Errorf("Test '%s' failed - expected status %d, got %d", test.name, test.expectedStatus, recorder.Code)
+		}
+	}
+}
@@ -2,110 +2,625 @@ package bouncer
 
 import (
 	"bytes"
+	"compress/gzip"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
-	"log"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"os"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	johari "github.com/sinkingpoint/johari-go/lib"
+	"go.opentelemetry.io/otel"
 	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 	"gopkg.in/yaml.v2"
 )
 
 type deciderSerialized struct {
-	Name   string            `yaml:"name"`
-	Config map[string]string `yaml:"config"`
+	Name          string        `yaml:"name"`
+	Config        DeciderConfig `yaml:"config"`
+	DryRun        bool          `yaml:"dryrun"`
+	Timeout       string        `yaml:"timeout"`
+	TimeoutStatus string        `yaml:"timeoutStatus"`
 }
 
 type bouncerSerialized struct {
-	Method   string              `yaml:"method"`
-	URIRegex string              `yaml:"uriRegex"`
-	Deciders []deciderSerialized `yaml:"deciders"`
-	DryRun   bool                `yaml:"dryrun"`
+	Name            string              `yaml:"name"`
+	Method          string              `yaml:"method"`
+	Methods         []string            `yaml:"methods"`
+	QueryParams     map[string]string   `yaml:"queryParams"`
+	Headers         map[string]string   `yaml:"headers"`
+	URIRegex        string              `yaml:"uriRegex"`
+	ExcludeURIRegex string              `yaml:"excludeURIRegex"`
+	URIRegexFlags   string              `yaml:"uriRegexFlags"`
+	ContentType     string              `yaml:"contentType"`
+	Deciders        []deciderSerialized `yaml:"deciders"`
+	DryRun          bool                `yaml:"dryrun"`
+	Logic           string              `yaml:"logic"`
+}
+
+// buildDecider instantiates the decider template with the given name, checking that
+// all its required config variables are set
+func buildDecider(name string, config map[string]string) (Decider, error) {
+	// The lock isn't held while the template is instantiated, as templates can build their own child deciders
+	template, exists := lookupDeciderTemplate(name)
+	if !exists {
+		return nil, fmt.Errorf("No decider template named %s found", name)
+	}
+
+	for _, expected := range template.requiredConfigVars {
+		if _, exists := config[expected]; !exists {
+			return nil, fmt.Errorf("Expected config variable %s not found for %s", expected, name)
+		}
+	}
+
+	status := 0
+	if config["status"] != "" {
+		var err error
+		status, err = parseRejectionStatus(config["status"])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid status for %s: %s", name, err)
+		}
+	}
+
+	decider, err := template.templateFunc(config)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid config for %s: %s", name, err)
+	}
+
+	if status != 0 {
+		decider = withRejectionStatus(decider, status)
+	}
+
+	return decider, nil
+}
+
+// envReference matches references to environment variables in decider config values, like `${VAR}`, or `${VAR:-default}`
+// to fall back to a default when VAR is unset or empty. `$${` escapes a literal `${`
+var envReference = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)(:-([^}]*))?\}`)
+
+// expandConfigEnv returns a copy of the given decider config, with environment variable references in its values
+// replaced with the variables' values, so that e.g. secrets can be kept out of the config file. Only decider configs
+// are expanded, as `$` is meaningful in the bouncers' regexes
+func expandConfigEnv(config map[string]string) (map[string]string, error) {
+	if config == nil {
+		return nil, nil
+	}
+
+	expanded := make(map[string]string, len(config))
+	for key, value := range config {
+		var err error
+		expanded[key] = envReference.ReplaceAllStringFunc(value, func(reference string) string {
+			if strings.HasPrefix(reference, "$$") {
+				return reference[1:]
+			}
+
+			match := envReference.FindStringSubmatch(reference)
+			if variable := os.Getenv(match[1]); variable != "" {
+				return variable
+			}
+
+			if match[2] != "" {
+				return match[3]
+			}
+
+			if _, set := os.LookupEnv(match[1]); !set && err == nil {
+				err = fmt.Errorf("%s references the environment variable %s, which isn't set", key, match[1])
+			}
+
+			return ""
+		})
+
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return expanded, nil
+}
+
+// parseRejectionStatus parses a status code that a decider should reject requests with, which must be a 4xx or a 5xx
+func parseRejectionStatus(value string) (int, error) {
+	status, err := strconv.Atoi(value)
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a number", value)
+	}
+
+	if status < 400 || status > 599 {
+		return 0, fmt.Errorf("%d is not a 4xx or 5xx status code", status)
+	}
+
+	return status, nil
+}
+
+// withRejectionStatus wraps the given decider so that its rejections are returned with the given status.
+// Only 4xx rejections are changed, so that errors where the decider couldn't make a decision (e.g. a 503 from
+// an unreachable Alertmanager) still surface as such
+func withRejectionStatus(decider Decider, status int) Decider {
+	return func(req *http.Request, context context.Context) *HTTPError {
+		err := decider(req, context)
+		if err != nil && err.Status >= 400 && err.Status < 500 {
+			err.Status = status
+		}
+
+		return err
+	}
 }
 
 // ParseBouncers loads a slice of Bouncers from a given byte array
 // which should represent a YAML encoded text stream of serialized bouncers.
 func ParseBouncers(bytes []byte) ([]Bouncer, error) {
+	var file bouncersFile
+	err := yaml.Unmarshal(bytes, &file)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(file.Include) > 0 {
+		return nil, fmt.Errorf("include is only supported when loading bouncers from a file, with ParseBouncersFromFile")
+	}
+
+	return parseSourcedBouncers(file.sourcedBouncers(""))
+}
+
+// bouncersFile is the top level of a bouncers config
+type bouncersFile struct {
+	Include  []string            `yaml:"include"`
+	Bypass   []bouncerSerialized `yaml:"bypass"`
+	Bouncers []bouncerSerialized `yaml:"bouncers"`
+}
+
+// sourcedBouncers lists the bypass targets and bouncers in the given file, loaded from the given path
+func (f bouncersFile) sourcedBouncers(path string) []sourcedBouncer {
+	sourced := make([]sourcedBouncer, 0, len(f.Bypass)+len(f.Bouncers))
+	for i, serialized := range f.Bypass {
+		sourced = append(sourced, sourcedBouncer{file: path, index: i, serialized: serialized, bypass: true})
+	}
+
+	for i, serialized := range f.Bouncers {
+		sourced = append(sourced, sourcedBouncer{file: path, index: i, serialized: serialized})
+	}
+
+	return sourced
+}
+
+// sourcedBouncer is a serialized bouncer, along with where it came from for errors. file is empty for bouncers
+// that weren't loaded from a file. bypass is set for the targets in the bypass section
+type sourcedBouncer struct {
+	file       string
+	index      int
+	serialized bouncerSerialized
+	bypass     bool
+}
+
+func (s sourcedBouncer) location() string {
+	kind := "bouncer"
+	if s.bypass {
+		kind = "bypass"
+	}
+
+	location := fmt.Sprintf("%s %d (%s)", kind, s.index, s.serialized.description())
+	if s.file != "" {
+		location = s.file + ": " + location
+	}
+
+	return location
+}
+
+// parseSourcedBouncers builds the given serialized bouncers, checking that their names are unique
+func parseSourcedBouncers(sourced []sourcedBouncer) ([]Bouncer, error) {
 	InitDeciderTemplates()
-	var serializedBouncers struct {
-		Bouncers []bouncerSerialized `yaml:"bouncers"`
+
+	// Every bouncer is parsed, even after one fails, so that all the problems with the config can be fixed at once
+	var errs ConfigErrors
+	names := map[string]sourcedBouncer{}
+	bouncers := make([]Bouncer, len(sourced))
+	for i, source := range sourced {
+		bouncer, bouncerErrs := parseBouncer(source.serialized)
+		if source.bypass {
+			bouncer.Bypass = true
+			if len(source.serialized.Deciders) > 0 {
+				bouncerErrs = append(bouncerErrs, fmt.Errorf("bypassed requests skip every decider, so bypass targets can't have deciders"))
+			}
+		}
+
+		for _, err := range bouncerErrs {
+			errs = append(errs, fmt.Errorf("%s: %s", source.location(), err))
+		}
+
+		// Only explicit names have to be unique, as bouncers can legitimately target the same thing
+		if name := source.serialized.Name; name != "" {
+			if first, exists := names[name]; exists {
+				errs = append(errs, fmt.Errorf("%s: the name %s is already used by %s", source.location(), name, first.location()))
+			} else {
+				names[name] = source
+			}
+		}
+
+		bouncers[i] = bouncer
+	}
+
+	if len(errs) > 0 {
+		return nil, errs
+	}
+
+	return bouncers, nil
+}
+
+// ConfigErrors is every problem with a bouncers config, as returned by ParseBouncers. Each error says which
+// bouncer (and decider) it's in. Callers that only want one error can take the first
+type ConfigErrors []error
+
+func (c ConfigErrors) Error() string {
+	if len(c) == 1 {
+		return c[0].Error()
+	}
+
+	messages := make([]string, len(c))
+	for i, err := range c {
+		messages[i] = err.Error()
 	}
-	err := yaml.Unmarshal(bytes, &serializedBouncers)
+
+	return fmt.Sprintf("%d errors in the bouncers config:\n%s", len(c), strings.Join(messages, "\n"))
+}
+
+// ValidateBouncersConfig checks that the given YAML encoded bouncers config is valid, i.e. that ParseBouncers would
+// accept it, without keeping the bouncers. Errors say which bouncer (and decider) is invalid, and list every problem with the
+// config as ConfigErrors, so this can be used to check configs before they're deployed
+func ValidateBouncersConfig(bytes []byte) error {
+	_, err := ParseBouncers(bytes)
+	return err
+}
+
+// description identifies a serialized bouncer in errors, by its name if it has one, or by what it targets
+func (b bouncerSerialized) description() string {
+	if b.Name != "" {
+		return b.Name
+	}
+
+	methods := append([]string{}, b.Methods...)
+	if b.Method != "" {
+		methods = append([]string{b.Method}, methods...)
+	}
+
+	if len(methods) == 0 {
+		methods = []string{"*"}
+	}
+
+	return strings.Join(methods, ",") + " " + b.URIRegex
+}
+
+// uriRegexFlagsPrefix converts the uriRegexFlags of a bouncer, e.g. `i` for case insensitive matching, into the inline flags
+// to prepend to its URI regexes, e.g. `(?i)`. The flags are the ones Go regexps support inline: i, m, s, and U
+func uriRegexFlagsPrefix(flags string) (string, error) {
+	if flags == "" {
+		return "", nil
+	}
+
+	for _, flag := range flags {
+		if !strings.ContainsRune("imsU", flag) {
+			return "", fmt.Errorf("Invalid uriRegexFlags %s: unknown flag %q, must be one of i, m, s, or U", flags, flag)
+		}
+	}
+
+	return "(?" + flags + ")", nil
+}
+
+// parseBouncer builds a Bouncer from its serialized form, returning every problem with it rather than just the first
+func parseBouncer(serializedBouncer bouncerSerialized) (Bouncer, []error) {
+	var errs []error
+	flags, err := uriRegexFlagsPrefix(serializedBouncer.URIRegexFlags)
 	if err != nil {
-		return nil, err
+		errs = append(errs, err)
 	}
 
-	bouncers := make([]Bouncer, len(serializedBouncers.Bouncers))
-	for bouncerIndex, serializedBouncer := range serializedBouncers.Bouncers {
-		uriRegex, err := regexp.Compile(serializedBouncer.URIRegex)
+	uriRegex, err := regexp.Compile(flags + serializedBouncer.URIRegex)
+	if err != nil {
+		errs = append(errs, fmt.Errorf("Invalid uriRegex %s: %s", serializedBouncer.URIRegex, err))
+	}
+
+	// The single method form predates methods, so both are accepted
+	methods := serializedBouncer.Methods
+	if serializedBouncer.Method != "" {
+		methods = append([]string{serializedBouncer.Method}, methods...)
+	}
+
+	// Wildcards are pulled out into AnyMethod, rather than being compared against request methods. If a
+	// wildcard is given alongside other methods, the wildcard wins
+	target := Target{
+		URIRegex: uriRegex,
+	}
+
+	if serializedBouncer.ExcludeURIRegex != "" {
+		target.ExcludeURIRegex, err = regexp.Compile(flags + serializedBouncer.ExcludeURIRegex)
 		if err != nil {
-			return nil, err
+			errs = append(errs, fmt.Errorf("Invalid excludeURIRegex %s: %s", serializedBouncer.ExcludeURIRegex, err))
+		}
+	}
+
+	if serializedBouncer.ContentType != "" {
+		target.ContentType, err = regexp.Compile(serializedBouncer.ContentType)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Invalid contentType %s: %s", serializedBouncer.ContentType, err))
 		}
+	}
 
-		target := Target{
-			Method:   serializedBouncer.Method,
-			URIRegex: uriRegex,
+	for _, method := range methods {
+		if isWildcardMethod(method) {
+			target.AnyMethod = true
+		} else {
+			target.Methods = append(target.Methods, method)
 		}
+	}
+
+	if target.AnyMethod {
+		target.Methods = nil
+	}
 
-		deciders := make([]Decider, len(serializedBouncer.Deciders))
-		for deciderIndex, serializedDecider := range serializedBouncer.Deciders {
-			if _, exists := deciderTemplates[serializedDecider.Name]; !exists {
-				return nil, fmt.Errorf("No decider template named %s found", serializedDecider.Name)
+	if len(serializedBouncer.QueryParams) > 0 {
+		target.QueryParams = map[string]*regexp.Regexp{}
+		for _, name := range sortedKeys(serializedBouncer.QueryParams) {
+			target.QueryParams[name], err = regexp.Compile(serializedBouncer.QueryParams[name])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Invalid regex for query parameter %s: %s", name, err))
 			}
+		}
+	}
 
-			for _, expected := range deciderTemplates[serializedDecider.Name].requiredConfigVars {
-				if _, exists := serializedDecider.Config[expected]; !exists {
-					return nil, fmt.Errorf("Expected config variable %s not found for %s", expected, serializedDecider.Name)
-				}
+	if len(serializedBouncer.Headers) > 0 {
+		target.Headers = map[string]*regexp.Regexp{}
+		for _, name := range sortedKeys(serializedBouncer.Headers) {
+			target.Headers[name], err = regexp.Compile(serializedBouncer.Headers[name])
+			if err != nil {
+				errs = append(errs, fmt.Errorf("Invalid regex for header %s: %s", name, err))
 			}
+		}
+	}
+
+	logic := Logic(strings.ToLower(serializedBouncer.Logic))
+	if logic == "" {
+		logic = LogicAll
+	}
 
-			deciders[deciderIndex] = deciderTemplates[serializedDecider.Name].templateFunc(serializedDecider.Config)
+	if logic != LogicAll && logic != LogicAny {
+		errs = append(errs, fmt.Errorf("Invalid logic %s: must be one of all or any", serializedBouncer.Logic))
+	}
+
+	deciders := make([]Decider, len(serializedBouncer.Deciders))
+	deciderOptions := make([]DeciderOptions, len(serializedBouncer.Deciders))
+	for deciderIndex, serializedDecider := range serializedBouncer.Deciders {
+		config, err := expandConfigEnv(serializedDecider.Config)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("decider %d (%s): %s", deciderIndex, serializedDecider.Name, err))
+			continue
+		}
+
+		decider, err := buildDecider(serializedDecider.Name, config)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("decider %d (%s): %s", deciderIndex, serializedDecider.Name, err))
+			continue
 		}
 
-		bouncers[bouncerIndex] = Bouncer{
-			Target:   target,
-			Deciders: deciders,
-			DryRun:   serializedBouncer.DryRun,
+		var timeout time.Duration
+		if serializedDecider.Timeout != "" {
+			timeout, err = time.ParseDuration(serializedDecider.Timeout)
+			if err != nil || timeout <= 0 {
+				errs = append(errs, fmt.Errorf("decider %d (%s): Invalid timeout %s: must be a positive duration, like 2s", deciderIndex, serializedDecider.Name, serializedDecider.Timeout))
+				continue
+			}
+		}
+
+		timeoutStatus := 0
+		if serializedDecider.TimeoutStatus != "" {
+			timeoutStatus, err = parseRejectionStatus(serializedDecider.TimeoutStatus)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("decider %d (%s): Invalid timeoutStatus: %s", deciderIndex, serializedDecider.Name, err))
+				continue
+			}
+		}
+
+		deciders[deciderIndex] = decider
+		deciderOptions[deciderIndex] = DeciderOptions{
+			Name:          serializedDecider.Name,
+			DryRun:        serializedDecider.DryRun,
+			Timeout:       timeout,
+			TimeoutStatus: timeoutStatus,
 		}
 	}
 
-	return bouncers, nil
+	if len(errs) > 0 {
+		return Bouncer{}, errs
+	}
+
+	bouncer := Bouncer{
+		Name:           serializedBouncer.Name,
+		Target:         target,
+		Deciders:       deciders,
+		DeciderOptions: deciderOptions,
+		DryRun:         serializedBouncer.DryRun,
+		Logic:          logic,
+	}
+
+	if bouncer.Name == "" {
+		bouncer.Name = bouncer.displayName()
+	}
+
+	return bouncer, nil
+}
+
+// sortedKeys returns the keys of the given map in order, so that they're always reported in the same order
+func sortedKeys(values map[string]string) []string {
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// isWildcardMethod returns whether the given configured method means "every method"
+func isWildcardMethod(method string) bool {
+	return method == "*" || strings.EqualFold(method, "ANY")
 }
 
 // Target Represents a potential target for an HTTP request
-// with both a Method (Which represents the HTTP method), and a URI Regex
-// which matches the URI of the request
+// with both a list of Methods (Which represent the HTTP methods), and a URI Regex
+// which matches the URI of the request. An empty list of Methods, or AnyMethod, matches every method.
+// Requests whose URI matches the ExcludeURIRegex don't match, even if they match the URIRegex.
+// If there are any QueryParams (or Headers), each of them must be in the request's query (or headers), with a value matching its regex.
+// If there's a ContentType regex, the request's Content-Type header must match it, and requests without one don't match
 type Target struct {
-	Method   string
-	URIRegex *regexp.Regexp
+	Methods         []string
+	AnyMethod       bool
+	URIRegex        *regexp.Regexp
+	ExcludeURIRegex *regexp.Regexp
+	QueryParams     map[string]*regexp.Regexp
+	Headers         map[string]*regexp.Regexp
+	ContentType     *regexp.Regexp
+}
+
+// methodsString returns a description of the methods the Target matches, e.g. `POST,PUT`, or `*` for every method
+func (t Target) methodsString() string {
+	if t.AnyMethod || len(t.Methods) == 0 {
+		return "*"
+	}
+
+	return strings.Join(t.Methods, ",")
 }
 
 // Matches returns whether the given the given Target matches the given
-// request, i.e. the method matches, and the URI matches the regex
+// request, i.e. one of the methods matches, and the URI matches the regex
 func (t Target) Matches(req *http.Request) bool {
-	methodMatches := strings.EqualFold(req.Method, t.Method)
-	uriMatches := t.URIRegex.MatchString(req.URL.RequestURI())
-	return methodMatches && uriMatches
+	// With a wildcard, the request's method is never compared, so it doesn't matter what it is
+	methodMatches := t.AnyMethod || len(t.Methods) == 0
+	if !methodMatches {
+		for _, method := range t.Methods {
+			if strings.EqualFold(req.Method, method) {
+				methodMatches = true
+				break
+			}
+		}
+	}
+
+	uri := req.URL.RequestURI()
+	uriMatches := t.URIRegex == nil || t.URIRegex.MatchString(uri)
+	if t.ExcludeURIRegex != nil && t.ExcludeURIRegex.MatchString(uri) {
+		uriMatches = false
+	}
+
+	if !methodMatches || !uriMatches {
+		return false
+	}
+
+	if t.ContentType != nil {
+		contentType := req.Header.Get("Content-Type")
+		if contentType == "" || !t.ContentType.MatchString(contentType) {
+			return false
+		}
+	}
+
+	query := req.URL.Query()
+	if !valuesMatch(t.QueryParams, func(name string) []string { return query[name] }) {
+		return false
+	}
+
+	return valuesMatch(t.Headers, func(name string) []string { return req.Header[http.CanonicalHeaderKey(name)] })
+}
+
+// valuesMatch returns whether, for every name in the given map, at least one of the values
+// returned by getValues matches the name's regex. Names without any values don't match
+func valuesMatch(regexes map[string]*regexp.Regexp, getValues func(name string) []string) bool {
+	for name, regex := range regexes {
+		matched := false
+		for _, value := range getValues(name) {
+			if regex.MatchString(value) {
+				matched = true
+				break
+			}
+		}
+
+		if !matched {
+			return false
+		}
+	}
+
+	return true
 }
 
 // HTTPError represents an error, coupled with an HTTP Status Code
 type HTTPError struct {
 	Status int
 	Err    error
+
+	// Header is any extra headers to send back with the error, e.g. a Retry-After
+	Header http.Header
 }
 
-// ToResponse converts the given HTTPError into an HTTP Response,
-// which can be sent back to a client
+// ErrorFormat is the format of the bodies of rejected requests
+type ErrorFormat string
+
+const (
+	// ErrorFormatText sends the error as the plain text body of the response
+	ErrorFormatText ErrorFormat = "text"
+
+	// ErrorFormatJSON sends the error as a JSON object like `{"status":"error","error":"..."}`, mirroring the Alertmanager API
+	ErrorFormatJSON ErrorFormat = "json"
+)
+
+// errorResponse is the body of a rejection in the ErrorFormatJSON format
+type errorResponse struct {
+	Status string `json:"status"`
+	Error  string `json:"error"`
+}
+
+// ToResponse converts the given HTTPError into an HTTP Response with a plain text body,
+// which can be sent back to a client. The error's Header is copied into the response,
+// although the Content-Type and Content-Length always describe the error body
 func (h *HTTPError) ToResponse() *http.Response {
+	return h.ToFormattedResponse(ErrorFormatText)
+}
+
+// ToFormattedResponse converts the given HTTPError into an HTTP Response like ToResponse, with its body in the given format
+func (h *HTTPError) ToFormattedResponse(format ErrorFormat) *http.Response {
+	header := http.Header{}
+	for name, values := range h.Header {
+		header[name] = append([]string(nil), values...)
+	}
+
+	body := []byte(h.Err.Error())
+	if format == ErrorFormatJSON {
+		// Marshalling a struct of strings can't fail
+		body, _ = json.Marshal(errorResponse{
+			Status: "error",
+			Error:  h.Err.Error(),
+		})
+		header.Set("Content-Type", "application/json")
+	} else {
+		header.Set("Content-Type", "text/plain; charset=utf-8")
+	}
+
+	header.Set("Content-Length", strconv.Itoa(len(body)))
 	return &http.Response{
-		StatusCode: h.Status,
-		Body:       ioutil.NopCloser(bytes.NewBufferString(h.Err.Error())),
+		Status:        fmt.Sprintf("%d %s", h.Status, http.StatusText(h.Status)),
+		StatusCode:    h.Status,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(body)),
 	}
 }
 
@@ -113,99 +628,885 @@ func (h *HTTPError) ToResponse() *http.Response {
 // an HTTPError, if the given request should be rejected
 type Decider func(req *http.Request, context context.Context) *HTTPError
 
+// rewrittenBody is a request body that has been replaced by a mutating decider
+// through RewriteBody. Bounce picks these up so that the change is seen by
+// subsequent deciders, and forwarded to the backend
+type rewrittenBody struct {
+	*bytes.Reader
+	body []byte
+}
+
+func (r *rewrittenBody) Close() error {
+	return nil
+}
+
+// RewriteBody replaces the body of the given request with the given bytes,
+// updating the ContentLength to match. Deciders that want to mutate a request,
+// rather than just accept or reject it, use this to have their changes
+// persisted by Bounce.
+//
+// Deciders run in the order they're defined, and each one sees the body as the deciders
+// (and bouncers) before it left it, so the last rewrite wins. A rewrite is only kept if the
+// decider that made it accepts the request and isn't in dry run mode. The Content-Length is recomputed from the
+// final body before the request is forwarded
+func RewriteBody(req *http.Request, body []byte) {
+	req.Body = &rewrittenBody{
+		Reader: bytes.NewReader(body),
+		body:   body,
+	}
+	setContentLength(req, len(body))
+}
+
+// BodyMutator is a function which takes an HTTP request, and its body, and returns the body that should be forwarded
+// in its place (which can be the given one, if it doesn't need changing), or an HTTPError if the request should be rejected
+type BodyMutator func(req *http.Request, body []byte, context context.Context) ([]byte, *HTTPError)
+
+// MutatingDecider returns a Decider that runs the given mutator over the body of every request, forwarding the body
+// it returns through RewriteBody, so that deciders can fix requests up (e.g. filling in a default comment) rather than rejecting them
+func MutatingDecider(mutator BodyMutator) Decider {
+	return func(req *http.Request, context context.Context) *HTTPError {
+		body, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 500,
+				Err:    fmt.Errorf("Failed to read body from request"),
+			}
+		}
+
+		mutated, httpErr := mutator(req, body, context)
+		if httpErr != nil {
+			return httpErr
+		}
+
+		if !bytes.Equal(mutated, body) {
+			RewriteBody(req, mutated)
+		}
+
+		return nil
+	}
+}
+
+// setContentLength updates both the ContentLength of the given request, and the
+// Content-Length header if the client sent one, so the two never disagree.
+// Any chunked Transfer-Encoding is dropped, as we now know the exact length
+func setContentLength(req *http.Request, length int) {
+	req.ContentLength = int64(length)
+	req.TransferEncoding = nil
+	if req.Header != nil && req.Header.Get("Content-Length") != "" {
+		req.Header.Set("Content-Length", strconv.Itoa(length))
+	}
+}
+
+// DeciderOptions are the settings of a single decider in a Bouncer
+type DeciderOptions struct {
+	// Name identifies the decider in logs and traces
+	Name string
+	// DryRun makes the decider just log the requests it would reject, even if the Bouncer isn't in dry run mode
+	DryRun bool
+	// Timeout bounds how long the decider can take, through the context it's given. Requests it takes longer than that over
+	// are rejected with the TimeoutStatus (default 504). Deciders that ignore their context aren't interrupted, but are still
+	// rejected once they return. Zero means no timeout
+	Timeout       time.Duration
+	TimeoutStatus int
+}
+
+// runDecider runs the given decider over the request, bounded by the timeout in its options, if it has one
+func runDecider(decider Decider, req *http.Request, ctx context.Context, options DeciderOptions) *HTTPError {
+	if options.Timeout <= 0 {
+		return decider(req, ctx)
+	}
+
+	tctx, cancel := context.WithTimeout(ctx, options.Timeout)
+	defer cancel()
+	err := decider(req, tctx)
+	if tctx.Err() == context.DeadlineExceeded {
+		status := options.TimeoutStatus
+		if status == 0 {
+			status = http.StatusGatewayTimeout
+		}
+
+		return &HTTPError{
+			Status: status,
+			Err:    fmt.Errorf("%s timed out after %s", options.Name, options.Timeout),
+		}
+	}
+
+	return err
+}
+
+// Logic is how a Bouncer combines the decisions of its Deciders
+type Logic string
+
+const (
+	// LogicAll rejects a request as soon as any decider rejects it, i.e. every decider has to accept it
+	LogicAll Logic = "all"
+
+	// LogicAny accepts a request as soon as any decider accepts it, only rejecting it if every decider rejects it.
+	// Deciders in dry run mode are left out of the decision, and the Bouncer's DryRun applies to the combined decision
+	LogicAny Logic = "any"
+)
+
 // Bouncer is a coupling of a Target, and a number of deciders. It can optionally
-// "Bounce" a request, i.e. reject it based on a series of Deciders
+// "Bounce" a request, i.e. reject it based on a series of Deciders. DeciderOptions
+// holds the options of the decider at the same index, and can be shorter than
+// Deciders (or empty), in which case the remaining deciders get the default options.
+// DryRun stops the bouncer rejecting requests, logging what it would have rejected instead. With LogicAll, that forces
+// every decider into dry run mode, and with LogicAny it applies to the combined decision. Name identifies the bouncer in logs and traces
 type Bouncer struct {
-	Target   Target
-	Deciders []Decider
-	DryRun   bool
+	Name           string
+	Target         Target
+	Deciders       []Decider
+	DeciderOptions []DeciderOptions
+	DryRun         bool
+
+	// Logic is how the decisions of the Deciders are combined. The zero value is LogicAll
+	Logic Logic
+
+	// Bypass makes requests matching the Target skip every bouncer, going straight to the backend without their bodies
+	// being read, e.g. for health checks. Bypass bouncers are checked before any others, wherever they are in the list
+	Bypass bool
+}
+
+// displayName returns the Name of the Bouncer, or one derived from its Target if it doesn't have one, e.g. `POST /api/v2/silences`
+func (b Bouncer) displayName() string {
+	if b.Name != "" {
+		return b.Name
+	}
+
+	uriRegex := ""
+	if b.Target.URIRegex != nil {
+		uriRegex = b.Target.URIRegex.String()
+	}
+
+	return b.Target.methodsString() + " " + uriRegex
 }
 
+// deciderOptions returns the options of the decider at the given index
+func (b Bouncer) deciderOptions(index int) DeciderOptions {
+	var options DeciderOptions
+	if index < len(b.DeciderOptions) {
+		options = b.DeciderOptions[index]
+	}
+
+	if options.Name == "" {
+		options.Name = fmt.Sprintf("decider %d", index)
+	}
+
+	return options
+}
+
+// DefaultMaxBodySize is the largest request body, in bytes, that bouncers will read if the proxy's MaxBodySize isn't set
+const DefaultMaxBodySize int64 = 10 << 20
+
 // Bounce takes an HTTPRequest and optionally returns an HTTPError
 // if the request should be "Bounced", i.e. rejected.
 func (b Bouncer) Bounce(req *http.Request) *HTTPError {
-	if !b.Target.Matches(req) {
-		return nil
+	err, _ := b.BounceWithResult(req)
+	return err
+}
+
+// Decision is what a decider decided about a request
+type Decision string
+
+const (
+	// DecisionAccepted means the decider let the request through
+	DecisionAccepted Decision = "accepted"
+
+	// DecisionRejected means the decider rejected the request
+	DecisionRejected Decision = "rejected"
+
+	// DecisionWouldReject means the decider would have rejected the request, but was in dry run mode
+	DecisionWouldReject Decision = "would_reject"
+)
+
+// DeciderResult is the decision of a single decider on a request, as returned by BounceWithResult
+type DeciderResult struct {
+	Name     string
+	Decision Decision
+	Duration time.Duration
+
+	// Err is why the decider rejected the request (or would have, in dry run mode). It's nil if the decider accepted it
+	Err *HTTPError
+}
+
+// BounceWithResult bounces the request like Bounce, also returning the decision of every decider that ran, in the order
+// they ran in. Deciders that didn't run, e.g. because an earlier one rejected the request, aren't included. The body is read
+// with the options of the BouncingReverseProxy the request is going through, or the defaults if it isn't going through one
+func (b Bouncer) BounceWithResult(req *http.Request) (*HTTPError, []DeciderResult) {
+	if !b.Target.Matches(req) || len(b.Deciders) == 0 {
+		return nil, nil
+	}
+
+	var options ProxyOptions
+	if state, ok := req.Context().Value(transportStateKey).(*transportState); ok {
+		options = state.options
+	}
+
+	rawBody, decoded, err := readBody(req, options)
+	if err != nil {
+		return err, nil
 	}
 
+	rawBody, rewritten, results, err := b.bounce(req, rawBody)
+	reseatBody(req, rawBody, rewritten || decoded)
+	return err, results
+}
+
+// readBody reads the whole body of the given request, so that every decider can read it, rejecting bodies over the MaxBodySize.
+// If DecodeGzip is set, gzipped bodies are decompressed, returning true so that the caller forwards the decompressed body
+func readBody(req *http.Request, options ProxyOptions) ([]byte, bool, *HTTPError) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return []byte{}, false, nil
+	}
+
+	defer req.Body.Close()
+	rawBody, err := readLimited(req, req.Body, options.maxBodySize())
+	if err != nil {
+		return nil, false, err
+	}
+
+	if !options.DecodeGzip || req.Header == nil || !strings.EqualFold(req.Header.Get("Content-Encoding"), "gzip") {
+		return rawBody, false, nil
+	}
+
+	reader, gzipErr := gzip.NewReader(bytes.NewReader(rawBody))
+	if gzipErr != nil {
+		markBounced(req)
+		return nil, false, &HTTPError{
+			Status: 400,
+			Err:    fmt.Errorf("Failed to decompress gzipped body: %s", gzipErr),
+		}
+	}
+
+	// The decompressed body is limited too, so that a small, highly compressed body can't make us buffer an enormous one
+	decoded, err := readLimited(req, reader, options.maxBodySize())
+	if err != nil {
+		return nil, false, err
+	}
+
+	req.Header.Del("Content-Encoding")
+	return decoded, true, nil
+}
+
+// readLimited reads all of the given reader, rejecting it with a 413 if it's over the given number of bytes
+func readLimited(req *http.Request, reader io.Reader, maxBodySize int64) ([]byte, *HTTPError) {
+	// Read one byte more than the limit, so that we can tell bodies at the limit from ones over it
+	rawBody, err := ioutil.ReadAll(io.LimitReader(reader, maxBodySize+1))
+	if err != nil {
+		return nil, &HTTPError{
+			Status: 500,
+			Err:    fmt.Errorf("Failed to read body from request"),
+		}
+	}
+
+	if int64(len(rawBody)) > maxBodySize {
+		markBounced(req)
+		return nil, &HTTPError{
+			Status: 413,
+			Err:    fmt.Errorf("Request bodies can be at most %d bytes", maxBodySize),
+		}
+	}
+
+	return rawBody, nil
+}
+
+// reseatBody replaces the body of the given request with the given one, after it's been read by readBody.
+// If the body was rewritten by a decider, the request's length is updated to match
+func reseatBody(req *http.Request, rawBody []byte, rewritten bool) {
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(rawBody))
+	if rewritten {
+		setContentLength(req, len(rawBody))
+	}
+}
+
+// bodyBufferPool holds the buffers that request bodies are copied into for each decider, so that
+// we don't allocate a new one for every decider on every request
+var bodyBufferPool = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// bounce runs the deciders over the given request, whose body has already been read into rawBody. Returns the body
+// that should be passed on, which is different to the given one if a decider rewrote it
+func (b Bouncer) bounce(req *http.Request, rawBody []byte) ([]byte, bool, []DeciderResult, *HTTPError) {
 	bctx, bspan := johari.NewChildSpan(req.Context(), "bouncer")
 	defer bspan.End()
 
-	bspan.SetAttributes(attribute.String("target_method", b.Target.Method))
-	bspan.SetAttributes(attribute.String("target_regex", b.Target.URIRegex.String()))
+	name := b.displayName()
+	bspan.SetAttributes(attribute.String("bouncer_name", name))
+	bspan.SetAttributes(attribute.String("target_method", b.Target.methodsString()))
+	if b.Target.URIRegex != nil {
+		bspan.SetAttributes(attribute.String("target_regex", b.Target.URIRegex.String()))
+	}
 	bspan.SetAttributes(attribute.Bool("dry_run", b.DryRun))
 
-	// We want multiple deciders to be able to read the body, so
-	// we have to read it here, and then reload it into a buffer for every decider
-	var rawBody []byte
-	var err error
-	if req.Body == nil || req.Body == http.NoBody {
-		rawBody = []byte{}
-	} else {
-		defer req.Body.Close()
-		rawBody, err = ioutil.ReadAll(req.Body)
-		if err != nil {
-			bspan.RecordError(err)
-			return &HTTPError{
-				Status: 500,
-				Err:    fmt.Errorf("Failed to read body from request"),
-			}
+	// The buffers handed to deciders are only returned to the pool once all the deciders have run. The caller reseats
+	// the body from rawBody afterwards so the forwarded request never references a pooled buffer
+	buffers := make([]*bytes.Buffer, 0, len(b.Deciders))
+	defer func() {
+		for _, buffer := range buffers {
+			buffer.Reset()
+			bodyBufferPool.Put(buffer)
 		}
+	}()
+
+	rewritten := false
+	var rejections []*HTTPError
+	var rejectedBy []string
+	results := make([]DeciderResult, 0, len(b.Deciders))
+	record := func(options DeciderOptions, decision Decision, duration time.Duration, err *HTTPError) {
+		bounceDecisions.WithLabelValues(name, options.Name, string(decision)).Inc()
+		results = append(results, DeciderResult{
+			Name:     options.Name,
+			Decision: decision,
+			Duration: duration,
+			Err:      err,
+		})
 	}
 
-	for _, decider := range b.Deciders {
+	// decide runs a single decider in its own span, returning whether the bouncer's decision has been made (and what it is).
+	// It's a closure, rather than the body of the loop, so that the span ends and the decider's body is closed as soon as the
+	// decider has run, rather than all of them being held open until the bouncer returns
+	decide := func(i int, decider Decider) (bool, *HTTPError) {
+		options := b.deciderOptions(i)
+		dryRun := b.DryRun || options.DryRun
 		dctx, dspan := johari.NewChildSpan(bctx, "decider")
 		defer dspan.End()
-		req.Body = ioutil.NopCloser(bytes.NewBuffer(rawBody))
-		defer req.Body.Close()
-		err := decider(req, dctx)
+		dspan.SetAttributes(attribute.String("decider_name", options.Name))
+		dspan.SetAttributes(attribute.Bool("dry_run", dryRun))
+		// We want multiple deciders to be able to read the body, so we reload it into a buffer for every decider
+		buffer := bodyBufferPool.Get().(*bytes.Buffer)
+		buffer.Write(rawBody)
+		buffers = append(buffers, buffer)
+		deciderBody := ioutil.NopCloser(buffer)
+		req.Body = deciderBody
+		contentLength, transferEncoding := req.ContentLength, req.TransferEncoding
+		var lengthHeader []string
+		if req.Header != nil {
+			lengthHeader = req.Header["Content-Length"]
+		}
+
+		hooks, _ := req.Context().Value(responseHooksKey).(*responseHooks)
+		var response *http.Response
+		if hooks != nil {
+			response = hooks.response
+		}
+
+		start := time.Now()
+		err := runDecider(decider, req, dctx, options)
+		duration := time.Since(start)
+		deciderBody.Close()
+		deciderDuration.WithLabelValues(options.Name).Observe(duration.Seconds())
+		if body, ok := req.Body.(*rewrittenBody); ok {
+			if err == nil && !dryRun {
+				// The decider has mutated the body, so subsequent deciders (and the backend) should see the new one
+				rawBody = body.body
+				rewritten = true
+				dspan.AddEvent("decider.rewrote_body")
+			} else {
+				// Rejections and dry run deciders don't get to change the request, so the rewrite is thrown away
+				req.ContentLength, req.TransferEncoding = contentLength, transferEncoding
+				if lengthHeader != nil {
+					req.Header["Content-Length"] = lengthHeader
+				}
+				dspan.AddEvent("decider.discarded_rewrite")
+			}
+		}
+
+		if hooks != nil && hooks.response != response && (err != nil || dryRun) {
+			// Likewise, rejections and dry run deciders don't get to answer the request with Respond
+			hooks.response = response
+			dspan.AddEvent("decider.discarded_response")
+		}
+
+		if b.Logic == LogicAny {
+			// In any mode, the bouncer's dry run applies to the combined decision rather than to each decider
+			if err != nil && options.DryRun {
+				markBounced(req, bspan, dspan)
+				record(options, DecisionWouldReject, duration, err)
+				logDecision(req, name, options.Name, DecisionWouldReject, err)
+			} else if err != nil {
+				// The rejection counts towards the combined decision, but if the bouncer is in dry run mode, that won't be enforced either
+				decision := DecisionRejected
+				if b.DryRun {
+					decision = DecisionWouldReject
+				}
+				record(options, decision, duration, err)
+				dspan.AddEvent("decider.rejected")
+				rejections = append(rejections, err)
+				rejectedBy = append(rejectedBy, options.Name)
+			} else {
+				record(options, DecisionAccepted, duration, nil)
+				dspan.AddEvent("decider.accepted")
+				if !options.DryRun {
+					return true, nil
+				}
+			}
+
+			return false, nil
+		}
+
 		if err != nil {
-			if b.DryRun {
-				log.Printf("Would have rejected %s %s: %s\n", req.Method, req.URL.RequestURI(), err.Err.Error())
+			markBounced(req, bspan, dspan)
+			if dryRun {
+				record(options, DecisionWouldReject, duration, err)
+				logDecision(req, name, options.Name, DecisionWouldReject, err)
 			} else {
-				log.Printf("Rejected %s %s: %s\n", req.Method, req.URL.RequestURI(), err.Err.Error())
+				record(options, DecisionRejected, duration, err)
+				logDecision(req, name, options.Name, DecisionRejected, err)
 				dspan.AddEvent("decider.rejected")
-				return err
+				return true, err
 			}
 		} else {
+			record(options, DecisionAccepted, duration, nil)
 			dspan.AddEvent("decider.accepted")
 		}
+
+		return false, nil
 	}
 
-	req.Body = ioutil.NopCloser(bytes.NewBuffer(rawBody))
-	return nil
+	for i, decider := range b.Deciders {
+		if decided, err := decide(i, decider); decided {
+			return rawBody, rewritten, results, err
+		}
+	}
+
+	if len(rejections) == 0 {
+		return rawBody, rewritten, results, nil
+	}
+
+	// Every enforcing decider rejected the request, so the bouncer does too
+	err := combineRejections(rejections)
+	markBounced(req, bspan)
+	deciders := strings.Join(rejectedBy, ", ")
+	if b.DryRun {
+		logDecision(req, name, deciders, DecisionWouldReject, err)
+		return rawBody, rewritten, results, nil
+	}
+
+	logDecision(req, name, deciders, DecisionRejected, err)
+	return rawBody, rewritten, results, err
+}
+
+// logDecision logs that the given decider(s) of the bouncer rejected the request (or would have, with a decision of would_reject)
+func logDecision(req *http.Request, bouncer string, decider string, decision Decision, err *HTTPError) {
+	msg := "Rejected request"
+	if decision == DecisionWouldReject {
+		msg = "Would have rejected request"
+	}
+
+	currentLogger().Info(msg,
+		"bouncer", bouncer,
+		"decider", decider,
+		"method", req.Method,
+		"path", req.URL.RequestURI(),
+		"decision", decision,
+		"reason", err.Err.Error(),
+	)
+}
+
+// combineRejections merges the rejections of all the deciders of an any mode bouncer into one error, with the status
+// of the first rejection
+func combineRejections(rejections []*HTTPError) *HTTPError {
+	if len(rejections) == 1 {
+		return rejections[0]
+	}
+
+	reasons := make([]string, len(rejections))
+	header := http.Header{}
+	for i, rejection := range rejections {
+		reasons[i] = rejection.Err.Error()
+		for name, values := range rejection.Header {
+			if _, exists := header[name]; !exists {
+				header[name] = values
+			}
+		}
+	}
+
+	return &HTTPError{
+		Status: rejections[0].Status,
+		Err:    fmt.Errorf("%s", strings.Join(reasons, "; ")),
+		Header: header,
+	}
+}
+
+// LastConfigLoad returns the time that the bouncers on the given proxy were last set, by NewBouncingReverseProxy or SetBouncers,
+// or the zero time if the proxy isn't a BouncingReverseProxy
+func LastConfigLoad(proxy *httputil.ReverseProxy) time.Time {
+	transport, ok := proxy.Transport.(*bouncingTransport)
+	if !ok {
+		return time.Time{}
+	}
+
+	return transport.currentState().loadedAt
 }
 
+// BouncedKey is set as both a baggage member on the request context, and an attribute on the bouncer
+// and decider spans, when a request is rejected (or would have been, in dry run mode). Tail based samplers
+// should keep any trace with a span carrying bouncer.bounced=true, so that bounces can always be found and
+// debugged. For samplers that follow the OpenTracing convention, sampling.priority=1 is set on the spans as well
+const BouncedKey = "bouncer.bounced"
+
+// markBounced attaches the BouncedKey sampling hint to the given request and spans
+func markBounced(req *http.Request, spans ...trace.Span) {
+	for _, span := range spans {
+		span.SetAttributes(attribute.Bool(BouncedKey, true))
+		span.SetAttributes(attribute.Int("sampling.priority", 1))
+	}
+
+	member, err := baggage.NewMember(BouncedKey, "true")
+	if err != nil {
+		return
+	}
+
+	bag, err := baggage.FromContext(req.Context()).SetMember(member)
+	if err != nil {
+		return
+	}
+
+	*req = *req.WithContext(baggage.ContextWithBaggage(req.Context(), bag))
+}
+
+// EvaluationMode controls which of the bouncers that match a request are run. Whatever the mode, the body is only read once,
+// by the first matching bouncer with deciders, and every bouncer after it sees that same body, including any rewrites by earlier bouncers
+type EvaluationMode string
+
+const (
+	// EvaluationUntilRejected runs every matching bouncer in order, stopping at the first one that rejects the request. This is the default
+	EvaluationUntilRejected EvaluationMode = "untilRejected"
+
+	// EvaluationFirstMatch stops at the first matching bouncer that isn't in dry run mode, so its decision is final. Dry run bouncers
+	// before it still run (and log what they would have done), but bouncers after it don't run at all
+	EvaluationFirstMatch EvaluationMode = "firstMatch"
+
+	// EvaluationAllMatch runs every matching bouncer, even after one rejects the request, so that all their decisions are logged and
+	// counted, and then rejects the request with the first rejection, if there was one
+	EvaluationAllMatch EvaluationMode = "allMatch"
+)
+
+// ProxyOptions are the settings of a BouncingReverseProxy that apply to every request going through it. The zero value is the default for each
+type ProxyOptions struct {
+	// MaxBodySize is the largest request body, in bytes, that bouncers will read. Bodies are buffered in memory so that
+	// every decider can read them, so larger ones are rejected with a 413 rather than read. If it's 0, DefaultMaxBodySize is used
+	MaxBodySize int64
+
+	// DecodeGzip makes bouncers decompress request bodies with a `Content-Encoding: gzip`, so that deciders see the plain JSON.
+	// The decompressed body is forwarded to the backend, without the Content-Encoding. It's off by default, so that bodies are passed through untouched
+	DecodeGzip bool
+
+	// ResponseFormat is the format that rejections are written in. If it's empty, they're written in ErrorFormatText
+	ResponseFormat ErrorFormat
+
+	// Evaluation is the mode that the proxy evaluates its bouncers in. If it's empty, it's EvaluationUntilRejected
+	Evaluation EvaluationMode
+
+	// BackendErrorResponse is sent to clients when the backend can't be reached, in the same format as bounced requests, so that
+	// clients get a consistent response. The error from the backend is logged and traced, but isn't sent to the client. If it's nil,
+	// the ReverseProxy's own error handling is used, which is a bare 502 by default
+	BackendErrorResponse *HTTPError
+
+	// DiagnosticHeaders sets X-Bouncer-Name and X-Bouncer-Decider headers on rejections, naming the bouncer and decider(s) that rejected
+	// the request, so that it's easy to see which rule fired when debugging. It's off by default, as it tells clients about the rules
+	DiagnosticHeaders bool
+}
+
+// maxBodySize returns the MaxBodySize, or the DefaultMaxBodySize if it isn't set
+func (o ProxyOptions) maxBodySize() int64 {
+	if o.MaxBodySize <= 0 {
+		return DefaultMaxBodySize
+	}
+
+	return o.MaxBodySize
+}
+
+// bouncingTransport is the transport of a BouncingReverseProxy. It lives as long as the proxy does, and the bouncers and
+// inspector it runs can be swapped while it's serving requests, so they're kept in a transportState that's atomically replaced
 type bouncingTransport struct {
 	backingTransport http.RoundTripper
-	bouncers         []Bouncer
+
+	// state holds a *transportState. Requests load it once, so they see a consistent set of bouncers for their whole round trip
+	state atomic.Value
+
+	// updateLock serializes updates to state, so that concurrent updates of different fields don't lose each other
+	updateLock sync.Mutex
+}
+
+// transportState is the set of bouncers and the inspector a bouncingTransport runs, along with the proxies in front of it and its options.
+// It's never modified once it's stored
+type transportState struct {
+	bouncers       []Bouncer
+	inspector      ResponseInspector
+	trustedProxies []*net.IPNet
+	options        ProxyOptions
+
+	// loadedAt is when the bouncers were last set
+	loadedAt time.Time
+}
+
+type transportStateKeyType struct{}
+
+// transportStateKey holds the *transportState a request is running with in its context, so that deciders can read the proxy's settings
+var transportStateKey = transportStateKeyType{}
+
+// currentState returns the state that requests should currently run with
+func (b *bouncingTransport) currentState() *transportState {
+	return b.state.Load().(*transportState)
+}
+
+// updateState atomically replaces the state with a copy of it, modified by the given function
+func (b *bouncingTransport) updateState(update func(state *transportState)) {
+	b.updateLock.Lock()
+	defer b.updateLock.Unlock()
+
+	state := *b.currentState()
+	update(&state)
+	b.state.Store(&state)
+}
+
+// ResponseInspector is called with every response from the backend, and the request it's a response to, before it's sent
+// on to the client. It can modify the response, e.g. to strip headers the backend shouldn't leak, or just audit it.
+// Inspectors that read the body must replace it, e.g. with ReadResponseBody, so that the client still gets all of it.
+// It isn't called for requests that were bounced, or where the backend couldn't be reached
+type ResponseInspector func(resp *http.Response, req *http.Request)
+
+// SetResponseInspector sets the ResponseInspector on the given proxy, replacing any it already has. A nil inspector removes it
+func SetResponseInspector(inspector ResponseInspector, proxy *httputil.ReverseProxy) error {
+	transport, ok := proxy.Transport.(*bouncingTransport)
+	if !ok {
+		return fmt.Errorf("Given proxy is not a BouncingReverseProxy")
+	}
+
+	transport.updateState(func(state *transportState) {
+		state.inspector = inspector
+	})
+	return nil
+}
+
+// ReadResponseBody reads the whole body of the given response, replacing it with a copy so that it can still be sent to the client
+func ReadResponseBody(resp *http.Response) ([]byte, error) {
+	if resp.Body == nil || resp.Body == http.NoBody {
+		return []byte{}, nil
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	resp.Body = ioutil.NopCloser(bytes.NewReader(body))
+	return body, err
 }
 
 // SetBouncers sets the set of bouncers on the given proxy
 // This allows us to reload a set of bouncers on a running proxy, without
-// restarting the process
+// restarting the process. It's safe to call while the proxy is serving requests:
+// requests that are already in flight finish with the bouncers they started with
 func SetBouncers(bouncers []Bouncer, proxy *httputil.ReverseProxy) error {
-	transport, ok := proxy.Transport.(bouncingTransport)
+	transport, ok := proxy.Transport.(*bouncingTransport)
 	if !ok {
 		return fmt.Errorf("Given proxy is not a BouncingReverseProxy")
 	}
 
-	proxy.Transport = bouncingTransport{
-		backingTransport: transport.backingTransport,
-		bouncers:         bouncers,
+	transport.updateState(func(state *transportState) {
+		state.bouncers = bouncers
+		state.loadedAt = time.Now()
+	})
+
+	return nil
+}
+
+// SetProxyOptions sets the options of the given proxy, replacing all of the ones it already has.
+// Requests that are already in flight finish with the options they started with
+func SetProxyOptions(options ProxyOptions, proxy *httputil.ReverseProxy) error {
+	transport, ok := proxy.Transport.(*bouncingTransport)
+	if !ok {
+		return fmt.Errorf("Given proxy is not a BouncingReverseProxy")
 	}
 
+	transport.updateState(func(state *transportState) {
+		state.options = options
+	})
 	return nil
 }
 
-func (b bouncingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
-	for _, bouncer := range b.bouncers {
-		err := bouncer.Bounce(request)
-		if err != nil {
-			return err.ToResponse(), nil
+// ResponseHook is a function which is called with the response to a request (or the
+// error from the backend, if there was no response). Hooks that read the response body
+// must replace it, so that the client still receives it
+type ResponseHook func(resp *http.Response, err error)
+
+type responseHooksKeyType struct{}
+
+var responseHooksKey = responseHooksKeyType{}
+
+type responseHooks struct {
+	hooks []ResponseHook
+
+	// response is set by Respond, to answer the request without forwarding it to the backend
+	response *http.Response
+}
+
+// OnResponse registers a hook to be called with the response to the given request, once
+// it has been through all the bouncers and (if it wasn't bounced) the backend. This lets deciders
+// which need to know the outcome of a request (e.g. to cache it) observe it. Returns false if
+// the request isn't going through a BouncingReverseProxy, in which case the hook will never be called
+func OnResponse(req *http.Request, hook ResponseHook) bool {
+	hooks, ok := req.Context().Value(responseHooksKey).(*responseHooks)
+	if !ok {
+		return false
+	}
+
+	hooks.hooks = append(hooks.hooks, hook)
+	return true
+}
+
+// Respond makes the proxy answer the given request with the given response, rather than forwarding it to the backend,
+// e.g. to replay a cached response. The response is only sent if none of the bouncers reject the request, and is ignored if the decider
+// that gave it rejects the request or is in dry run mode. Returns false if
+// the request isn't going through a BouncingReverseProxy, in which case the request is forwarded as normal
+func Respond(req *http.Request, resp *http.Response) bool {
+	hooks, ok := req.Context().Value(responseHooksKey).(*responseHooks)
+	if !ok {
+		return false
+	}
+
+	hooks.response = resp
+	return true
+}
+
+func (b *bouncingTransport) RoundTrip(request *http.Request) (*http.Response, error) {
+	ctx, span := johari.NewChildSpan(request.Context(), "bouncing_transport")
+	defer span.End()
+
+	state := b.currentState()
+	hooks := &responseHooks{}
+	ctx = context.WithValue(ctx, transportStateKey, state)
+	request = request.WithContext(context.WithValue(ctx, responseHooksKey, hooks))
+
+	resp, err := b.roundTrip(request, span, state)
+	for _, hook := range hooks.hooks {
+		hook(resp, err)
+	}
+
+	return resp, err
+}
+
+// rejectRequest records that the given bouncer bounced the request on the transport's span, and builds the response to send back.
+// deciders is the names of the deciders that rejected the request, which is empty if it was rejected before any deciders ran
+func rejectRequest(span trace.Span, options ProxyOptions, bouncer Bouncer, deciders string, err *HTTPError) *http.Response {
+	span.SetAttributes(attribute.String("decision", "bounced"))
+	span.SetAttributes(attribute.String("bouncer_name", bouncer.displayName()))
+	resp := err.ToFormattedResponse(options.ResponseFormat)
+	if options.DiagnosticHeaders {
+		resp.Header.Set("X-Bouncer-Name", bouncer.displayName())
+		if deciders != "" {
+			resp.Header.Set("X-Bouncer-Decider", deciders)
+		}
+	}
+
+	return resp
+}
+
+// rejectingDeciders returns the names of the deciders in the given results that rejected the request, comma separated
+func rejectingDeciders(results []DeciderResult) string {
+	var names []string
+	for _, result := range results {
+		if result.Decision == DecisionRejected {
+			names = append(names, result.Name)
+		}
+	}
+
+	return strings.Join(names, ", ")
+}
+
+func (b *bouncingTransport) roundTrip(request *http.Request, span trace.Span, state *transportState) (*http.Response, error) {
+	// The body is only read once the first bouncer that will use it matches, and then shared by the rest,
+	// so that requests which don't match any bouncers are passed through untouched
+	var rawBody []byte
+	bodyRead := false
+	rewritten := false
+	for _, bouncer := range state.bouncers {
+		if bouncer.Bypass && bouncer.Target.Matches(request) {
+			span.SetAttributes(attribute.String("decision", "bypassed"))
+			span.SetAttributes(attribute.String("bouncer_name", bouncer.displayName()))
+			return b.forward(request, span, state)
 		}
 	}
-	return b.backingTransport.RoundTrip(request)
+
+	var rejection *HTTPError
+	var rejectedBy Bouncer
+	var rejectedByDeciders string
+	for _, bouncer := range state.bouncers {
+		if !bouncer.Target.Matches(request) || len(bouncer.Deciders) == 0 {
+			continue
+		}
+
+		if !bodyRead {
+			var err *HTTPError
+			rawBody, rewritten, err = readBody(request, state.options)
+			if err != nil {
+				return rejectRequest(span, state.options, bouncer, "", err), nil
+			}
+			bodyRead = true
+		}
+
+		var bouncerRewrote bool
+		var results []DeciderResult
+		var err *HTTPError
+		rawBody, bouncerRewrote, results, err = bouncer.bounce(request, rawBody)
+		rewritten = rewritten || bouncerRewrote
+		if err != nil && rejection == nil {
+			rejection, rejectedBy, rejectedByDeciders = err, bouncer, rejectingDeciders(results)
+		}
+
+		if rejection != nil && state.options.Evaluation != EvaluationAllMatch {
+			break
+		}
+
+		if state.options.Evaluation == EvaluationFirstMatch && !bouncer.DryRun {
+			break
+		}
+	}
+
+	if bodyRead {
+		reseatBody(request, rawBody, rewritten)
+	}
+
+	if rejection != nil {
+		return rejectRequest(span, state.options, rejectedBy, rejectedByDeciders, rejection), nil
+	}
+
+	if hooks, ok := request.Context().Value(responseHooksKey).(*responseHooks); ok && hooks.response != nil {
+		span.SetAttributes(attribute.String("decision", "responded"))
+		hooks.response.Request = request
+		return hooks.response, nil
+	}
+
+	span.SetAttributes(attribute.String("decision", "passed"))
+	return b.forward(request, span, state)
+}
+
+// forward sends the given request on to the backend, passing the response through the state's inspector, if there is one
+func (b *bouncingTransport) forward(request *http.Request, span trace.Span, state *transportState) (*http.Response, error) {
+	// Inject our span into the forwarded request, so that the backend's trace is connected to ours
+	otel.GetTextMapPropagator().Inject(request.Context(), propagation.HeaderCarrier(request.Header))
+	resp, err := b.backingTransport.RoundTrip(request)
+	if err != nil {
+		span.RecordError(err)
+		if state.options.BackendErrorResponse == nil {
+			return nil, err
+		}
+
+		currentLogger().Error("Failed to reach the backend",
+			"method", request.Method,
+			"path", request.URL.RequestURI(),
+			"error", err.Error(),
+		)
+		return state.options.BackendErrorResponse.ToFormattedResponse(state.options.ResponseFormat), nil
+	}
+
+	if state.inspector != nil {
+		state.inspector(resp, request)
+	}
+
+	return resp, nil
 }
 
 // NewBouncingReverseProxy generates a ReverseProxy instance which runs the given
@@ -215,10 +1516,9 @@ func NewBouncingReverseProxy(backend *url.URL, bouncers []Bouncer, backingTransp
 		backingTransport = http.DefaultTransport
 	}
 	proxy := httputil.NewSingleHostReverseProxy(backend)
-	proxy.Transport = bouncingTransport{
-		backingTransport: backingTransport,
-		bouncers:         bouncers,
-	}
+	transport := &bouncingTransport{backingTransport: backingTransport}
+	transport.state.Store(&transportState{bouncers: bouncers, loadedAt: time.Now()})
+	proxy.Transport = transport
 
 	return proxy
 }
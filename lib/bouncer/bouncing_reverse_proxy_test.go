@@ -2,15 +2,30 @@ package bouncer_test
 
 import (
 	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
+	"log"
 	"net/http"
 	"net/http/httptest"
+	"net/http/httputil"
 	"net/url"
+	"os"
+	"reflect"
 	"regexp"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/baggage"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
 )
 
 func mustMakeRequest(t *testing.T, method string, urlString string, body string) *http.Request {
@@ -90,6 +105,223 @@ func TestParseBouncers(t *testing.T) {
 	}
 }
 
+func TestParseBouncersMethods(t *testing.T) {
+	testCases := []struct {
+		serialized      string
+		expectedMethods []string
+		expectedAny     bool
+	}{
+		{
+			serialized:      `{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: []}]}`,
+			expectedMethods: []string{"POST"},
+		},
+		{
+			serialized:      `{"bouncers": [{"methods": ["POST", "PUT"], "uriRegex":"cats", deciders: []}]}`,
+			expectedMethods: []string{"POST", "PUT"},
+		},
+		{
+			serialized:      `{"bouncers": [{"uriRegex":"cats", deciders: []}]}`,
+			expectedMethods: nil,
+		},
+		{
+			serialized:      `{"bouncers": [{"method": "*", "uriRegex":"cats", deciders: []}]}`,
+			expectedMethods: nil,
+			expectedAny:     true,
+		},
+		{
+			serialized:      `{"bouncers": [{"methods": ["POST", "any"], "uriRegex":"cats", deciders: []}]}`,
+			expectedMethods: nil,
+			expectedAny:     true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		bouncers, err := bouncer.ParseBouncers([]byte(testCase.serialized))
+		if err != nil {
+			t.Errorf("Failed to parse %s: %s", testCase.serialized, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(bouncers[0].Target.Methods, testCase.expectedMethods) {
+			t.Errorf("Expected %s to parse to methods %v, got %v", testCase.serialized, testCase.expectedMethods, bouncers[0].Target.Methods)
+		}
+
+		if bouncers[0].Target.AnyMethod != testCase.expectedAny {
+			t.Errorf("Expected %s to parse to AnyMethod %t", testCase.serialized, testCase.expectedAny)
+		}
+	}
+}
+
+func TestParseBouncersDeciderOptions(t *testing.T) {
+	bouncers, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: [{"name": "SilencesDontExpireOnWeekends", "dryrun": true}, {"name": "normalize_alert_batch", "timeout": "2s", "timeoutStatus": "503"}]}]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse bouncers: %s", err)
+	}
+
+	expected := []bouncer.DeciderOptions{{Name: "SilencesDontExpireOnWeekends", DryRun: true}, {Name: "normalize_alert_batch", DryRun: false, Timeout: 2 * time.Second, TimeoutStatus: 503}}
+	if !reflect.DeepEqual(bouncers[0].DeciderOptions, expected) {
+		t.Errorf("Expected decider options %v, got %v", expected, bouncers[0].DeciderOptions)
+	}
+
+	for _, invalid := range []string{`"timeout": "soon"`, `"timeout": "-1s"`, `"timeout": "1s", "timeoutStatus": "200"`} {
+		if _, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: [{"name": "normalize_alert_batch", ` + invalid + `}]}]}`)); err == nil {
+			t.Errorf("Expected decider options %s to fail to parse", invalid)
+		}
+	}
+}
+
+func TestParseBouncersNames(t *testing.T) {
+	bouncers, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"name": "authors", "method": "POST", "uriRegex":"silences", deciders: []}, {"methods": ["POST", "PUT"], "uriRegex":"alerts", deciders: []}]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse bouncers: %s", err)
+	}
+
+	if bouncers[0].Name != "authors" {
+		t.Errorf("Expected the configured name to be used, got %s", bouncers[0].Name)
+	}
+
+	if bouncers[1].Name != "POST,PUT alerts" {
+		t.Errorf("Expected the name to default to the target, got %s", bouncers[1].Name)
+	}
+}
+
+func TestParseBouncersValueMatchers(t *testing.T) {
+	bouncers, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"uriRegex":"alerts", "queryParams": {"filter": "^team="}, deciders: []}]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse query params: %s", err)
+	}
+
+	req := mustMakeRequest(t, "GET", "http://testendpoint/api/v2/alerts?filter=team%3Dinfra", "")
+	if !bouncers[0].Target.Matches(req) {
+		t.Errorf("Expected the parsed query params to match")
+	}
+
+	if _, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"uriRegex":"alerts", "queryParams": {"filter": "("}, deciders: []}]}`)); err == nil {
+		t.Errorf("Expected an invalid query param regex to fail to parse")
+	}
+
+	if _, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"uriRegex":"alerts", "excludeURIRegex": "(", deciders: []}]}`)); err == nil {
+		t.Errorf("Expected an invalid excludeURIRegex to fail to parse")
+	}
+
+	if _, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"uriRegex":"alerts", "headers": {"Content-Type": "("}, deciders: []}]}`)); err == nil {
+		t.Errorf("Expected an invalid header regex to fail to parse")
+	}
+
+	bouncers, err = bouncer.ParseBouncers([]byte(`{"bouncers": [{"uriRegex":"silences", "contentType": "^application/json", deciders: []}]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse contentType: %s", err)
+	}
+
+	req = mustMakeRequest(t, "POST", "http://testendpoint/api/v2/silences", "")
+	req.Header = http.Header{"Content-Type": []string{"application/json"}}
+	if !bouncers[0].Target.Matches(req) {
+		t.Errorf("Expected the parsed contentType to match")
+	}
+
+	if _, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"uriRegex":"alerts", "contentType": "(", deciders: []}]}`)); err == nil {
+		t.Errorf("Expected an invalid contentType regex to fail to parse")
+	}
+}
+
+func TestParseBouncersURIRegexFlags(t *testing.T) {
+	bouncers, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "*", "uriRegex":"^/api/v2/silences", "excludeURIRegex": "silences/legacy", "uriRegexFlags": "i", deciders: []}]}`))
+	if err != nil {
+		t.Fatalf("Failed to parse bouncers: %s", err)
+	}
+
+	if !bouncers[0].Target.Matches(mustMakeRequest(t, "POST", "http://localhost/API/v2/Silences", "")) {
+		t.Errorf("Expected uriRegexFlags i to make the uriRegex case insensitive")
+	}
+
+	if bouncers[0].Target.Matches(mustMakeRequest(t, "POST", "http://localhost/api/v2/SILENCES/Legacy", "")) {
+		t.Errorf("Expected uriRegexFlags i to make the excludeURIRegex case insensitive")
+	}
+
+	if _, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"uriRegex":"alerts", "uriRegexFlags": "ix", deciders: []}]}`)); err == nil || !strings.Contains(err.Error(), "unknown flag 'x'") {
+		t.Errorf("Expected unknown uriRegexFlags to fail to parse, got %v", err)
+	}
+}
+
+func TestRegisterDecider(t *testing.T) {
+	rejectAll := func(config map[string]string) bouncer.Decider {
+		return func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+			return &bouncer.HTTPError{Status: 403, Err: fmt.Errorf("%s", config["message"])}
+		}
+	}
+
+	if err := bouncer.RegisterDecider("reject_all", []string{"message"}, rejectAll); err != nil {
+		t.Fatalf("Failed to register a decider: %s", err)
+	}
+	defer bouncer.UnregisterDecider("reject_all")
+
+	if err := bouncer.RegisterDecider("reject_all", nil, rejectAll); err == nil {
+		t.Errorf("Expected registering a duplicate decider to fail")
+	}
+
+	if err := bouncer.RegisterDecider("AllSilencesHaveAuthor", nil, rejectAll); err == nil {
+		t.Errorf("Expected registering over a built in decider to fail")
+	}
+
+	bouncers, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: [{"name": "reject_all", "config":{"message":"no"}}]}]}`))
+	if err != nil {
+		t.Fatalf("Expected registered deciders to be parsed, got %s", err)
+	}
+
+	if err := bouncers[0].Deciders[0](mustBuildRequest("", t), context.Background()); err == nil || err.Err.Error() != "no" {
+		t.Errorf("Expected the registered decider to be used, got %v", err)
+	}
+
+	if _, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: [{"name": "reject_all", "config":{}}]}]}`)); err == nil {
+		t.Errorf("Expected the registered decider's required config vars to be checked")
+	}
+
+	rejectOdd := func(config bouncer.DeciderConfig) (bouncer.Decider, error) {
+		if config["message"] == "odd" {
+			return nil, fmt.Errorf("message: odd isn't allowed")
+		}
+
+		return rejectAll(config), nil
+	}
+
+	if err := bouncer.RegisterDeciderTemplate("reject_odd", nil, rejectOdd); err != nil {
+		t.Fatalf("Failed to register a decider template: %s", err)
+	}
+	defer bouncer.UnregisterDecider("reject_odd")
+
+	if _, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: [{"name": "reject_odd", "config":{"message":"odd"}}]}]}`)); err == nil || !strings.Contains(err.Error(), "Invalid config for reject_odd: message: odd isn't allowed") {
+		t.Errorf("Expected the registered template's error to be reported, got %v", err)
+	}
+
+	if _, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: [{"name": "reject_odd", "config":{"message":"even"}}]}]}`)); err != nil {
+		t.Errorf("Expected the registered template to be parsed, got %s", err)
+	}
+
+	bouncer.UnregisterDecider("reject_all")
+	if _, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: [{"name": "reject_all", "config":{"message":"no"}}]}]}`)); err == nil {
+		t.Errorf("Expected unregistered deciders not to be found")
+	}
+}
+
+func TestParseBouncersDeciderStatus(t *testing.T) {
+	bouncers, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: [{"name": "AllSilencesHaveAuthor", "config":{"domain": "@cloudflare.com", "status": "422"}}]}]}`))
+	if err != nil {
+		t.Fatalf("Expected a decider with a status to be parsed, got %s", err)
+	}
+
+	input := `{"comment":"test","createdBy":"colin@quirl.co.nz", "startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z"}`
+	if err := bouncers[0].Deciders[0](mustBuildRequest(input, t), context.Background()); err == nil || err.Status != 422 {
+		t.Errorf("Expected the rejection to have the configured status, got %v", err)
+	}
+
+	for _, status := range []string{"cats", "200", "302", "600"} {
+		_, err := bouncer.ParseBouncers([]byte(fmt.Sprintf(`{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: [{"name": "AllSilencesHaveAuthor", "config":{"domain": "@cloudflare.com", "status": "%s"}}]}]}`, status)))
+		if err == nil || !strings.Contains(err.Error(), "Invalid status") {
+			t.Errorf("Expected a status of %s to fail to parse, got %v", status, err)
+		}
+	}
+}
+
 func TestTargetMatches(t *testing.T) {
 	testCases := []struct {
 		name           string
@@ -100,7 +332,7 @@ func TestTargetMatches(t *testing.T) {
 		{
 			name: "Test method normalization",
 			target: bouncer.Target{
-				Method:   "poST",
+				Methods:  []string{"poST"},
 				URIRegex: regexp.MustCompile("/api/v1/silences"),
 			},
 			request:        mustMakeRequest(t, "POsT", "http://testendpoint/api/v1/silences", ""),
@@ -109,7 +341,7 @@ func TestTargetMatches(t *testing.T) {
 		{
 			name: "Test regexp is applied",
 			target: bouncer.Target{
-				Method:   "POST",
+				Methods:  []string{"POST"},
 				URIRegex: regexp.MustCompile("^/api/v[12]/silences$"),
 			},
 			request:        mustMakeRequest(t, "POST", "http://testendpoint/api/v1/silences", ""),
@@ -118,12 +350,162 @@ func TestTargetMatches(t *testing.T) {
 		{
 			name: "Test doesn't match invalid",
 			target: bouncer.Target{
-				Method:   "POST",
+				Methods:  []string{"POST"},
 				URIRegex: regexp.MustCompile("/api/v/silences"),
 			},
 			request:        mustMakeRequest(t, "POST", "http://testendpoint/api/v1/silences", ""),
 			expectedOutput: false,
 		},
+		{
+			name: "Test any of multiple methods match",
+			target: bouncer.Target{
+				Methods:  []string{"POST", "put", "DELETE"},
+				URIRegex: regexp.MustCompile("/api/v1/silences"),
+			},
+			request:        mustMakeRequest(t, "PUT", "http://testendpoint/api/v1/silences", ""),
+			expectedOutput: true,
+		},
+		{
+			name: "Test unlisted method doesn't match",
+			target: bouncer.Target{
+				Methods:  []string{"POST", "PUT"},
+				URIRegex: regexp.MustCompile("/api/v1/silences"),
+			},
+			request:        mustMakeRequest(t, "GET", "http://testendpoint/api/v1/silences", ""),
+			expectedOutput: false,
+		},
+		{
+			name: "Test wildcard matches every method",
+			target: bouncer.Target{
+				AnyMethod: true,
+				URIRegex:  regexp.MustCompile("/api/v1/silences"),
+			},
+			request:        mustMakeRequest(t, "DELETE", "http://testendpoint/api/v1/silences", ""),
+			expectedOutput: true,
+		},
+		{
+			name: "Test literal star method only matches itself",
+			target: bouncer.Target{
+				Methods:  []string{"POST"},
+				URIRegex: regexp.MustCompile("/api/v1/silences"),
+			},
+			request:        mustMakeRequest(t, "*", "http://testendpoint/api/v1/silences", ""),
+			expectedOutput: false,
+		},
+		{
+			name: "Test query params must match",
+			target: bouncer.Target{
+				URIRegex:    regexp.MustCompile("/api/v2/alerts"),
+				QueryParams: map[string]*regexp.Regexp{"filter": regexp.MustCompile(`^team=`)},
+			},
+			request:        mustMakeRequest(t, "GET", "http://testendpoint/api/v2/alerts?active=true&filter=alertname%3DFoo&filter=team%3Dinfra", ""),
+			expectedOutput: true,
+		},
+		{
+			name: "Test non matching query param doesn't match",
+			target: bouncer.Target{
+				URIRegex:    regexp.MustCompile("/api/v2/alerts"),
+				QueryParams: map[string]*regexp.Regexp{"filter": regexp.MustCompile(`^team=`)},
+			},
+			request:        mustMakeRequest(t, "GET", "http://testendpoint/api/v2/alerts?filter=alertname%3DFoo", ""),
+			expectedOutput: false,
+		},
+		{
+			name: "Test missing query param doesn't match",
+			target: bouncer.Target{
+				URIRegex:    regexp.MustCompile("/api/v2/alerts"),
+				QueryParams: map[string]*regexp.Regexp{"filter": regexp.MustCompile(`.*`)},
+			},
+			request:        mustMakeRequest(t, "GET", "http://testendpoint/api/v2/alerts", ""),
+			expectedOutput: false,
+		},
+		{
+			name: "Test any header value can match",
+			target: bouncer.Target{
+				URIRegex: regexp.MustCompile("/api/v2/alerts"),
+				Headers:  map[string]*regexp.Regexp{"x-forwarded-user": regexp.MustCompile(`^bot-`)},
+			},
+			request: func() *http.Request {
+				req := mustMakeRequest(t, "POST", "http://testendpoint/api/v2/alerts", "")
+				req.Header = http.Header{"X-Forwarded-User": []string{"alice", "bot-ci"}}
+				return req
+			}(),
+			expectedOutput: true,
+		},
+		{
+			name: "Test missing header doesn't match",
+			target: bouncer.Target{
+				URIRegex: regexp.MustCompile("/api/v2/alerts"),
+				Headers:  map[string]*regexp.Regexp{"Content-Type": regexp.MustCompile(`json`)},
+			},
+			request: func() *http.Request {
+				req := mustMakeRequest(t, "POST", "http://testendpoint/api/v2/alerts", "")
+				req.Header = http.Header{}
+				return req
+			}(),
+			expectedOutput: false,
+		},
+		{
+			name: "Test matching content type matches",
+			target: bouncer.Target{
+				URIRegex:    regexp.MustCompile("/api/v2/silences"),
+				ContentType: regexp.MustCompile(`^application/json`),
+			},
+			request: func() *http.Request {
+				req := mustMakeRequest(t, "POST", "http://testendpoint/api/v2/silences", "")
+				req.Header = http.Header{"Content-Type": []string{"application/json; charset=utf-8"}}
+				return req
+			}(),
+			expectedOutput: true,
+		},
+		{
+			name: "Test other content types don't match",
+			target: bouncer.Target{
+				URIRegex:    regexp.MustCompile("/api/v2/silences"),
+				ContentType: regexp.MustCompile(`^application/json`),
+			},
+			request: func() *http.Request {
+				req := mustMakeRequest(t, "POST", "http://testendpoint/api/v2/silences", "")
+				req.Header = http.Header{"Content-Type": []string{"application/x-www-form-urlencoded"}}
+				return req
+			}(),
+			expectedOutput: false,
+		},
+		{
+			name: "Test missing content type doesn't match",
+			target: bouncer.Target{
+				URIRegex:    regexp.MustCompile("/api/v2/silences"),
+				ContentType: regexp.MustCompile(`.*`),
+			},
+			request:        mustMakeRequest(t, "POST", "http://testendpoint/api/v2/silences", ""),
+			expectedOutput: false,
+		},
+		{
+			name: "Test excluded URI doesn't match",
+			target: bouncer.Target{
+				URIRegex:        regexp.MustCompile("^/api/v2/"),
+				ExcludeURIRegex: regexp.MustCompile("^/api/v2/status"),
+			},
+			request:        mustMakeRequest(t, "GET", "http://testendpoint/api/v2/status", ""),
+			expectedOutput: false,
+		},
+		{
+			name: "Test URI outside exclusion matches",
+			target: bouncer.Target{
+				URIRegex:        regexp.MustCompile("^/api/v2/"),
+				ExcludeURIRegex: regexp.MustCompile("^/api/v2/status"),
+			},
+			request:        mustMakeRequest(t, "GET", "http://testendpoint/api/v2/silences", ""),
+			expectedOutput: true,
+		},
+		{
+			name: "Test no methods match everything",
+			target: bouncer.Target{
+				URIRegex: regexp.MustCompile("/api/v1/silences"),
+			},
+			request:        mustMakeRequest(t, "PATCH", "http://testendpoint/api/v1/silences", ""),
+			expectedOutput: true,
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -173,11 +555,11 @@ func TestBouncerBounces(t *testing.T) {
 			bouncers: []bouncer.Bouncer{
 				bouncer.Bouncer{
 					Target: bouncer.Target{
-						Method:   "GET",
+						Methods:  []string{"GET"},
 						URIRegex: regexp.MustCompile(".*"),
 					},
 					Deciders: []bouncer.Decider{
-						func(req *http.Request) *bouncer.HTTPError {
+						func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
 							return &bouncer.HTTPError{
 								Err:    fmt.Errorf("No"),
 								Status: 401,
@@ -196,11 +578,11 @@ func TestBouncerBounces(t *testing.T) {
 			bouncers: []bouncer.Bouncer{
 				bouncer.Bouncer{
 					Target: bouncer.Target{
-						Method:   "GET",
+						Methods:  []string{"GET"},
 						URIRegex: regexp.MustCompile(".*"),
 					},
 					Deciders: []bouncer.Decider{
-						func(req *http.Request) *bouncer.HTTPError {
+						func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
 							return nil
 						},
 					},
@@ -218,11 +600,11 @@ func TestBouncerBounces(t *testing.T) {
 			bouncers: []bouncer.Bouncer{
 				bouncer.Bouncer{
 					Target: bouncer.Target{
-						Method:   "GET",
+						Methods:  []string{"GET"},
 						URIRegex: regexp.MustCompile(".*"),
 					},
 					Deciders: []bouncer.Decider{
-						func(req *http.Request) *bouncer.HTTPError {
+						func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
 							body, err := ioutil.ReadAll(req.Body)
 							if err != nil {
 								return &bouncer.HTTPError{
@@ -241,7 +623,7 @@ func TestBouncerBounces(t *testing.T) {
 
 							return nil
 						},
-						func(req *http.Request) *bouncer.HTTPError {
+						func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
 							body, err := ioutil.ReadAll(req.Body)
 							if err != nil {
 								return &bouncer.HTTPError{
@@ -268,6 +650,85 @@ func TestBouncerBounces(t *testing.T) {
 			expectedStatus: backendStatus,
 			expectedOutput: backendResponse,
 		},
+		{
+			name: "Test Dry Run Decider Accepts",
+			bouncers: []bouncer.Bouncer{
+				bouncer.Bouncer{
+					Target: bouncer.Target{
+						Methods:  []string{"GET"},
+						URIRegex: regexp.MustCompile(".*"),
+					},
+					Deciders: []bouncer.Decider{
+						func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+							return &bouncer.HTTPError{
+								Err:    fmt.Errorf("No"),
+								Status: 401,
+							}
+						},
+					},
+					DeciderOptions: []bouncer.DeciderOptions{{Name: "new_rule", DryRun: true}},
+				},
+			},
+			requestMethod:  "GET",
+			requestBody:    "",
+			expectedStatus: backendStatus,
+			expectedOutput: backendResponse,
+		},
+		{
+			name: "Test Enforcing Decider After Dry Run Decider Rejects",
+			bouncers: []bouncer.Bouncer{
+				bouncer.Bouncer{
+					Target: bouncer.Target{
+						Methods:  []string{"GET"},
+						URIRegex: regexp.MustCompile(".*"),
+					},
+					Deciders: []bouncer.Decider{
+						func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+							return &bouncer.HTTPError{
+								Err:    fmt.Errorf("Dry"),
+								Status: 401,
+							}
+						},
+						func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+							return &bouncer.HTTPError{
+								Err:    fmt.Errorf("Enforced"),
+								Status: 403,
+							}
+						},
+					},
+					DeciderOptions: []bouncer.DeciderOptions{{Name: "new_rule", DryRun: true}},
+				},
+			},
+			requestMethod:  "GET",
+			requestBody:    "",
+			expectedStatus: 403,
+			expectedOutput: "Enforced",
+		},
+		{
+			name: "Test Dry Run Bouncer Overrides Deciders",
+			bouncers: []bouncer.Bouncer{
+				bouncer.Bouncer{
+					Target: bouncer.Target{
+						Methods:  []string{"GET"},
+						URIRegex: regexp.MustCompile(".*"),
+					},
+					Deciders: []bouncer.Decider{
+						func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+							return &bouncer.HTTPError{
+								Err:    fmt.Errorf("No"),
+								Status: 401,
+							}
+						},
+					},
+					DeciderOptions: []bouncer.DeciderOptions{{Name: "old_rule", DryRun: false}},
+					DryRun:         true,
+				},
+			},
+			requestMethod:  "GET",
+			requestBody:    "",
+			expectedStatus: backendStatus,
+			expectedOutput: backendResponse,
+		},
 	}
 
 	for _, testCase := range testCases {
@@ -292,3 +753,1330 @@ func TestBouncerBounces(t *testing.T) {
 		}
 	}
 }
+
+func TestBounceSetsSamplingHint(t *testing.T) {
+	reject := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		return &bouncer.HTTPError{
+			Err:    fmt.Errorf("No"),
+			Status: 401,
+		}
+	}
+
+	accept := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		return nil
+	}
+
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		dryRun          bool
+		logic           bouncer.Logic
+		deciderDryRun   bool
+		expectedBounced bool
+	}{
+		{"Test Accepted Requests Aren't Marked", accept, false, bouncer.LogicAll, false, false},
+		{"Test Rejected Requests Are Marked", reject, false, bouncer.LogicAll, false, true},
+		{"Test Dry Run Rejections Are Marked", reject, true, bouncer.LogicAll, false, true},
+		{"Test Dry Run Decider Rejections Are Marked In Any Mode", reject, false, bouncer.LogicAny, true, true},
+	}
+
+	for _, testCase := range testCases {
+		b := bouncer.Bouncer{
+			Target: bouncer.Target{
+				Methods:  []string{"GET"},
+				URIRegex: regexp.MustCompile(".*"),
+			},
+			Deciders:       []bouncer.Decider{testCase.decider},
+			DeciderOptions: []bouncer.DeciderOptions{{DryRun: testCase.deciderDryRun}},
+			DryRun:         testCase.dryRun,
+			Logic:          testCase.logic,
+		}
+
+		req := mustMakeRequest(t, "GET", "http://localhost/api/v2/silences", "")
+		b.Bounce(req)
+		bounced := baggage.FromContext(req.Context()).Member(bouncer.BouncedKey).Value() == "true"
+		if bounced != testCase.expectedBounced {
+			t.Errorf("Test '%s' failed - expected bounced to be %t, got %t", testCase.name, testCase.expectedBounced, bounced)
+		}
+	}
+}
+
+func TestBounceLimitsBodySize(t *testing.T) {
+	var seen string
+	b := bouncer.Bouncer{
+		Target: bouncer.Target{
+			URIRegex: regexp.MustCompile(".*"),
+		},
+		Deciders: []bouncer.Decider{
+			func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+				body, _ := ioutil.ReadAll(req.Body)
+				seen = string(body)
+				return nil
+			},
+		},
+	}
+
+	var forwarded []byte
+	backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		forwarded, _ = ioutil.ReadAll(req.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})
+
+	backendURL, _ := url.Parse("http://localhost")
+	limited := bouncer.NewBouncingReverseProxy(backendURL, []bouncer.Bouncer{b}, backend)
+	if err := bouncer.SetProxyOptions(bouncer.ProxyOptions{MaxBodySize: 16}, limited); err != nil {
+		t.Fatal(err)
+	}
+
+	send := func(proxy *httputil.ReverseProxy, body string) int {
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, httptest.NewRequest("POST", "http://localhost/api/v2/silences", strings.NewReader(body)))
+		return recorder.Code
+	}
+
+	atLimit := strings.Repeat("a", 16)
+	if code := send(limited, atLimit); code != 200 {
+		t.Fatalf("Expected a body at the limit to pass, got a %d", code)
+	}
+
+	if seen != atLimit || string(forwarded) != atLimit {
+		t.Errorf("Expected a body at the limit to be passed on unchanged, got %q and %q", seen, forwarded)
+	}
+
+	seen = ""
+	if code := send(limited, atLimit+"a"); code != 413 {
+		t.Errorf("Expected a body one byte over the limit to be rejected with a 413, got a %d", code)
+	}
+
+	if seen != "" {
+		t.Errorf("Expected deciders not to see bodies over the limit")
+	}
+
+	// The limit only applies to the proxy it was set on
+	unlimited := bouncer.NewBouncingReverseProxy(backendURL, []bouncer.Bouncer{b}, backend)
+	if code := send(unlimited, atLimit+"a"); code != 200 {
+		t.Errorf("Expected proxies without a MaxBodySize to use the default, got a %d", code)
+	}
+
+	// Outside of a proxy, bodies are limited to the DefaultMaxBodySize
+	oversized := strings.Repeat("a", int(bouncer.DefaultMaxBodySize)+1)
+	if err := b.Bounce(mustBuildRequest(oversized, t)); err == nil || err.Status != 413 {
+		t.Errorf("Expected a body over the default limit to be rejected with a 413, got %v", err)
+	}
+}
+
+// countingBody counts how many times the body of a request is read, so that tests can check when it's read
+type countingBody struct {
+	reader *strings.Reader
+	reads  int
+}
+
+func (c *countingBody) Read(p []byte) (int, error) {
+	c.reads++
+	return c.reader.Read(p)
+}
+
+func (c *countingBody) Close() error {
+	return nil
+}
+
+type roundTripperFunc func(req *http.Request) (*http.Response, error)
+
+func (r roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return r(req)
+}
+
+func TestBounceReadsBodyOnce(t *testing.T) {
+	var seen []string
+	readsBody := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		body, _ := ioutil.ReadAll(req.Body)
+		seen = append(seen, string(body))
+		return nil
+	}
+
+	matching := bouncer.Bouncer{
+		Target: bouncer.Target{
+			Methods:  []string{"POST"},
+			URIRegex: regexp.MustCompile("/api/v2/silences"),
+		},
+		Deciders: []bouncer.Decider{readsBody, readsBody},
+	}
+
+	notMatching := bouncer.Bouncer{
+		Target: bouncer.Target{
+			Methods:  []string{"DELETE"},
+			URIRegex: regexp.MustCompile(".*"),
+		},
+		Deciders: []bouncer.Decider{readsBody},
+	}
+
+	testCases := []struct {
+		name             string
+		bouncers         []bouncer.Bouncer
+		expectedOriginal bool
+		expectedSeen     int
+	}{
+		{"Test Unmatched Requests Pass Through Untouched", []bouncer.Bouncer{notMatching}, true, 0},
+		{"Test Bouncers Without Deciders Pass Through Untouched", []bouncer.Bouncer{{Target: matching.Target}}, true, 0},
+		{"Test Matching Bouncers Share A Single Read", []bouncer.Bouncer{notMatching, matching, matching}, false, 4},
+	}
+
+	for _, testCase := range testCases {
+		seen = nil
+		body := &countingBody{reader: strings.NewReader("{}")}
+		var forwarded []byte
+		var sawOriginal bool
+		readsBeforeBackend := -1
+		backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			readsBeforeBackend = body.reads
+			sawOriginal = req.Body == body
+			forwarded, _ = ioutil.ReadAll(req.Body)
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+			}, nil
+		})
+
+		backendURL, _ := url.Parse("http://localhost")
+		proxy := bouncer.NewBouncingReverseProxy(backendURL, testCase.bouncers, backend)
+		req := httptest.NewRequest("POST", "http://localhost/api/v2/silences", nil)
+		req.Body = body
+		req.ContentLength = 2
+		proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+		if sawOriginal != testCase.expectedOriginal {
+			t.Errorf("Test '%s' failed - expected the backend to get the original body: %t, got %t", testCase.name, testCase.expectedOriginal, sawOriginal)
+		}
+
+		if testCase.expectedOriginal && readsBeforeBackend != 0 {
+			t.Errorf("Test '%s' failed - expected the body not to be read before the backend, but it was read %d times", testCase.name, readsBeforeBackend)
+		}
+
+		if string(forwarded) != "{}" {
+			t.Errorf("Test '%s' failed - expected the backend to get the body, got %q", testCase.name, forwarded)
+		}
+
+		if len(seen) != testCase.expectedSeen {
+			t.Errorf("Test '%s' failed - expected %d deciders to run, got %d", testCase.name, testCase.expectedSeen, len(seen))
+		}
+
+		for _, deciderBody := range seen {
+			if deciderBody != "{}" {
+				t.Errorf("Test '%s' failed - expected every decider to see the body, got %q", testCase.name, deciderBody)
+			}
+		}
+	}
+}
+
+func BenchmarkBounce(b *testing.B) {
+	discardBody := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		io.Copy(ioutil.Discard, req.Body)
+		return nil
+	}
+
+	bouncer := bouncer.Bouncer{
+		Target: bouncer.Target{
+			Methods:  []string{"POST"},
+			URIRegex: regexp.MustCompile("/api/v2/silences"),
+		},
+		Deciders: []bouncer.Decider{discardBody, discardBody, discardBody, discardBody, discardBody, discardBody, discardBody, discardBody},
+	}
+
+	body := strings.Repeat("a", 64<<10)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		req := httptest.NewRequest("POST", "http://localhost/api/v2/silences", strings.NewReader(body))
+		bouncer.Bounce(req)
+	}
+}
+
+// BenchmarkBounceDeciderChain bounces requests through increasingly long chains of deciders. The bytes and allocations
+// per decider should stay flat as the chain grows, as each decider's span and body are cleaned up as soon as it has run
+func BenchmarkBounceDeciderChain(b *testing.B) {
+	accept := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		return nil
+	}
+
+	for _, length := range []int{1, 10, 100, 1000} {
+		deciders := make([]bouncer.Decider, length)
+		for i := range deciders {
+			deciders[i] = accept
+		}
+
+		bouncer := bouncer.Bouncer{
+			Target:   bouncer.Target{URIRegex: regexp.MustCompile("/api/v2/silences")},
+			Deciders: deciders,
+		}
+
+		b.Run(fmt.Sprintf("deciders=%d", length), func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				req := httptest.NewRequest("POST", "http://localhost/api/v2/silences", strings.NewReader("{}"))
+				bouncer.Bounce(req)
+			}
+		})
+	}
+}
+
+func TestHTTPErrorToResponse(t *testing.T) {
+	testCases := []struct {
+		name                string
+		format              bouncer.ErrorFormat
+		expectedBody        string
+		expectedContentType string
+	}{
+		{"Test Text Errors", bouncer.ErrorFormatText, `Silences need an "author"`, "text/plain; charset=utf-8"},
+		{"Test JSON Errors", bouncer.ErrorFormatJSON, `{"status":"error","error":"Silences need an \"author\""}`, "application/json"},
+	}
+
+	for _, testCase := range testCases {
+		err := &bouncer.HTTPError{
+			Status: 403,
+			Err:    fmt.Errorf(`Silences need an "author"`),
+		}
+
+		response := err.ToFormattedResponse(testCase.format)
+		body, _ := ioutil.ReadAll(response.Body)
+		if string(body) != testCase.expectedBody {
+			t.Errorf("Test '%s' failed - expected body %s, got %s", testCase.name, testCase.expectedBody, body)
+		}
+
+		if response.Header.Get("Content-Type") != testCase.expectedContentType {
+			t.Errorf("Test '%s' failed - expected Content-Type %s, got %s", testCase.name, testCase.expectedContentType, response.Header.Get("Content-Type"))
+		}
+
+		if response.ContentLength != int64(len(body)) || response.Header.Get("Content-Length") != fmt.Sprint(len(body)) {
+			t.Errorf("Test '%s' failed - expected a Content-Length of %d, got %d", testCase.name, len(body), response.ContentLength)
+		}
+
+		if response.Status != "403 Forbidden" || response.StatusCode != 403 {
+			t.Errorf("Test '%s' failed - expected a 403 Forbidden, got %s", testCase.name, response.Status)
+		}
+	}
+}
+
+func TestHTTPErrorResponseHeaders(t *testing.T) {
+	err := &bouncer.HTTPError{
+		Status: 429,
+		Err:    fmt.Errorf("Slow down"),
+		Header: http.Header{
+			"Retry-After":  []string{"30"},
+			"Content-Type": []string{"application/xml"},
+		},
+	}
+
+	response := err.ToResponse()
+	if response.Header.Get("Retry-After") != "30" {
+		t.Errorf("Expected the Retry-After header to be copied into the response, got %q", response.Header.Get("Retry-After"))
+	}
+
+	if response.Header.Get("Content-Type") == "application/xml" {
+		t.Errorf("Expected the Content-Type to describe the error body, not be overridden")
+	}
+
+	response.Header.Add("Retry-After", "60")
+	if len(err.Header["Retry-After"]) != 1 {
+		t.Errorf("Expected the response headers to be a copy of the error's")
+	}
+
+	bare := (&bouncer.HTTPError{Status: 403, Err: fmt.Errorf("No")}).ToResponse()
+	if len(bare.Header) != 2 {
+		t.Errorf("Expected errors without headers to only have a Content-Type and Content-Length, got %v", bare.Header)
+	}
+}
+
+func TestBouncerLogic(t *testing.T) {
+	accept := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		return nil
+	}
+
+	rejectWith := func(status int, reason string) bouncer.Decider {
+		return func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+			return &bouncer.HTTPError{Status: status, Err: fmt.Errorf("%s", reason)}
+		}
+	}
+
+	testCases := []struct {
+		name           string
+		logic          bouncer.Logic
+		deciders       []bouncer.Decider
+		options        []bouncer.DeciderOptions
+		dryRun         bool
+		expectedStatus int
+		expectedReason string
+	}{
+		{"Test All Rejects If Any Decider Rejects", bouncer.LogicAll, []bouncer.Decider{accept, rejectWith(403, "a")}, nil, false, 403, "a"},
+		{"Test The Zero Logic Is All", "", []bouncer.Decider{accept, rejectWith(403, "a")}, nil, false, 403, "a"},
+		{"Test Any Accepts If Any Decider Accepts", bouncer.LogicAny, []bouncer.Decider{rejectWith(403, "a"), accept}, nil, false, 0, ""},
+		{"Test Any Rejects If Every Decider Rejects", bouncer.LogicAny, []bouncer.Decider{rejectWith(403, "a"), rejectWith(401, "b")}, nil, false, 403, "a; b"},
+		{"Test Any Ignores Dry Run Deciders", bouncer.LogicAny, []bouncer.Decider{rejectWith(403, "a"), accept}, []bouncer.DeciderOptions{{}, {DryRun: true}}, false, 403, "a"},
+		{"Test Any With Only Dry Run Deciders Accepts", bouncer.LogicAny, []bouncer.Decider{rejectWith(403, "a")}, []bouncer.DeciderOptions{{DryRun: true}}, false, 0, ""},
+		{"Test Any Dry Run Bouncers Don't Reject", bouncer.LogicAny, []bouncer.Decider{rejectWith(403, "a"), rejectWith(403, "b")}, nil, true, 0, ""},
+	}
+
+	for _, testCase := range testCases {
+		b := bouncer.Bouncer{
+			Target:         bouncer.Target{URIRegex: regexp.MustCompile(".*")},
+			Deciders:       testCase.deciders,
+			DeciderOptions: testCase.options,
+			DryRun:         testCase.dryRun,
+			Logic:          testCase.logic,
+		}
+
+		err := b.Bounce(mustBuildRequest("", t))
+		if testCase.expectedStatus == 0 {
+			if err != nil {
+				t.Errorf("Test '%s' failed - expected the request to be accepted, got %s", testCase.name, err.Err)
+			}
+			continue
+		}
+
+		if err == nil || err.Status != testCase.expectedStatus || err.Err.Error() != testCase.expectedReason {
+			t.Errorf("Test '%s' failed - expected a %d (%s), got %v", testCase.name, testCase.expectedStatus, testCase.expectedReason, err)
+		}
+	}
+
+	bouncers, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "POST", "uriRegex":"cats", "logic": "any", deciders: [{"name": "AllSilencesHaveAuthor", "config":{"domain": "@cloudflare.com"}}]}]}`))
+	if err != nil || bouncers[0].Logic != bouncer.LogicAny {
+		t.Errorf("Expected the logic to be parsed, got %v", err)
+	}
+
+	if _, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "POST", "uriRegex":"cats", "logic": "most"}]}`)); err == nil {
+		t.Errorf("Expected an invalid logic to fail to parse")
+	}
+}
+
+func TestValidateBouncersConfig(t *testing.T) {
+	testCases := []struct {
+		name          string
+		config        string
+		expectedError string
+	}{
+		{"Test Valid Configs Pass", `{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: [{"name": "AllSilencesHaveAuthor", "config":{"domain": "@cloudflare.com"}}]}]}`, ""},
+		{"Test Invalid YAML Fails", `{"bouncers": [`, "yaml"},
+		{"Test Invalid Regexes Name The Bouncer", `{"bouncers": [{"method": "POST", "uriRegex":"cats"}, {"name": "broken", "method": "POST", "uriRegex":"("}]}`, "bouncer 1 (broken): Invalid uriRegex"},
+		{"Test Unknown Deciders Name The Decider", `{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: [{"name": "AllSilencesHaveAuthor", "config":{"domain": "@cloudflare.com"}}, {"name": "dogs", "config":{}}]}]}`, "bouncer 0 (POST cats): decider 1 (dogs): No decider template named dogs"},
+		{"Test Missing Config Vars Name The Decider", `{"bouncers": [{"uriRegex":"cats", deciders: [{"name": "max_silence_duration", "config":{}}]}]}`, "bouncer 0 (* cats): decider 0 (max_silence_duration): Expected config variable maxDuration"},
+		{"Test Invalid Config Names The Decider", `{"bouncers": [{"method": "POST", "uriRegex":"cats", deciders: [{"name": "max_silence_duration", "config":{"maxDuration": "forever"}}]}]}`, "decider 0 (max_silence_duration): Invalid config for max_silence_duration: maxDuration: forever is not a positive duration"},
+	}
+
+	for _, testCase := range testCases {
+		err := bouncer.ValidateBouncersConfig([]byte(testCase.config))
+		if testCase.expectedError == "" {
+			if err != nil {
+				t.Errorf("Test '%s' failed - expected the config to be valid, got %s", testCase.name, err)
+			}
+			continue
+		}
+
+		if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+			t.Errorf("Test '%s' failed - expected an error containing %q, got %v", testCase.name, testCase.expectedError, err)
+		}
+	}
+}
+
+func TestParseBouncersReportsEveryError(t *testing.T) {
+	config := `{"bouncers": [
+		{"method": "POST", "uriRegex": "(", "queryParams": {"b": "(", "a": "["}},
+		{"method": "POST", "uriRegex": "cats", "deciders": [{"name": "AllSilencesHaveAuthor", "config": {"domain": "@cloudflare.com"}}]},
+		{"name": "broken", "uriRegex": "cats", "deciders": [{"name": "dogs"}, {"name": "max_silence_duration", "config": {}}]}
+	]}`
+
+	bouncers, err := bouncer.ParseBouncers([]byte(config))
+	if bouncers != nil {
+		t.Errorf("Expected no bouncers to be built from an invalid config")
+	}
+
+	errs, ok := err.(bouncer.ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected ConfigErrors, got %v", err)
+	}
+
+	expected := []string{
+		"bouncer 0 (POST (): Invalid uriRegex",
+		"bouncer 0 (POST (): Invalid regex for query parameter a",
+		"bouncer 0 (POST (): Invalid regex for query parameter b",
+		"bouncer 2 (broken): decider 0 (dogs): No decider template named dogs",
+		"bouncer 2 (broken): decider 1 (max_silence_duration): Expected config variable maxDuration",
+	}
+
+	if len(errs) != len(expected) {
+		t.Fatalf("Expected %d errors, got %d: %s", len(expected), len(errs), err)
+	}
+
+	for i, prefix := range expected {
+		if !strings.HasPrefix(errs[i].Error(), prefix) {
+			t.Errorf("Expected error %d to start with %q, got %q", i, prefix, errs[i])
+		}
+	}
+
+	if !strings.HasPrefix(err.Error(), "5 errors in the bouncers config:\n") {
+		t.Errorf("Expected the combined error to list every error, got %s", err)
+	}
+}
+
+func TestParseBouncersExpandsEnv(t *testing.T) {
+	os.Setenv("BOUNCER_TEST_DOMAIN", "@cloudflare.com")
+	os.Setenv("BOUNCER_TEST_EMPTY", "")
+	defer os.Unsetenv("BOUNCER_TEST_DOMAIN")
+	defer os.Unsetenv("BOUNCER_TEST_EMPTY")
+
+	var seen map[string]string
+	if err := bouncer.RegisterDecider("env_test", nil, func(config map[string]string) bouncer.Decider {
+		seen = config
+		return func(req *http.Request, ctx context.Context) *bouncer.HTTPError { return nil }
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer bouncer.UnregisterDecider("env_test")
+
+	config := `{"bouncers": [{"method": "POST", "uriRegex": "^/api/v2/silences${x}$", deciders: [{"name": "env_test", "config": {
+		"plain": "cats",
+		"domain": "${BOUNCER_TEST_DOMAIN}",
+		"embedded": "https://${BOUNCER_TEST_DOMAIN}/x",
+		"fallback": "${BOUNCER_TEST_MISSING:-dogs}",
+		"emptyFallback": "${BOUNCER_TEST_EMPTY:-dogs}",
+		"empty": "${BOUNCER_TEST_EMPTY}",
+		"escaped": "$${BOUNCER_TEST_DOMAIN}",
+		"regex": "^[A-Z]+-[0-9]+$"
+	}}]}]}`
+
+	bouncers, err := bouncer.ParseBouncers([]byte(config))
+	if err != nil {
+		t.Fatalf("Failed to parse bouncers: %s", err)
+	}
+
+	expected := map[string]string{
+		"plain":         "cats",
+		"domain":        "@cloudflare.com",
+		"embedded":      "https://@cloudflare.com/x",
+		"fallback":      "dogs",
+		"emptyFallback": "dogs",
+		"empty":         "",
+		"escaped":       "${BOUNCER_TEST_DOMAIN}",
+		"regex":         "^[A-Z]+-[0-9]+$",
+	}
+
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Expected the config to be expanded to %v, got %v", expected, seen)
+	}
+
+	if bouncers[0].Target.URIRegex.String() != "^/api/v2/silences${x}$" {
+		t.Errorf("Expected the uriRegex not to be expanded, got %s", bouncers[0].Target.URIRegex)
+	}
+
+	_, err = bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "POST", "uriRegex": "cats", deciders: [{"name": "env_test", "config": {"token": "${BOUNCER_TEST_MISSING}"}}]}]}`))
+	if err == nil || !strings.Contains(err.Error(), "BOUNCER_TEST_MISSING") {
+		t.Errorf("Expected an unset variable to fail to parse, naming the variable, got %v", err)
+	}
+}
+
+func TestBounceInjectsTraceContext(t *testing.T) {
+	defer func(original propagation.TextMapPropagator) { otel.SetTextMapPropagator(original) }(otel.GetTextMapPropagator())
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	traceID, _ := trace.TraceIDFromHex("4bf92f3577b34da6a3ce929d0e0e4736")
+	spanID, _ := trace.SpanIDFromHex("00f067aa0ba902b7")
+	parent := trace.NewSpanContext(trace.SpanContextConfig{
+		TraceID:    traceID,
+		SpanID:     spanID,
+		TraceFlags: trace.FlagsSampled,
+		Remote:     true,
+	})
+
+	var traceparent string
+	backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		traceparent = req.Header.Get("traceparent")
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})
+
+	b := bouncer.Bouncer{
+		Target: bouncer.Target{
+			URIRegex: regexp.MustCompile(".*"),
+		},
+		Deciders: []bouncer.Decider{
+			func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+				return nil
+			},
+		},
+	}
+
+	backendURL, _ := url.Parse("http://localhost")
+	proxy := bouncer.NewBouncingReverseProxy(backendURL, []bouncer.Bouncer{b}, backend)
+	req := httptest.NewRequest("POST", "http://localhost/api/v2/silences", strings.NewReader("{}"))
+	req = req.WithContext(trace.ContextWithRemoteSpanContext(req.Context(), parent))
+	proxy.ServeHTTP(httptest.NewRecorder(), req)
+
+	if traceparent == "" {
+		t.Fatalf("Test 'Bounce Injects Trace Context' failed - expected a traceparent header on the forwarded request, got none")
+	}
+
+	if !strings.Contains(traceparent, traceID.String()) {
+		t.Errorf("Test 'Bounce Injects Trace Context' failed - expected the traceparent to continue trace %s, got %s", traceID, traceparent)
+	}
+}
+
+func TestBouncerEvaluationModes(t *testing.T) {
+	var ran []string
+	var seen []string
+	decider := func(name string, status int) bouncer.Decider {
+		return func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+			ran = append(ran, name)
+			body, _ := ioutil.ReadAll(req.Body)
+			seen = append(seen, string(body))
+			if status != 0 {
+				return &bouncer.HTTPError{Status: status, Err: fmt.Errorf("%s rejected", name)}
+			}
+			return nil
+		}
+	}
+
+	makeBouncer := func(name string, status int, dryRun bool) bouncer.Bouncer {
+		return bouncer.Bouncer{
+			Name:     name,
+			Target:   bouncer.Target{URIRegex: regexp.MustCompile("/api/v2/silences")},
+			Deciders: []bouncer.Decider{decider(name, status)},
+			DryRun:   dryRun,
+		}
+	}
+
+	bouncers := []bouncer.Bouncer{
+		makeBouncer("dry_run", 403, true),
+		{Target: bouncer.Target{URIRegex: regexp.MustCompile("/api/v2/alerts")}, Deciders: []bouncer.Decider{decider("not_matching", 403)}},
+		makeBouncer("accepts", 0, false),
+		makeBouncer("rejects", 403, false),
+		makeBouncer("last", 0, false),
+	}
+
+	testCases := []struct {
+		name           string
+		mode           bouncer.EvaluationMode
+		expectedRan    []string
+		expectedStatus int
+	}{
+		{"Test The Default Stops At The First Rejection", "", []string{"dry_run", "accepts", "rejects"}, 403},
+		{"Test Until Rejected Stops At The First Rejection", bouncer.EvaluationUntilRejected, []string{"dry_run", "accepts", "rejects"}, 403},
+		{"Test First Match Stops At The First Enforcing Bouncer", bouncer.EvaluationFirstMatch, []string{"dry_run", "accepts"}, 200},
+		{"Test All Match Runs Every Bouncer", bouncer.EvaluationAllMatch, []string{"dry_run", "accepts", "rejects", "last"}, 403},
+	}
+
+	for _, testCase := range testCases {
+		ran, seen = nil, nil
+		body := &countingBody{reader: strings.NewReader("{}")}
+		var forwarded []byte
+		backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			forwarded, _ = ioutil.ReadAll(req.Body)
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+			}, nil
+		})
+
+		backendURL, _ := url.Parse("http://localhost")
+		proxy := bouncer.NewBouncingReverseProxy(backendURL, bouncers, backend)
+		if err := bouncer.SetProxyOptions(bouncer.ProxyOptions{Evaluation: testCase.mode}, proxy); err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "http://localhost/api/v2/silences", nil)
+		req.Body = body
+		req.ContentLength = 2
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+
+		if !reflect.DeepEqual(ran, testCase.expectedRan) {
+			t.Errorf("Test '%s' failed - expected %v to run, got %v", testCase.name, testCase.expectedRan, ran)
+		}
+
+		if recorder.Code != testCase.expectedStatus {
+			t.Errorf("Test '%s' failed - expected status %d, got %d", testCase.name, testCase.expectedStatus, recorder.Code)
+		}
+
+		// The body is read once, and every bouncer sees all of it
+		for _, deciderBody := range seen {
+			if deciderBody != "{}" {
+				t.Errorf("Test '%s' failed - expected every decider to see the body, got %q", testCase.name, deciderBody)
+			}
+		}
+
+		if testCase.expectedStatus == 200 && string(forwarded) != "{}" {
+			t.Errorf("Test '%s' failed - expected the backend to get the body, got %q", testCase.name, forwarded)
+		}
+	}
+}
+
+func TestBounceDecodesGzip(t *testing.T) {
+	silence := `{"matchers":[{"name":"alertname","value":"Test","isRegex":false}],"createdBy":"colin","comment":"testing"}`
+	var compressed bytes.Buffer
+	writer := gzip.NewWriter(&compressed)
+	writer.Write([]byte(silence))
+	writer.Close()
+
+	// Rejects requests whose body isn't a silence, so that we can tell whether the decider saw the decompressed body
+	parsesSilence := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		var parsed struct {
+			CreatedBy string `json:"createdBy"`
+		}
+
+		if err := json.NewDecoder(req.Body).Decode(&parsed); err != nil || parsed.CreatedBy != "colin" {
+			return &bouncer.HTTPError{Status: 400, Err: fmt.Errorf("Failed to parse silence")}
+		}
+
+		return nil
+	}
+
+	b := bouncer.Bouncer{
+		Target:   bouncer.Target{URIRegex: regexp.MustCompile("/api/v2/silences")},
+		Deciders: []bouncer.Decider{parsesSilence},
+	}
+
+	testCases := []struct {
+		name           string
+		decodeGzip     bool
+		body           []byte
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Test Gzipped Bodies Are Passed Through By Default", false, compressed.Bytes(), 400, ""},
+		{"Test Gzipped Bodies Are Decoded", true, compressed.Bytes(), 200, silence},
+		{"Test Invalid Gzip Bodies Are Rejected", true, []byte(silence), 400, ""},
+	}
+
+	for _, testCase := range testCases {
+		var forwarded []byte
+		var forwardedLength int64
+		var forwardedEncoding string
+		backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			forwarded, _ = ioutil.ReadAll(req.Body)
+			forwardedLength = req.ContentLength
+			forwardedEncoding = req.Header.Get("Content-Encoding")
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+			}, nil
+		})
+
+		backendURL, _ := url.Parse("http://localhost")
+		proxy := bouncer.NewBouncingReverseProxy(backendURL, []bouncer.Bouncer{b}, backend)
+		if err := bouncer.SetProxyOptions(bouncer.ProxyOptions{DecodeGzip: testCase.decodeGzip}, proxy); err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "http://localhost/api/v2/silences", bytes.NewReader(testCase.body))
+		req.Header.Set("Content-Encoding", "gzip")
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+
+		if recorder.Code != testCase.expectedStatus {
+			t.Errorf("Test '%s' failed - expected status %d, got %d", testCase.name, testCase.expectedStatus, recorder.Code)
+		}
+
+		if testCase.expectedStatus != 200 {
+			continue
+		}
+
+		if string(forwarded) != testCase.expectedBody {
+			t.Errorf("Test '%s' failed - expected the backend to get %q, got %q", testCase.name, testCase.expectedBody, forwarded)
+		}
+
+		if forwardedLength != int64(len(testCase.expectedBody)) {
+			t.Errorf("Test '%s' failed - expected a Content-Length of %d, got %d", testCase.name, len(testCase.expectedBody), forwardedLength)
+		}
+
+		if forwardedEncoding != "" {
+			t.Errorf("Test '%s' failed - expected the Content-Encoding to be stripped, got %q", testCase.name, forwardedEncoding)
+		}
+	}
+}
+
+func TestMutatingDecider(t *testing.T) {
+	// Fills in a default comment, and forces createdBy to the caller
+	setDefaults := bouncer.MutatingDecider(func(req *http.Request, body []byte, ctx context.Context) ([]byte, *bouncer.HTTPError) {
+		var silence map[string]interface{}
+		if err := json.Unmarshal(body, &silence); err != nil {
+			return nil, &bouncer.HTTPError{Status: 400, Err: err}
+		}
+
+		if silence["comment"] == nil {
+			silence["comment"] = "No comment given"
+		}
+		silence["createdBy"] = req.Header.Get("X-User")
+		mutated, _ := json.Marshal(silence)
+		return mutated, nil
+	})
+
+	rejectsAfterMutating := bouncer.MutatingDecider(func(req *http.Request, body []byte, ctx context.Context) ([]byte, *bouncer.HTTPError) {
+		return []byte(`{"discarded":true}`), &bouncer.HTTPError{Status: 403, Err: fmt.Errorf("Rejected")}
+	})
+
+	var seen string
+	recordsBody := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		body, _ := ioutil.ReadAll(req.Body)
+		seen = string(body)
+		return nil
+	}
+
+	testCases := []struct {
+		name              string
+		deciders          []bouncer.Decider
+		options           []bouncer.DeciderOptions
+		dryRun            bool
+		expectedStatus    int
+		expectedSeen      string
+		expectedForwarded string
+	}{
+		{
+			name:              "Test Mutations Are Seen By Later Deciders And Forwarded",
+			deciders:          []bouncer.Decider{setDefaults, recordsBody},
+			expectedStatus:    200,
+			expectedSeen:      `{"comment":"No comment given","createdBy":"colin"}`,
+			expectedForwarded: `{"comment":"No comment given","createdBy":"colin"}`,
+		},
+		{
+			name:              "Test Mutations From Rejecting Deciders Are Discarded",
+			deciders:          []bouncer.Decider{rejectsAfterMutating, setDefaults, recordsBody},
+			options:           []bouncer.DeciderOptions{{DryRun: true}},
+			expectedStatus:    200,
+			expectedSeen:      `{"comment":"No comment given","createdBy":"colin"}`,
+			expectedForwarded: `{"comment":"No comment given","createdBy":"colin"}`,
+		},
+		{
+			name:              "Test Mutations From Dry Run Deciders Are Discarded",
+			deciders:          []bouncer.Decider{setDefaults, recordsBody},
+			options:           []bouncer.DeciderOptions{{DryRun: true}},
+			expectedStatus:    200,
+			expectedSeen:      `{"createdBy":"someone else"}`,
+			expectedForwarded: `{"createdBy":"someone else"}`,
+		},
+		{
+			name:              "Test Mutations From Dry Run Bouncers Are Discarded",
+			deciders:          []bouncer.Decider{setDefaults, recordsBody},
+			dryRun:            true,
+			expectedStatus:    200,
+			expectedSeen:      `{"createdBy":"someone else"}`,
+			expectedForwarded: `{"createdBy":"someone else"}`,
+		},
+		{
+			name:           "Test Rejecting Mutators Reject",
+			deciders:       []bouncer.Decider{setDefaults, rejectsAfterMutating, recordsBody},
+			expectedStatus: 403,
+		},
+	}
+
+	for _, testCase := range testCases {
+		seen = ""
+		var forwarded []byte
+		var forwardedLength int64
+		backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			forwarded, _ = ioutil.ReadAll(req.Body)
+			forwardedLength = req.ContentLength
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+			}, nil
+		})
+
+		b := bouncer.Bouncer{
+			Target:         bouncer.Target{URIRegex: regexp.MustCompile(".*")},
+			Deciders:       testCase.deciders,
+			DeciderOptions: testCase.options,
+			DryRun:         testCase.dryRun,
+		}
+
+		backendURL, _ := url.Parse("http://localhost")
+		proxy := bouncer.NewBouncingReverseProxy(backendURL, []bouncer.Bouncer{b}, backend)
+		req := httptest.NewRequest("POST", "http://localhost/api/v2/silences", strings.NewReader(`{"createdBy":"someone else"}`))
+		req.Header.Set("X-User", "colin")
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+
+		if recorder.Code != testCase.expectedStatus {
+			t.Errorf("Test '%s' failed - expected status %d, got %d", testCase.name, testCase.expectedStatus, recorder.Code)
+			continue
+		}
+
+		if testCase.expectedStatus != 200 {
+			continue
+		}
+
+		if seen != testCase.expectedSeen {
+			t.Errorf("Test '%s' failed - expected later deciders to see %q, got %q", testCase.name, testCase.expectedSeen, seen)
+		}
+
+		if string(forwarded) != testCase.expectedForwarded {
+			t.Errorf("Test '%s' failed - expected the backend to get %q, got %q", testCase.name, testCase.expectedForwarded, forwarded)
+		}
+
+		if forwardedLength != int64(len(testCase.expectedForwarded)) {
+			t.Errorf("Test '%s' failed - expected a Content-Length of %d, got %d", testCase.name, len(testCase.expectedForwarded), forwardedLength)
+		}
+	}
+}
+
+func TestDeciderTimeout(t *testing.T) {
+	// Waits for its context, like a well behaved decider making a slow request would
+	slow := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		select {
+		case <-ctx.Done():
+			return &bouncer.HTTPError{Status: 403, Err: ctx.Err()}
+		case <-time.After(5 * time.Second):
+			return nil
+		}
+	}
+
+	// Ignores its context, so can't be interrupted
+	ignoresContext := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		time.Sleep(50 * time.Millisecond)
+		return nil
+	}
+
+	fast := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		return nil
+	}
+
+	testCases := []struct {
+		name           string
+		decider        bouncer.Decider
+		options        bouncer.DeciderOptions
+		expectedStatus int
+	}{
+		{"Test Slow Deciders Time Out", slow, bouncer.DeciderOptions{Name: "slow", Timeout: 20 * time.Millisecond}, 504},
+		{"Test Timeout Status Is Configurable", slow, bouncer.DeciderOptions{Name: "slow", Timeout: 20 * time.Millisecond, TimeoutStatus: 503}, 503},
+		{"Test Deciders Ignoring Their Context Are Rejected Once They Return", ignoresContext, bouncer.DeciderOptions{Name: "ignores_context", Timeout: 10 * time.Millisecond}, 504},
+		{"Test Fast Deciders Pass", fast, bouncer.DeciderOptions{Name: "fast", Timeout: time.Second}, 0},
+	}
+
+	for _, testCase := range testCases {
+		b := bouncer.Bouncer{
+			Target:         bouncer.Target{URIRegex: regexp.MustCompile(".*")},
+			Deciders:       []bouncer.Decider{testCase.decider},
+			DeciderOptions: []bouncer.DeciderOptions{testCase.options},
+		}
+
+		start := time.Now()
+		err := b.Bounce(mustMakeRequest(t, "POST", "http://localhost/api/v2/silences", "{}"))
+		if time.Since(start) > time.Second {
+			t.Errorf("Test '%s' failed - expected the decider to be bounded by its timeout, but it took %s", testCase.name, time.Since(start))
+		}
+
+		status := 0
+		if err != nil {
+			status = err.Status
+		}
+
+		if status != testCase.expectedStatus {
+			t.Errorf("Test '%s' failed - expected status %d, got %v", testCase.name, testCase.expectedStatus, err)
+		}
+	}
+}
+
+func TestBypass(t *testing.T) {
+	bouncers, err := bouncer.ParseBouncers([]byte(`
+bypass:
+  - method: GET
+    uriRegex: ^/-/healthy$
+  - method: POST
+    uriRegex: ^/api/v2/raw$
+bouncers:
+  - method: "*"
+    uriRegex: .*
+    deciders:
+      - name: AllSilencesHaveAuthor
+        config:
+          domain: quirl.co.nz
+`))
+	if err != nil {
+		t.Fatalf("Failed to parse bouncers: %s", err)
+	}
+
+	payload := "\x00\x1f\x8b not a silence \xff"
+	testCases := []struct {
+		name           string
+		method         string
+		path           string
+		expectedStatus int
+		expectedBypass bool
+	}{
+		{"Test Bypassed POSTs Are Forwarded Untouched", "POST", "/api/v2/raw", 200, true},
+		{"Test Bypass Matches Methods", "GET", "/api/v2/raw", 400, false},
+		{"Test Other Requests Are Still Bounced", "POST", "/api/v2/silences", 400, false},
+	}
+
+	for _, testCase := range testCases {
+		body := &countingBody{reader: strings.NewReader(payload)}
+		var forwarded []byte
+		var sawOriginal bool
+		readsBeforeBackend := -1
+		backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			readsBeforeBackend = body.reads
+			sawOriginal = req.Body == body
+			forwarded, _ = ioutil.ReadAll(req.Body)
+			return &http.Response{
+				StatusCode: 200,
+				Header:     http.Header{},
+				Body:       ioutil.NopCloser(strings.NewReader("")),
+			}, nil
+		})
+
+		backendURL, _ := url.Parse("http://localhost")
+		proxy := bouncer.NewBouncingReverseProxy(backendURL, bouncers, backend)
+		req := httptest.NewRequest(testCase.method, "http://localhost"+testCase.path, nil)
+		req.Body = body
+		req.ContentLength = int64(len(payload))
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, req)
+
+		if recorder.Code != testCase.expectedStatus {
+			t.Errorf("Test '%s' failed - expected status %d, got %d", testCase.name, testCase.expectedStatus, recorder.Code)
+		}
+
+		if !testCase.expectedBypass {
+			continue
+		}
+
+		if !sawOriginal || readsBeforeBackend != 0 {
+			t.Errorf("Test '%s' failed - expected the original body to be forwarded without being read", testCase.name)
+		}
+
+		if string(forwarded) != payload {
+			t.Errorf("Test '%s' failed - expected the backend to get %q, got %q", testCase.name, payload, forwarded)
+		}
+	}
+
+	if _, err := bouncer.ParseBouncers([]byte(`{"bypass": [{"method": "GET", "uriRegex": "healthy", "deciders": [{"name": "normalize_alert_batch"}]}]}`)); err == nil || !strings.Contains(err.Error(), "bypass 0") {
+		t.Errorf("Expected bypass targets with deciders to fail to parse, got %v", err)
+	}
+}
+
+func TestResponseInspector(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Internal-Secret", "hunter2")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`[{"id":"silence"}]`))
+	}))
+	defer backend.Close()
+
+	var inspected []string
+	inspector := func(resp *http.Response, req *http.Request) {
+		resp.Header.Del("X-Internal-Secret")
+		body, err := bouncer.ReadResponseBody(resp)
+		if err != nil {
+			t.Errorf("Failed to read response body: %s", err)
+		}
+		inspected = append(inspected, fmt.Sprintf("%s %s %d %s", req.Method, req.URL.Path, resp.StatusCode, body))
+	}
+
+	rejectsPosts := bouncer.Bouncer{
+		Target: bouncer.Target{Methods: []string{"POST"}, URIRegex: regexp.MustCompile(".*")},
+		Deciders: []bouncer.Decider{
+			func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+				return &bouncer.HTTPError{Status: 403, Err: fmt.Errorf("No posting")}
+			},
+		},
+	}
+
+	backendURL, _ := url.Parse(backend.URL)
+	proxy := bouncer.NewBouncingReverseProxy(backendURL, nil, nil)
+	if err := bouncer.SetResponseInspector(inspector, proxy); err != nil {
+		t.Fatalf("Failed to set the response inspector: %s", err)
+	}
+
+	// Reloading the bouncers should keep the inspector
+	if err := bouncer.SetBouncers([]bouncer.Bouncer{rejectsPosts}, proxy); err != nil {
+		t.Fatalf("Failed to set bouncers: %s", err)
+	}
+
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	resp, err := http.Get(frontend.URL + "/api/v2/silences")
+	if err != nil {
+		t.Fatalf("Failed to make request: %s", err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(body) != `[{"id":"silence"}]` {
+		t.Errorf("Expected the client to get the whole body after it was inspected, got %q", body)
+	}
+
+	if resp.Header.Get("X-Internal-Secret") != "" {
+		t.Errorf("Expected the inspector to be able to strip headers, got %q", resp.Header.Get("X-Internal-Secret"))
+	}
+
+	resp, err = http.Post(frontend.URL+"/api/v2/silences", "application/json", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatalf("Failed to make request: %s", err)
+	}
+	resp.Body.Close()
+
+	expected := []string{`GET /api/v2/silences 200 [{"id":"silence"}]`}
+	if !reflect.DeepEqual(inspected, expected) {
+		t.Errorf("Expected only the responses from the backend to be inspected (%v), got %v", expected, inspected)
+	}
+
+	if err := bouncer.SetResponseInspector(nil, httputil.NewSingleHostReverseProxy(backendURL)); err == nil {
+		t.Errorf("Expected setting an inspector on a plain ReverseProxy to fail")
+	}
+}
+
+func TestBackendErrorResponse(t *testing.T) {
+	failing := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return nil, fmt.Errorf("dial tcp 10.0.0.1:9093: connection refused")
+	})
+
+	testCases := []struct {
+		name           string
+		response       *bouncer.HTTPError
+		format         bouncer.ErrorFormat
+		expectedStatus int
+		expectedBody   string
+	}{
+		{"Test Unconfigured Backend Errors Are A Bare 502", nil, "", 502, ""},
+		{"Test Configured Backend Errors Are Sent", &bouncer.HTTPError{Status: 503, Err: fmt.Errorf("Alertmanager is unavailable, try again later")}, "", 503, "Alertmanager is unavailable, try again later"},
+		{"Test Backend Errors Are In The Response Format", &bouncer.HTTPError{Status: 503, Err: fmt.Errorf("Unavailable")}, bouncer.ErrorFormatJSON, 503, `{"status":"error","error":"Unavailable"}`},
+	}
+
+	for _, testCase := range testCases {
+		backendURL, _ := url.Parse("http://localhost")
+		proxy := bouncer.NewBouncingReverseProxy(backendURL, nil, failing)
+		options := bouncer.ProxyOptions{BackendErrorResponse: testCase.response, ResponseFormat: testCase.format}
+		if err := bouncer.SetProxyOptions(options, proxy); err != nil {
+			t.Fatal(err)
+		}
+
+		proxy.ErrorLog = log.New(ioutil.Discard, "", 0)
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, httptest.NewRequest("GET", "http://localhost/api/v2/silences", nil))
+
+		if recorder.Code != testCase.expectedStatus {
+			t.Errorf("Test '%s' failed - expected status %d, got %d", testCase.name, testCase.expectedStatus, recorder.Code)
+		}
+
+		if recorder.Body.String() != testCase.expectedBody {
+			t.Errorf("Test '%s' failed - expected body %q, got %q", testCase.name, testCase.expectedBody, recorder.Body.String())
+		}
+	}
+}
+
+func TestBounceWithResult(t *testing.T) {
+	accepts := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		return nil
+	}
+
+	rejects := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		return &bouncer.HTTPError{Status: 403, Err: fmt.Errorf("No")}
+	}
+
+	b := bouncer.Bouncer{
+		Target:   bouncer.Target{URIRegex: regexp.MustCompile("/api/v2/silences")},
+		Deciders: []bouncer.Decider{accepts, rejects, rejects, accepts},
+		DeciderOptions: []bouncer.DeciderOptions{
+			{Name: "first"},
+			{Name: "dry_run", DryRun: true},
+			{Name: "enforcing"},
+			{Name: "never_runs"},
+		},
+	}
+
+	err, results := b.BounceWithResult(mustMakeRequest(t, "POST", "http://localhost/api/v2/silences", "{}"))
+	if err == nil || err.Status != 403 {
+		t.Errorf("Expected the request to be rejected with a 403, got %v", err)
+	}
+
+	type summary struct {
+		name     string
+		decision bouncer.Decision
+		rejected bool
+	}
+
+	var summaries []summary
+	for _, result := range results {
+		summaries = append(summaries, summary{result.Name, result.Decision, result.Err != nil})
+		if result.Duration < 0 {
+			t.Errorf("Expected %s to have a duration, got %s", result.Name, result.Duration)
+		}
+	}
+
+	expected := []summary{
+		{"first", bouncer.DecisionAccepted, false},
+		{"dry_run", bouncer.DecisionWouldReject, true},
+		{"enforcing", bouncer.DecisionRejected, true},
+	}
+
+	if !reflect.DeepEqual(summaries, expected) {
+		t.Errorf("Expected results %v, got %v", expected, summaries)
+	}
+
+	if err, results := b.BounceWithResult(mustMakeRequest(t, "POST", "http://localhost/api/v2/alerts", "{}")); err != nil || results != nil {
+		t.Errorf("Expected requests the bouncer doesn't match to have no results, got %v, %v", err, results)
+	}
+}
+
+func TestSetBouncersDuringTraffic(t *testing.T) {
+	bouncer.SetLogger(nil)
+	defer bouncer.SetLogger(nil)
+
+	backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		ioutil.ReadAll(req.Body)
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	})
+
+	rejects := []bouncer.Bouncer{
+		{
+			Target: bouncer.Target{URIRegex: regexp.MustCompile(".*")},
+			Deciders: []bouncer.Decider{
+				func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+					return &bouncer.HTTPError{Status: 403, Err: fmt.Errorf("No silences allowed")}
+				},
+			},
+		},
+	}
+
+	accepts := []bouncer.Bouncer{
+		{
+			Target: bouncer.Target{URIRegex: regexp.MustCompile(".*")},
+			Deciders: []bouncer.Decider{
+				func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+					return nil
+				},
+			},
+		},
+	}
+
+	backendURL, _ := url.Parse("http://localhost:9093")
+	proxy := bouncer.NewBouncingReverseProxy(backendURL, rejects, backend)
+
+	stop := make(chan struct{})
+	var reloads sync.WaitGroup
+	reloads.Add(1)
+	go func() {
+		defer reloads.Done()
+		for i := 0; ; i++ {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+
+			bouncers := rejects
+			if i%2 == 0 {
+				bouncers = accepts
+			}
+
+			if err := bouncer.SetBouncers(bouncers, proxy); err != nil {
+				t.Errorf("Failed to set bouncers: %s", err)
+				return
+			}
+		}
+	}()
+
+	var requests sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			for j := 0; j < 100; j++ {
+				resp, err := proxy.Transport.RoundTrip(httptest.NewRequest("POST", "http://localhost:9093/api/v2/silences", strings.NewReader("{}")))
+				if err != nil {
+					t.Errorf("Unexpected error from the proxy: %s", err)
+					return
+				}
+				resp.Body.Close()
+
+				if resp.StatusCode != 200 && resp.StatusCode != 403 {
+					t.Errorf("Expected the request to be accepted or rejected, got status %d", resp.StatusCode)
+				}
+			}
+		}()
+	}
+
+	requests.Wait()
+	close(stop)
+	reloads.Wait()
+}
+
+func TestDiagnosticHeaders(t *testing.T) {
+	bouncer.SetLogger(nil)
+	defer bouncer.SetLogger(nil)
+
+	backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+			Request:    req,
+		}, nil
+	})
+
+	bouncers := []bouncer.Bouncer{
+		{
+			Name:   "silences",
+			Target: bouncer.Target{Methods: []string{"POST"}, URIRegex: regexp.MustCompile(".*")},
+			Deciders: []bouncer.Decider{
+				func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+					return nil
+				},
+				func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+					return &bouncer.HTTPError{Status: 403, Err: fmt.Errorf("No silences allowed")}
+				},
+			},
+			DeciderOptions: []bouncer.DeciderOptions{{Name: "allow"}, {Name: "deny"}},
+		},
+	}
+
+	backendURL, _ := url.Parse("http://localhost:9093")
+	proxy := bouncer.NewBouncingReverseProxy(backendURL, bouncers, backend)
+
+	testCases := []struct {
+		name             string
+		enabled          bool
+		method           string
+		expectedBouncer  string
+		expectedDeciders string
+	}{
+		{"Test Headers Are Off By Default", false, "POST", "", ""},
+		{"Test Rejections Name The Bouncer And Decider", true, "POST", "silences", "deny"},
+		{"Test Accepted Requests Don't Get Headers", true, "GET", "", ""},
+	}
+
+	for _, testCase := range testCases {
+		if err := bouncer.SetProxyOptions(bouncer.ProxyOptions{DiagnosticHeaders: testCase.enabled}, proxy); err != nil {
+			t.Fatal(err)
+		}
+
+		resp, err := proxy.Transport.RoundTrip(httptest.NewRequest(testCase.method, "http://localhost:9093/api/v2/silences", strings.NewReader("{}")))
+		if err != nil {
+			t.Errorf("Test '%s' failed - unexpected error: %s", testCase.name, err)
+			continue
+		}
+		resp.Body.Close()
+
+		if resp.Header.Get("X-Bouncer-Name") != testCase.expectedBouncer {
+			t.Errorf("Test '%s' failed - expected X-Bouncer-Name %q, got %q", testCase.name, testCase.expectedBouncer, resp.Header.Get("X-Bouncer-Name"))
+		}
+
+		if resp.Header.Get("X-Bouncer-Decider") != testCase.expectedDeciders {
+			t.Errorf("Test '%s' failed - expected X-Bouncer-Decider %q, got %q", testCase.name, testCase.expectedDeciders, resp.Header.Get("X-Bouncer-Decider"))
+		}
+	}
+}
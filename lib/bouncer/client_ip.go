@@ -0,0 +1,75 @@
+package bouncer
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+)
+
+// SetTrustedProxies sets the networks of the proxies in front of the given proxy (e.g. a load balancer), whose X-Forwarded-For
+// entries are believed when working out the IP of the client with ClientIP. If there are none, the client is always the peer
+func SetTrustedProxies(trustedProxies []*net.IPNet, proxy *httputil.ReverseProxy) error {
+	transport, ok := proxy.Transport.(*bouncingTransport)
+	if !ok {
+		return fmt.Errorf("Given proxy is not a BouncingReverseProxy")
+	}
+
+	transport.updateState(func(state *transportState) {
+		state.trustedProxies = trustedProxies
+	})
+	return nil
+}
+
+// TrustedProxies returns the trusted proxies of the BouncingReverseProxy the given request is going through, to pass to ClientIP.
+// Returns nil if the request isn't going through a BouncingReverseProxy
+func TrustedProxies(req *http.Request) []*net.IPNet {
+	state, ok := req.Context().Value(transportStateKey).(*transportState)
+	if !ok {
+		return nil
+	}
+
+	return state.trustedProxies
+}
+
+// ClientIP returns the IP of the client that sent the given request. X-Forwarded-For is walked right to left from the RemoteAddr,
+// skipping over hops in the trustedProxies, so clients can't spoof their IP by sending their own X-Forwarded-For. Requests without
+// the header (i.e. that didn't come through a proxy) are from the RemoteAddr. Returns nil if an address that would need to be
+// believed can't be parsed, so that deciders can refuse requests they can't attribute, rather than attributing them to a proxy
+func ClientIP(req *http.Request, trustedProxies []*net.IPNet) net.IP {
+	return forwardedClientIP(req, "X-Forwarded-For", trustedProxies)
+}
+
+// remoteIP returns the IP of the peer that sent the given request, without its port
+func remoteIP(req *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		host = req.RemoteAddr
+	}
+
+	return net.ParseIP(host)
+}
+
+// forwardedClientIP returns the IP of the client that sent the given request, according to the given X-Forwarded-For style
+// header. Each proxy appends the address it got the request from, so the chain (ending with the RemoteAddr) is walked from the
+// right, skipping over trusted proxies, and the first untrusted address is the client. Addresses to the left of that could
+// have been made up by the client, so aren't believed
+func forwardedClientIP(req *http.Request, header string, trustedProxies []*net.IPNet) net.IP {
+	var chain []string
+	for _, value := range req.Header[http.CanonicalHeaderKey(header)] {
+		for _, entry := range strings.Split(value, ",") {
+			// Blank entries (e.g. an empty header) don't claim any address, so they aren't hops
+			if entry = strings.TrimSpace(entry); entry != "" {
+				chain = append(chain, entry)
+			}
+		}
+	}
+
+	ip := remoteIP(req)
+	for i := len(chain) - 1; i >= 0 && ip != nil && ipInNetworks(ip, trustedProxies); i-- {
+		ip = net.ParseIP(chain[i])
+	}
+
+	return ip
+}
@@ -0,0 +1,124 @@
+package bouncer_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"regexp"
+	"testing"
+
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+func TestClientIP(t *testing.T) {
+	trusted := []*net.IPNet{}
+	for _, cidr := range []string{"10.0.0.0/8", "fd00::/8"} {
+		_, network, _ := net.ParseCIDR(cidr)
+		trusted = append(trusted, network)
+	}
+
+	testCases := []struct {
+		name           string
+		trustedProxies []*net.IPNet
+		remoteAddr     string
+		forwardedFor   []string
+		expectedIP     string
+	}{
+		{"Test RemoteAddr Is Used Without A Header", trusted, "192.0.2.10:5000", nil, "192.0.2.10"},
+		{"Test IPv6 RemoteAddr Is Used Without A Header", trusted, "[2001:db8::1]:5000", nil, "2001:db8::1"},
+		{"Test Header Is Ignored Without Trusted Proxies", nil, "10.0.0.1:5000", []string{"192.0.2.10"}, "10.0.0.1"},
+		{"Test Header Is Ignored From Untrusted Peers", trusted, "198.51.100.1:5000", []string{"192.0.2.10"}, "198.51.100.1"},
+		{"Test Forwarded Client Is Used From Trusted Peers", trusted, "10.0.0.1:5000", []string{"192.0.2.10"}, "192.0.2.10"},
+		{"Test IPv6 Clients And Proxies", trusted, "[fd00::1]:5000", []string{"2001:db8::1, fd00::2"}, "2001:db8::1"},
+		{"Test Multiple Entries Skip Trusted Hops", trusted, "10.0.0.1:5000", []string{"203.0.113.1, 192.0.2.10, 10.0.0.2", "10.0.0.3"}, "192.0.2.10"},
+		{"Test Spoofed Entries Left Of The Client Are Ignored", trusted, "10.0.0.1:5000", []string{"192.0.2.10, 198.51.100.1"}, "198.51.100.1"},
+		{"Test All Trusted Hops Use The Leftmost", trusted, "10.0.0.1:5000", []string{"10.0.0.3, 10.0.0.2"}, "10.0.0.3"},
+		{"Test Empty Header Uses The RemoteAddr", trusted, "10.0.0.1:5000", []string{""}, "10.0.0.1"},
+		{"Test Blank Entries Are Skipped", trusted, "10.0.0.1:5000", []string{"192.0.2.10, , 10.0.0.2"}, "192.0.2.10"},
+		{"Test Garbage Header Is Unknown", trusted, "10.0.0.1:5000", []string{"cats"}, "<nil>"},
+		{"Test Garbage Left Of The Client Is Ignored", trusted, "10.0.0.1:5000", []string{"cats, 192.0.2.10"}, "192.0.2.10"},
+		{"Test Garbage RemoteAddr Is Unknown", trusted, "cats", nil, "<nil>"},
+	}
+
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("GET", "http://localhost/api/v2/silences", nil)
+		req.RemoteAddr = testCase.remoteAddr
+		for _, value := range testCase.forwardedFor {
+			req.Header.Add("X-Forwarded-For", value)
+		}
+
+		if ip := bouncer.ClientIP(req, testCase.trustedProxies); ip.String() != testCase.expectedIP {
+			t.Errorf("Test '%s' failed - expected %s, got %s", testCase.name, testCase.expectedIP, ip)
+		}
+	}
+}
+
+func TestTrustedProxiesArePerProxy(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	var seen string
+	bouncers := []bouncer.Bouncer{
+		{
+			Target: bouncer.Target{URIRegex: regexp.MustCompile(".*")},
+			Deciders: []bouncer.Decider{
+				func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+					seen = bouncer.ClientIP(req, bouncer.TrustedProxies(req)).String()
+					return nil
+				},
+			},
+		},
+	}
+
+	trusting := bouncer.NewBouncingReverseProxy(backendURL, bouncers, nil)
+	if err := bouncer.SetTrustedProxies([]*net.IPNet{loopback}, trusting); err != nil {
+		t.Fatalf("Failed to set the trusted proxies: %s", err)
+	}
+
+	// Reloading the bouncers shouldn't lose the trusted proxies
+	if err := bouncer.SetBouncers(bouncers, trusting); err != nil {
+		t.Fatalf("Failed to set the bouncers: %s", err)
+	}
+
+	untrusting := bouncer.NewBouncingReverseProxy(backendURL, bouncers, nil)
+	testCases := []struct {
+		name       string
+		proxy      *httputil.ReverseProxy
+		expectedIP string
+	}{
+		{"Test Trusting Proxy Uses The Forwarded Client", trusting, "192.0.2.10"},
+		{"Test Other Proxies Use The Peer", untrusting, "127.0.0.1"},
+	}
+
+	for _, testCase := range testCases {
+		frontend := httptest.NewServer(testCase.proxy)
+		request := mustMakeRequest(t, "GET", frontend.URL+"/api/v2/silences", "")
+		request.Header = http.Header{"X-Forwarded-For": []string{"192.0.2.10"}}
+		response, err := frontend.Client().Do(request)
+		frontend.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		response.Body.Close()
+
+		if seen != testCase.expectedIP {
+			t.Errorf("Test '%s' failed - expected %s, got %s", testCase.name, testCase.expectedIP, seen)
+		}
+	}
+
+	if proxies := bouncer.TrustedProxies(httptest.NewRequest("GET", "http://localhost/api/v2/silences", nil)); proxies != nil {
+		t.Errorf("Expected requests outside a proxy to have no trusted proxies, got %v", proxies)
+	}
+
+	if err := bouncer.SetTrustedProxies(nil, httputil.NewSingleHostReverseProxy(backendURL)); err == nil {
+		t.Errorf("Expected setting the trusted proxies of a plain ReverseProxy to fail")
+	}
+}
@@ -0,0 +1,93 @@
+package bouncer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v2"
+)
+
+// ParseBouncersFromFile loads the bouncers in the YAML config file at the given path, like ParseBouncers. The file can also
+// include other files, with a top level `include` listing paths or globs (e.g. `teams/*.yaml`), whose bouncers are added after
+// its own. Relative includes are resolved against the directory of the file including them. Files including each other are an
+// error, as are bouncers in different files with the same name. A file that's included more than once is only loaded once
+func ParseBouncersFromFile(path string) ([]Bouncer, error) {
+	loader := configLoader{
+		loaded: map[string]bool{},
+	}
+
+	if err := loader.load(path); err != nil {
+		return nil, err
+	}
+
+	return parseSourcedBouncers(loader.bouncers)
+}
+
+// configLoader loads the bouncers from a config file, and everything it includes
+type configLoader struct {
+	// stack is the chain of files currently being loaded, to detect cycles
+	stack    []string
+	loaded   map[string]bool
+	bouncers []sourcedBouncer
+}
+
+func (c *configLoader) load(path string) error {
+	absolute, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	for i, loading := range c.stack {
+		if loading == absolute {
+			cycle := append(append([]string{}, c.stack[i:]...), absolute)
+			return fmt.Errorf("include cycle: %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	if c.loaded[absolute] {
+		return nil
+	}
+
+	bytes, err := ioutil.ReadFile(absolute)
+	if err != nil {
+		return err
+	}
+
+	var file bouncersFile
+	if err := yaml.Unmarshal(bytes, &file); err != nil {
+		return fmt.Errorf("%s: %s", path, err)
+	}
+
+	c.loaded[absolute] = true
+	c.stack = append(c.stack, absolute)
+	defer func() { c.stack = c.stack[:len(c.stack)-1] }()
+
+	c.bouncers = append(c.bouncers, file.sourcedBouncers(path)...)
+
+	for _, include := range file.Include {
+		pattern := include
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(absolute), pattern)
+		}
+
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			return fmt.Errorf("%s: invalid include %s: %s", path, include, err)
+		}
+
+		// A glob matching nothing is fine (e.g. a directory of team configs with no teams yet), but a missing file is a mistake
+		if len(matches) == 0 && !strings.ContainsAny(include, "*?[") {
+			return fmt.Errorf("%s: included file %s doesn't exist", path, include)
+		}
+
+		for _, match := range matches {
+			if err := c.load(match); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
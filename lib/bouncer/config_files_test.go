@@ -0,0 +1,91 @@
+package bouncer_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+// writeConfigFiles writes the given files, keyed by their path relative to a new temporary directory, returning the directory
+func writeConfigFiles(t *testing.T, files map[string]string) string {
+	dir, err := ioutil.TempDir("", "bouncer")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, contents := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := ioutil.WriteFile(path, []byte(contents), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestParseBouncersFromFile(t *testing.T) {
+	dir := writeConfigFiles(t, map[string]string{
+		"bouncers.yaml":        "include: [teams/*.yaml, shared.yaml]\nbouncers:\n  - name: main\n    uriRegex: main\n",
+		"teams/a.yaml":         "include: [../shared.yaml]\nbouncers:\n  - name: team_a\n    uriRegex: a\n",
+		"teams/b.yaml":         "bouncers:\n  - name: team_b\n    uriRegex: b\n",
+		"shared.yaml":          "bouncers:\n  - name: shared\n    uriRegex: shared\n",
+		"cycle/a.yaml":         "include: [b.yaml]\n",
+		"cycle/b.yaml":         "include: [a.yaml]\n",
+		"duplicate/main.yaml":  "include: [other.yaml]\nbouncers:\n  - name: same\n    uriRegex: a\n",
+		"duplicate/other.yaml": "bouncers:\n  - name: same\n    uriRegex: b\n",
+		"missing.yaml":         "include: [nope.yaml]\n",
+		"empty_glob.yaml":      "include: [nope/*.yaml]\nbouncers:\n  - uriRegex: a\n",
+		"broken/main.yaml":     "include: [other.yaml]\n",
+		"broken/other.yaml":    "bouncers:\n  - uriRegex: a\n  - uriRegex: (\n",
+	})
+	defer os.RemoveAll(dir)
+
+	bouncers, err := bouncer.ParseBouncersFromFile(filepath.Join(dir, "bouncers.yaml"))
+	if err != nil {
+		t.Fatalf("Failed to parse bouncers: %s", err)
+	}
+
+	var names []string
+	for _, b := range bouncers {
+		names = append(names, b.Name)
+	}
+
+	// Included files are loaded once, even though shared.yaml is included twice
+	if strings.Join(names, ",") != "main,team_a,shared,team_b" {
+		t.Errorf("Expected the bouncers from every file in order, got %v", names)
+	}
+
+	testCases := []struct {
+		name          string
+		file          string
+		expectedError string
+	}{
+		{"Test Cycles Fail", "cycle/a.yaml", "include cycle"},
+		{"Test Duplicate Names Fail", "duplicate/main.yaml", "the name same is already used"},
+		{"Test Missing Includes Fail", "missing.yaml", "nope.yaml doesn't exist"},
+		{"Test Errors Name The File", "broken/main.yaml", "other.yaml: bouncer 1"},
+	}
+
+	for _, testCase := range testCases {
+		_, err := bouncer.ParseBouncersFromFile(filepath.Join(dir, testCase.file))
+		if err == nil || !strings.Contains(err.Error(), testCase.expectedError) {
+			t.Errorf("Test '%s' failed - expected an error containing %q, got %v", testCase.name, testCase.expectedError, err)
+		}
+	}
+
+	if _, err := bouncer.ParseBouncersFromFile(filepath.Join(dir, "empty_glob.yaml")); err != nil {
+		t.Errorf("Expected globs matching nothing to be ignored, got %s", err)
+	}
+
+	if _, err := bouncer.ParseBouncers([]byte("include: [a.yaml]\n")); err == nil {
+		t.Errorf("Expected includes to be rejected without a file to resolve them against")
+	}
+}
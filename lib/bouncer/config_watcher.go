@@ -0,0 +1,53 @@
+package bouncer
+
+import (
+	"net/http/httputil"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+)
+
+// WatchConfig reloads the bouncers on the given proxy from the config file at path whenever the process gets a SIGHUP.
+// If the file can't be read or parsed, the error is logged and the proxy keeps its current bouncers, so a bad reload
+// never takes down a running proxy. Returns a function that stops watching, which waits for any reload in progress to finish
+func WatchConfig(path string, proxy *httputil.ReverseProxy) func() {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	done := make(chan struct{})
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			case <-signals:
+				currentLogger().Info("Received a SIGHUP. Reloading bouncers", "path", path)
+				bouncers, err := ParseBouncersFromFile(path)
+				if err != nil {
+					currentLogger().Error("Failed to parse bouncers. Aborting reload", "path", path, "error", err.Error())
+					continue
+				}
+
+				if err := SetBouncers(bouncers, proxy); err != nil {
+					currentLogger().Error("Failed to reload bouncers", "path", path, "error", err.Error())
+					continue
+				}
+
+				currentLogger().Info("Reloaded bouncers", "path", path, "bouncers", len(bouncers))
+			}
+		}
+	}()
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			signal.Stop(signals)
+			close(done)
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,84 @@
+package bouncer_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+// waitForConfigLoad waits for the bouncers on the given proxy to be (re)loaded after the given time, failing the test if they aren't
+func waitForConfigLoad(t *testing.T, proxy *httputil.ReverseProxy, after time.Time) {
+	deadline := time.Now().Add(5 * time.Second)
+	for !bouncer.LastConfigLoad(proxy).After(after) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the bouncers to be reloaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestWatchConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bouncer")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bouncers.yaml")
+	if err := ioutil.WriteFile(path, []byte(`{"bouncers": [{"method": "GET", "uriRegex": ".*", "deciders": [{"name": "require_token", "config": {"tokens": "secret"}}]}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer backend.Close()
+	backendURL, _ := url.Parse(backend.URL)
+	proxy := bouncer.NewBouncingReverseProxy(backendURL, nil, nil)
+
+	status := func() int {
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, httptest.NewRequest("GET", "http://localhost/api/v2/silences", nil))
+		return recorder.Code
+	}
+
+	if code := status(); code != 200 {
+		t.Fatalf("Expected requests to pass before the reload, got a %d", code)
+	}
+
+	stop := bouncer.WatchConfig(path, proxy)
+	defer stop()
+
+	before := bouncer.LastConfigLoad(proxy)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	waitForConfigLoad(t, proxy, before)
+	if code := status(); code != 401 {
+		t.Errorf("Expected the reloaded bouncers to reject requests, got a %d", code)
+	}
+
+	// A broken config should leave the running bouncers alone
+	if err := ioutil.WriteFile(path, []byte(`{"bouncers": [{"method": "GET", "uriRegex": "(", "deciders": []}]}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	before = bouncer.LastConfigLoad(proxy)
+	syscall.Kill(os.Getpid(), syscall.SIGHUP)
+	time.Sleep(100 * time.Millisecond)
+	if bouncer.LastConfigLoad(proxy) != before {
+		t.Errorf("Expected a broken config not to be loaded")
+	}
+
+	if code := status(); code != 401 {
+		t.Errorf("Expected the old bouncers to keep running after a bad reload, got a %d", code)
+	}
+
+	stop()
+	stop()
+}
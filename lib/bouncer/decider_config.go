@@ -0,0 +1,122 @@
+package bouncer
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DeciderConfig is the config of a decider, as given to its template. Values are always strings, but they can be written in the
+// YAML as numbers, bools, or lists of them, which are joined with commas for the config variables that take comma separated lists.
+// The Get methods parse values into the types the decider expects, so that templates can validate them (at parse time)
+// without each doing their own parsing. DeciderTemplates are given one, and deciders registered with RegisterDecider, which take a
+// map[string]string, can convert theirs with DeciderConfig(config)
+type DeciderConfig map[string]string
+
+// UnmarshalYAML flattens the values of a decider's config into strings, so that existing string only configs keep loading as they did
+func (c *DeciderConfig) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw map[string]interface{}
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+
+	config := make(DeciderConfig, len(raw))
+	for key, value := range raw {
+		if list, ok := value.([]interface{}); ok {
+			items := make([]string, len(list))
+			for i, item := range list {
+				flattened, err := flattenConfigValue(item)
+				if err != nil {
+					return fmt.Errorf("Invalid value for %s: %s", key, err)
+				}
+				items[i] = flattened
+			}
+
+			config[key] = strings.Join(items, ",")
+			continue
+		}
+
+		flattened, err := flattenConfigValue(value)
+		if err != nil {
+			return fmt.Errorf("Invalid value for %s: %s", key, err)
+		}
+		config[key] = flattened
+	}
+
+	*c = config
+	return nil
+}
+
+// flattenConfigValue converts a single YAML scalar into the string a decider would have been given for it
+func flattenConfigValue(value interface{}) (string, error) {
+	switch value := value.(type) {
+	case nil:
+		return "", nil
+	case string:
+		return value, nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case int:
+		return strconv.Itoa(value), nil
+	case int64:
+		return strconv.FormatInt(value, 10), nil
+	case uint64:
+		return strconv.FormatUint(value, 10), nil
+	case float64:
+		return strconv.FormatFloat(value, 'f', -1, 64), nil
+	default:
+		return "", fmt.Errorf("expected a string, number, bool, or a list of them, got %T", value)
+	}
+}
+
+// GetString returns the value of the given config variable, or the given default if it isn't set
+func (c DeciderConfig) GetString(key string, def string) string {
+	if value, ok := c[key]; ok && value != "" {
+		return value
+	}
+
+	return def
+}
+
+// GetDuration parses the given config variable as a duration, like `5m`, returning the given default if it isn't set
+func (c DeciderConfig) GetDuration(key string, def time.Duration) (time.Duration, error) {
+	if c[key] == "" {
+		return def, nil
+	}
+
+	return time.ParseDuration(c[key])
+}
+
+// GetInt parses the given config variable as an integer, returning the given default if it isn't set
+func (c DeciderConfig) GetInt(key string, def int) (int, error) {
+	if c[key] == "" {
+		return def, nil
+	}
+
+	value, err := strconv.Atoi(c[key])
+	if err != nil {
+		return 0, fmt.Errorf("%s is not an integer", c[key])
+	}
+
+	return value, nil
+}
+
+// GetBool parses the given config variable as a bool, like `true` or `false`, returning the given default if it isn't set
+func (c DeciderConfig) GetBool(key string, def bool) (bool, error) {
+	if c[key] == "" {
+		return def, nil
+	}
+
+	value, err := strconv.ParseBool(c[key])
+	if err != nil {
+		return false, fmt.Errorf("%s is not true or false", c[key])
+	}
+
+	return value, nil
+}
+
+// GetStringSlice parses the given config variable as a comma separated list (or a YAML list), ignoring empty items
+func (c DeciderConfig) GetStringSlice(key string) []string {
+	return parseConfigList(c[key])
+}
@@ -0,0 +1,113 @@
+package bouncer_test
+
+import (
+	"context"
+	"net/http"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+func TestDeciderConfigYAML(t *testing.T) {
+	var seen map[string]string
+	if err := bouncer.RegisterDecider("typed_config_test", nil, func(config map[string]string) bouncer.Decider {
+		seen = config
+		return func(req *http.Request, ctx context.Context) *bouncer.HTTPError { return nil }
+	}); err != nil {
+		t.Fatal(err)
+	}
+	defer bouncer.UnregisterDecider("typed_config_test")
+
+	config := `
+bouncers:
+  - method: POST
+    uriRegex: cats
+    deciders:
+      - name: typed_config_test
+        config:
+          string: cats
+          int: 5
+          float: 0.5
+          bool: true
+          duration: 5m
+          list: [192.0.2.0/24, 10.0.0.0/8]
+          numbers:
+            - 1
+            - 2
+          empty:
+`
+
+	if _, err := bouncer.ParseBouncers([]byte(config)); err != nil {
+		t.Fatalf("Failed to parse bouncers: %s", err)
+	}
+
+	expected := map[string]string{
+		"string":   "cats",
+		"int":      "5",
+		"float":    "0.5",
+		"bool":     "true",
+		"duration": "5m",
+		"list":     "192.0.2.0/24,10.0.0.0/8",
+		"numbers":  "1,2",
+		"empty":    "",
+	}
+
+	if !reflect.DeepEqual(seen, expected) {
+		t.Errorf("Expected the config to be flattened to %v, got %v", expected, seen)
+	}
+
+	_, err := bouncer.ParseBouncers([]byte(`{"bouncers": [{"method": "POST", "uriRegex": "cats", "deciders": [{"name": "typed_config_test", "config": {"nested": {"a": "b"}}}]}]}`))
+	if err == nil || !strings.Contains(err.Error(), "nested") {
+		t.Errorf("Expected nested config values to fail to parse, got %v", err)
+	}
+}
+
+func TestDeciderConfigGetters(t *testing.T) {
+	config := bouncer.DeciderConfig{
+		"duration": "5m",
+		"int":      "5",
+		"bool":     "false",
+		"list":     "a, b,,c",
+		"bad":      "cats",
+		"unset":    "",
+	}
+
+	if value := config.GetString("unset", "default"); value != "default" {
+		t.Errorf("Expected unset strings to get the default, got %s", value)
+	}
+
+	if value, err := config.GetDuration("duration", time.Second); err != nil || value != 5*time.Minute {
+		t.Errorf("Expected a duration of 5m, got %s (%v)", value, err)
+	}
+
+	if value, err := config.GetDuration("missing", time.Second); err != nil || value != time.Second {
+		t.Errorf("Expected missing durations to get the default, got %s (%v)", value, err)
+	}
+
+	if value, err := config.GetInt("int", 0); err != nil || value != 5 {
+		t.Errorf("Expected an int of 5, got %d (%v)", value, err)
+	}
+
+	if value, err := config.GetBool("bool", true); err != nil || value {
+		t.Errorf("Expected a bool of false, got %t (%v)", value, err)
+	}
+
+	if value := config.GetStringSlice("list"); !reflect.DeepEqual(value, []string{"a", "b", "c"}) {
+		t.Errorf("Expected a list of a, b, c, got %v", value)
+	}
+
+	if _, err := config.GetDuration("bad", 0); err == nil {
+		t.Errorf("Expected an invalid duration to fail")
+	}
+
+	if _, err := config.GetInt("bad", 0); err == nil {
+		t.Errorf("Expected an invalid int to fail")
+	}
+
+	if _, err := config.GetBool("bad", false); err == nil {
+		t.Errorf("Expected an invalid bool to fail")
+	}
+}
@@ -0,0 +1,20 @@
+package bouncer
+
+import (
+	"net/http/httputil"
+	"time"
+)
+
+// SetClock overrides the current time seen by deciders that care about the time of day, returning a func which restores it
+func SetClock(now func() time.Time) func() {
+	original := clock
+	clock = now
+	return func() { clock = original }
+}
+
+// SetConfigLoaded overrides when the bouncers on the given BouncingReverseProxy were last set
+func SetConfigLoaded(at time.Time, proxy *httputil.ReverseProxy) {
+	proxy.Transport.(*bouncingTransport).updateState(func(state *transportState) {
+		state.loadedAt = at
+	})
+}
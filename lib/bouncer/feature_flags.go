@@ -0,0 +1,256 @@
+package bouncer
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FlagSource is somewhere that feature flags can be looked up, e.g. a feature flag service
+type FlagSource interface {
+	// FlagEnabled returns whether the given flag is currently on
+	FlagEnabled(ctx context.Context, flag string) (bool, error)
+}
+
+// flagSources maps the names of flag sources, as used in feature_flag_gate's "source", to
+// functions constructing them from the decider's config
+var flagSources = map[string]func(config map[string]string) (FlagSource, error){
+	"http": newHTTPFlagSource,
+}
+
+// flagSourcesLock guards flagSources, which are read whenever bouncers are parsed, e.g. by the config watcher
+var flagSourcesLock sync.Mutex
+
+// RegisterFlagSource makes a FlagSource available to feature_flag_gate deciders under the given name.
+// The factory is given the feature_flag_gate's config, so sources can take their own config variables.
+// Returns an error if a source with the name already exists, so that sources can't clobber each other
+func RegisterFlagSource(name string, factory func(config map[string]string) (FlagSource, error)) error {
+	flagSourcesLock.Lock()
+	defer flagSourcesLock.Unlock()
+
+	if _, exists := flagSources[name]; exists {
+		return fmt.Errorf("A flag source named %s is already registered", name)
+	}
+
+	flagSources[name] = factory
+	return nil
+}
+
+// UnregisterFlagSource removes a flag source registered with RegisterFlagSource, e.g. to clean up after tests
+func UnregisterFlagSource(name string) {
+	flagSourcesLock.Lock()
+	defer flagSourcesLock.Unlock()
+
+	delete(flagSources, name)
+}
+
+// lookupFlagSource returns the factory of the flag source with the given name, if there is one
+func lookupFlagSource(name string) (func(config map[string]string) (FlagSource, error), bool) {
+	flagSourcesLock.Lock()
+	defer flagSourcesLock.Unlock()
+
+	factory, ok := flagSources[name]
+	return factory, ok
+}
+
+// httpFlagSource looks up flags with a GET to "<flagURL>/<flag>", which should return
+// a JSON object like `{"enabled": true}`
+type httpFlagSource struct {
+	flagURL string
+	timeout time.Duration
+}
+
+func newHTTPFlagSource(config map[string]string) (FlagSource, error) {
+	if config["flagURL"] == "" {
+		return nil, fmt.Errorf("flagURL is required for the http source")
+	}
+
+	timeout := 5 * time.Second
+	if config["timeout"] != "" {
+		parsed, err := time.ParseDuration(config["timeout"])
+		if err != nil {
+			return nil, fmt.Errorf("invalid timeout: %s", err)
+		}
+		timeout = parsed
+	}
+
+	return &httpFlagSource{
+		flagURL: config["flagURL"],
+		timeout: timeout,
+	}, nil
+}
+
+func (h *httpFlagSource) FlagEnabled(ctx context.Context, flag string) (bool, error) {
+	var response struct {
+		Enabled *bool `json:"enabled"`
+	}
+
+	status, err := fetchAlertmanager(ctx, h.flagURL, "/"+flag, h.timeout, &response)
+	if err != nil {
+		return false, err
+	}
+
+	if status < 200 || status > 299 {
+		return false, fmt.Errorf("Flag service returned a %d for %s", status, flag)
+	}
+
+	if response.Enabled == nil {
+		return false, fmt.Errorf("Flag service didn't return a state for %s", flag)
+	}
+
+	return *response.Enabled, nil
+}
+
+// cachedFlag caches the state of a flag, only going back to the source once the state is older than the pollInterval
+type cachedFlag struct {
+	lock         sync.Mutex
+	source       FlagSource
+	flag         string
+	pollInterval time.Duration
+	timeout      time.Duration
+	known        bool
+	enabled      bool
+	// fetchedAt is when the source was last asked, whether or not it answered
+	fetchedAt time.Time
+	inFlight  *flagFetch
+}
+
+// flagFetch is a lookup of the flag in its source, shared by every request that's waiting on it
+type flagFetch struct {
+	done chan struct{}
+}
+
+// get returns the state of the flag, and whether it is known. If the source can't be reached, the last
+// known state (if any) keeps being returned until the next poll, rather than every request waiting on the source
+// while it's down. The source is queried outside the lock, with its own timeout rather than the request's context,
+// so that one slow or cancelled request doesn't hold up or fail the lookup for the others
+func (c *cachedFlag) get(now time.Time) (bool, bool) {
+	c.lock.Lock()
+	if !c.fetchedAt.IsZero() && now.Sub(c.fetchedAt) < c.pollInterval {
+		defer c.lock.Unlock()
+		return c.enabled, c.known
+	}
+
+	if call := c.inFlight; call != nil {
+		c.lock.Unlock()
+		<-call.done
+		return c.cached()
+	}
+
+	call := &flagFetch{done: make(chan struct{})}
+	c.inFlight = call
+	c.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
+	enabled, err := c.source.FlagEnabled(ctx, c.flag)
+	cancel()
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err != nil {
+		currentLogger().Warn("Failed to look up feature flag", "decider", "feature_flag_gate", "flag", c.flag, "error", err.Error())
+	} else {
+		c.known = true
+		c.enabled = enabled
+	}
+	c.fetchedAt = now
+	c.inFlight = nil
+	close(call.done)
+	return c.enabled, c.known
+}
+
+// cached returns the last known state of the flag, and whether it is known
+func (c *cachedFlag) cached() (bool, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.enabled, c.known
+}
+
+// FeatureFlagGateDecider returns a Decider which only enforces a child decider while a feature flag is on, accepting
+// every request while it's off, so that rules can be toggled centrally. The child is the decider named by "decider", configured
+// with every config variable prefixed with "decider." (with the prefix removed), e.g. `decider.domain` for an AllSilencesHaveAuthor child.
+// The "flag" is looked up in the "source" (default http, which GETs `<flagURL>/<flag>` and expects `{"enabled": <bool>}`), and its
+// state is cached for the "pollInterval" (default 30s). Lookups time out after the "timeout" (default 5s), whichever source is used. If
+// the source can't be reached, the last known state is used until the next poll. If the state has never been known, "onError" decides:
+// "enforce" (the default) enforces the child, and "skip" accepts the request
+func FeatureFlagGateDecider(config map[string]string) Decider {
+	return deciderOrNil("feature_flag_gate", newFeatureFlagGateDecider, config)
+}
+
+func newFeatureFlagGateDecider(config DeciderConfig) (Decider, error) {
+	if config["flag"] == "" {
+		return nil, fmt.Errorf("flag: a flag name is required")
+	}
+
+	sourceName := config["source"]
+	if sourceName == "" {
+		sourceName = "http"
+	}
+
+	factory, ok := lookupFlagSource(sourceName)
+	if !ok {
+		return nil, fmt.Errorf("source: no flag source named %s", sourceName)
+	}
+
+	source, err := factory(config)
+	if err != nil {
+		return nil, fmt.Errorf("source: %s", err)
+	}
+
+	pollInterval := 30 * time.Second
+	if config["pollInterval"] != "" {
+		pollInterval, err = time.ParseDuration(config["pollInterval"])
+		if err != nil {
+			return nil, fmt.Errorf("pollInterval: %s", err)
+		}
+	}
+
+	timeout, err := config.GetDuration("timeout", 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("timeout: %s", err)
+	}
+
+	onError := config["onError"]
+	if onError == "" {
+		onError = "enforce"
+	}
+
+	if onError != "enforce" && onError != "skip" {
+		return nil, fmt.Errorf("onError: %s is not one of enforce or skip", onError)
+	}
+
+	childConfig := map[string]string{}
+	for key, value := range config {
+		if strings.HasPrefix(key, "decider.") {
+			childConfig[strings.TrimPrefix(key, "decider.")] = value
+		}
+	}
+
+	child, err := buildDecider(config["decider"], childConfig)
+	if err != nil {
+		return nil, fmt.Errorf("decider: %s", err)
+	}
+
+	flag := &cachedFlag{
+		source:       source,
+		flag:         config["flag"],
+		pollInterval: pollInterval,
+		timeout:      timeout,
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		enabled, known := flag.get(time.Now())
+		if !known {
+			enabled = onError == "enforce"
+		}
+
+		if !enabled {
+			return nil
+		}
+
+		return child(req, context)
+	}, nil
+}
@@ -0,0 +1,208 @@
+package bouncer_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+func TestFeatureFlagGateDecider(t *testing.T) {
+	var enabled int32
+	var lookups int32
+	flagService := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&lookups, 1)
+		if r.URL.Path != "/strict_authors" {
+			w.WriteHeader(404)
+			return
+		}
+
+		if atomic.LoadInt32(&enabled) == 1 {
+			w.Write([]byte(`{"enabled": true}`))
+		} else {
+			w.Write([]byte(`{"enabled": false}`))
+		}
+	}))
+	defer flagService.Close()
+
+	config := map[string]string{
+		"flag":           "strict_authors",
+		"flagURL":        flagService.URL,
+		"pollInterval":   "0s",
+		"decider":        "AllSilencesHaveAuthor",
+		"decider.domain": "example.com",
+	}
+
+	decider := bouncer.FeatureFlagGateDecider(config)
+	input := `{"createdBy":"someone@example.org","startsAt":"2020-01-21T00:23:55.242Z","endsAt":"2020-01-21T01:23:55.242Z","matchers":[]}`
+	if err := decider(mustBuildRequest(input, t), context.Background()); err != nil {
+		t.Errorf("Expected the child decider not to be enforced while the flag is off, got %s", err.Err)
+	}
+
+	atomic.StoreInt32(&enabled, 1)
+	if err := decider(mustBuildRequest(input, t), context.Background()); err == nil {
+		t.Errorf("Expected the child decider to be enforced while the flag is on")
+	}
+
+	// The cached state is used while it's fresh
+	config["pollInterval"] = "1h"
+	cached := bouncer.FeatureFlagGateDecider(config)
+	cached(mustBuildRequest(input, t), context.Background())
+	before := atomic.LoadInt32(&lookups)
+	cached(mustBuildRequest(input, t), context.Background())
+	if atomic.LoadInt32(&lookups) != before {
+		t.Errorf("Expected the flag state to be cached for the pollInterval")
+	}
+
+	// Before the flag has ever been looked up, onError decides
+	for onError, expectedSuccess := range map[string]bool{"enforce": false, "skip": true} {
+		decider := bouncer.FeatureFlagGateDecider(map[string]string{
+			"flag":           "unknown_flag",
+			"flagURL":        flagService.URL,
+			"onError":        onError,
+			"decider":        "AllSilencesHaveAuthor",
+			"decider.domain": "example.com",
+		})
+
+		if err := decider(mustBuildRequest(input, t), context.Background()); (err == nil) != expectedSuccess {
+			t.Errorf("Expected success %t with onError %s when the flag service fails", expectedSuccess, onError)
+		}
+	}
+
+	invalidConfigs := []map[string]string{
+		{"flag": "a", "flagURL": flagService.URL, "decider": "NotADecider"},
+		{"flag": "a", "flagURL": flagService.URL, "decider": "AllSilencesHaveAuthor"},
+		{"flag": "a", "decider": "SilencesDontExpireOnWeekends"},
+		{"flag": "a", "flagURL": flagService.URL, "source": "nope", "decider": "SilencesDontExpireOnWeekends"},
+		{"flag": "", "flagURL": flagService.URL, "decider": "SilencesDontExpireOnWeekends"},
+		{"flag": "a", "flagURL": flagService.URL, "timeout": "cats", "decider": "SilencesDontExpireOnWeekends"},
+	}
+
+	for _, config := range invalidConfigs {
+		if bouncer.FeatureFlagGateDecider(config) != nil {
+			t.Errorf("Expected %v to fail to construct a decider", config)
+		}
+	}
+}
+
+// blockingFlagSource is a FlagSource whose lookups wait until it's released, recording whether they were given a live context
+type blockingFlagSource struct {
+	lookups  int32
+	canceled int32
+	release  chan struct{}
+}
+
+func (b *blockingFlagSource) FlagEnabled(ctx context.Context, flag string) (bool, error) {
+	atomic.AddInt32(&b.lookups, 1)
+	<-b.release
+	if _, hasDeadline := ctx.Deadline(); ctx.Err() != nil || !hasDeadline {
+		atomic.AddInt32(&b.canceled, 1)
+	}
+
+	return true, nil
+}
+
+func TestFeatureFlagGateSharesLookups(t *testing.T) {
+	source := &blockingFlagSource{release: make(chan struct{})}
+	factory := func(config map[string]string) (bouncer.FlagSource, error) {
+		return source, nil
+	}
+
+	if err := bouncer.RegisterFlagSource("blocking_test", factory); err != nil {
+		t.Fatalf("Failed to register a flag source: %s", err)
+	}
+	defer bouncer.UnregisterFlagSource("blocking_test")
+
+	if err := bouncer.RegisterFlagSource("blocking_test", factory); err == nil {
+		t.Errorf("Expected registering a duplicate flag source to fail")
+	}
+
+	if err := bouncer.RegisterFlagSource("http", factory); err == nil {
+		t.Errorf("Expected registering over a built in flag source to fail")
+	}
+
+	decider := bouncer.FeatureFlagGateDecider(map[string]string{
+		"flag":           "strict_authors",
+		"source":         "blocking_test",
+		"pollInterval":   "1h",
+		"decider":        "AllSilencesHaveAuthor",
+		"decider.domain": "example.com",
+	})
+
+	// Requests that give up while the flag is being looked up shouldn't fail the lookup for everyone else
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	input := `{"createdBy":"someone@example.org","startsAt":"2020-01-21T00:23:55.242Z","endsAt":"2020-01-21T01:23:55.242Z","matchers":[]}`
+	var rejected int32
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if decider(mustBuildRequest(input, t), ctx) != nil {
+				atomic.AddInt32(&rejected, 1)
+			}
+		}()
+	}
+
+	time.Sleep(50 * time.Millisecond)
+	close(source.release)
+	wg.Wait()
+
+	if lookups := atomic.LoadInt32(&source.lookups); lookups != 1 {
+		t.Errorf("Expected concurrent requests to share one lookup, got %d", lookups)
+	}
+
+	if atomic.LoadInt32(&source.canceled) != 0 {
+		t.Errorf("Expected the lookup to have its own timeout, rather than the request's context")
+	}
+
+	if rejected != 10 {
+		t.Errorf("Expected every request to see the flag as on, but only %d were rejected", rejected)
+	}
+}
+
+// failingFlagSource is a FlagSource that can never be reached
+type failingFlagSource struct {
+	lookups int32
+}
+
+func (f *failingFlagSource) FlagEnabled(ctx context.Context, flag string) (bool, error) {
+	atomic.AddInt32(&f.lookups, 1)
+	return false, fmt.Errorf("unreachable")
+}
+
+func TestFeatureFlagGateCachesFailures(t *testing.T) {
+	source := &failingFlagSource{}
+	if err := bouncer.RegisterFlagSource("failing_test", func(config map[string]string) (bouncer.FlagSource, error) {
+		return source, nil
+	}); err != nil {
+		t.Fatalf("Failed to register a flag source: %s", err)
+	}
+	defer bouncer.UnregisterFlagSource("failing_test")
+
+	decider := bouncer.FeatureFlagGateDecider(map[string]string{
+		"flag":         "strict_authors",
+		"source":       "failing_test",
+		"pollInterval": "1h",
+		"onError":      "skip",
+		"decider":      "SilencesDontExpireOnWeekends",
+	})
+
+	for i := 0; i < 5; i++ {
+		if err := decider(mustBuildRequest("", t), context.Background()); err != nil {
+			t.Errorf("Expected onError skip to accept the request, got %s", err.Err)
+		}
+	}
+
+	if lookups := atomic.LoadInt32(&source.lookups); lookups != 1 {
+		t.Errorf("Expected the failed lookup to be cached until the next poll, but the source was asked %d times", lookups)
+	}
+}
@@ -0,0 +1,228 @@
+package bouncer
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// idempotencyEntry is the state of a single idempotency key. Entries are inFlight from
+// when the first request with the key is accepted, until its response comes back
+type idempotencyEntry struct {
+	key      string
+	inFlight bool
+	status   int
+	header   http.Header
+	body     []byte
+	expires  time.Time
+	element  *list.Element
+}
+
+// idempotencyCache is a size bounded cache of responses, keyed by idempotency key.
+// Entries expire after the ttl, and once there are more than maxEntries the oldest
+// are evicted, regardless of whether they have expired
+type idempotencyCache struct {
+	lock       sync.Mutex
+	ttl        time.Duration
+	maxEntries int
+	entries    map[string]*idempotencyEntry
+	order      *list.List
+}
+
+func newIdempotencyCache(ttl time.Duration, maxEntries int) *idempotencyCache {
+	return &idempotencyCache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		entries:    map[string]*idempotencyEntry{},
+		order:      list.New(),
+	}
+}
+
+// reserve returns the existing entry for the given key, if there is an unexpired one.
+// Otherwise it creates a new inFlight one and returns nil
+func (c *idempotencyCache) reserve(key string, now time.Time) *idempotencyEntry {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry, ok := c.entries[key]; ok {
+		if now.Before(entry.expires) {
+			// Return a copy so that the caller can read it without holding the lock
+			existing := *entry
+			return &existing
+		}
+
+		c.remove(entry)
+	}
+
+	entry := &idempotencyEntry{
+		key:      key,
+		inFlight: true,
+		expires:  now.Add(c.ttl),
+	}
+	entry.element = c.order.PushBack(entry)
+	c.entries[key] = entry
+
+	for c.order.Len() > c.maxEntries {
+		c.remove(c.order.Front().Value.(*idempotencyEntry))
+	}
+
+	return nil
+}
+
+// complete stores the response for the given inFlight key
+func (c *idempotencyCache) complete(key string, status int, header http.Header, body []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry, ok := c.entries[key]; ok && entry.inFlight {
+		entry.inFlight = false
+		entry.status = status
+		entry.header = header
+		entry.body = body
+	}
+}
+
+// release forgets the given inFlight key, so that it can be retried
+func (c *idempotencyCache) release(key string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if entry, ok := c.entries[key]; ok && entry.inFlight {
+		c.remove(entry)
+	}
+}
+
+// response builds a copy of the cached response to the given request, so that it can be replayed
+func (e *idempotencyEntry) response(req *http.Request) *http.Response {
+	header := e.header.Clone()
+	header.Set("Content-Length", strconv.Itoa(len(e.body)))
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", e.status, http.StatusText(e.status)),
+		StatusCode:    e.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        header,
+		ContentLength: int64(len(e.body)),
+		Body:          ioutil.NopCloser(bytes.NewReader(e.body)),
+		Request:       req,
+	}
+}
+
+// remove deletes the given entry. The lock must be held
+func (c *idempotencyCache) remove(entry *idempotencyEntry) {
+	c.order.Remove(entry.element)
+	delete(c.entries, entry.key)
+}
+
+// IdempotentReplayDecider returns a Decider which makes requests carrying an idempotency key (in the "header", default
+// Idempotency-Key) safe to retry. The first request with a given key is let through, and if the backend responds with a 2xx,
+// that response's status, headers and body (if it is at most "maxResponseSize", default 64KiB) is cached for the "ttl" (default 24h).
+// Repeats of the key within the ttl are answered with a replay of the cached response, without reaching the backend, and repeats while
+// the first is still in flight are rejected with a 409. Keys whose first request fails are forgotten so they can be retried.
+// At most "maxEntries" (default 10000) keys are kept, with the oldest evicted first. Keys are scoped to the method and path, and to the
+// caller, so that one caller can't get another's responses by reusing their key. The caller is the user in the "identityHeader" (default
+// X-Forwarded-User), or the client IP (from ClientIP, with the proxy's TrustedProxies) if there isn't one
+func IdempotentReplayDecider(config map[string]string) Decider {
+	return deciderOrNil("idempotent_replay", newIdempotentReplayDecider, config)
+}
+
+func newIdempotentReplayDecider(config DeciderConfig) (Decider, error) {
+	header := config.GetString("header", "Idempotency-Key")
+	identityHeader := config.GetString("identityHeader", "X-Forwarded-User")
+
+	ttl := 24 * time.Hour
+	if config["ttl"] != "" {
+		parsed, err := time.ParseDuration(config["ttl"])
+		if err != nil {
+			return nil, fmt.Errorf("ttl: %s", err)
+		}
+		ttl = parsed
+	}
+
+	maxEntries := 10000
+	if config["maxEntries"] != "" {
+		parsed, err := strconv.Atoi(config["maxEntries"])
+		if err != nil || parsed <= 0 {
+			return nil, fmt.Errorf("maxEntries: %s is not a positive integer", config["maxEntries"])
+		}
+		maxEntries = parsed
+	}
+
+	maxResponseSize := int64(64 << 10)
+	if config["maxResponseSize"] != "" {
+		parsed, err := parseByteSize(config["maxResponseSize"])
+		if err != nil {
+			return nil, fmt.Errorf("maxResponseSize: %s", err)
+		}
+		maxResponseSize = parsed
+	}
+
+	cache := newIdempotencyCache(ttl, maxEntries)
+	return func(req *http.Request, context context.Context) *HTTPError {
+		idempotencyKey := req.Header.Get(header)
+		if idempotencyKey == "" {
+			return nil
+		}
+
+		caller := requestIdentity(req, identityHeader)
+		if caller == "" {
+			caller = "ip:" + ClientIP(req, TrustedProxies(req)).String()
+		} else {
+			caller = "user:" + caller
+		}
+
+		key := strings.Join([]string{req.Method, req.URL.Path, caller, idempotencyKey}, "\x00")
+		if existing := cache.reserve(key, time.Now()); existing != nil {
+			if existing.inFlight {
+				return &HTTPError{
+					Status: 409,
+					Err:    fmt.Errorf("A request with the %s %s is already in progress", header, idempotencyKey),
+				}
+			}
+
+			// Replay the original response. Keys are only ever completed from an OnResponse hook, so this request must be
+			// going through a BouncingReverseProxy, and Respond can't fail
+			Respond(req, existing.response(req))
+			return nil
+		}
+
+		hooked := OnResponse(req, func(resp *http.Response, err error) {
+			if err != nil || resp.StatusCode < 200 || resp.StatusCode > 299 {
+				cache.release(key)
+				return
+			}
+
+			// Only read up to the maxResponseSize (and a byte, to know if it's over), so that large responses aren't buffered.
+			// Whatever was read is stitched back onto the front of the body for the client
+			original := resp.Body
+			body, err := ioutil.ReadAll(io.LimitReader(original, maxResponseSize+1))
+			resp.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(body), original), original}
+
+			if err != nil || int64(len(body)) > maxResponseSize {
+				cache.release(key)
+				return
+			}
+
+			cache.complete(key, resp.StatusCode, resp.Header.Clone(), body)
+		})
+
+		if !hooked {
+			// We'll never see the response, so don't leave the key in flight forever
+			cache.release(key)
+		}
+
+		return nil
+	}, nil
+}
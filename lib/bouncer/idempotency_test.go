@@ -0,0 +1,187 @@
+package bouncer_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+func TestIdempotentReplayDecider(t *testing.T) {
+	var backendHits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hit := atomic.AddInt32(&backendHits, 1)
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Backend-Hit", fmt.Sprint(hit))
+		if r.URL.Path == "/fail" {
+			w.WriteHeader(500)
+		}
+
+		if r.URL.Path == "/large" {
+			w.Write([]byte(strings.Repeat("a", 100)))
+		}
+		w.Write([]byte(fmt.Sprintf("response %d", hit)))
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	bouncers := []bouncer.Bouncer{
+		{
+			Target: bouncer.Target{
+				Methods:  []string{"POST"},
+				URIRegex: regexp.MustCompile(".*"),
+			},
+			Deciders: []bouncer.Decider{
+				bouncer.IdempotentReplayDecider(map[string]string{"maxEntries": "2", "maxResponseSize": "64"}),
+			},
+		},
+	}
+
+	// Replays are the original response, with its headers, rather than an error in the ResponseFormat
+	proxy := bouncer.NewBouncingReverseProxy(backendURL, bouncers, nil)
+	if err := bouncer.SetProxyOptions(bouncer.ProxyOptions{ResponseFormat: bouncer.ErrorFormatJSON}, proxy); err != nil {
+		t.Fatal(err)
+	}
+
+	frontend := httptest.NewServer(proxy)
+	defer frontend.Close()
+
+	send := func(path string, key string) (int, http.Header, string) {
+		request := mustMakeRequest(t, "POST", frontend.URL+path, "{}")
+		request.Header = http.Header{}
+		if key != "" {
+			request.Header.Set("Idempotency-Key", key)
+		}
+
+		response, err := frontend.Client().Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return response.StatusCode, response.Header, string(body)
+	}
+
+	testCases := []struct {
+		name           string
+		path           string
+		key            string
+		expectedStatus int
+		expectedOutput string
+	}{
+		{"Test First Request Reaches Backend", "/api/v2/silences", "a", 200, "response 1"},
+		{"Test Replay Returns Original Response", "/api/v2/silences", "a", 200, "response 1"},
+		{"Test No Key Reaches Backend", "/api/v2/silences", "", 200, "response 2"},
+		{"Test Keys Are Scoped To Path", "/api/v2/alerts", "a", 200, "response 3"},
+		{"Test Failures Aren't Cached", "/fail", "b", 500, "response 4"},
+		{"Test Failed Keys Can Be Retried", "/fail", "b", 500, "response 5"},
+		{"Test New Key Evicts Oldest", "/api/v2/silences", "c", 200, "response 6"},
+		{"Test Evicted Key Reaches Backend", "/api/v2/silences", "a", 200, "response 7"},
+		{"Test Replay Still Works After Eviction", "/api/v2/silences", "c", 200, "response 6"},
+		{"Test Large Responses Reach The Client", "/large", "d", 200, strings.Repeat("a", 100) + "response 8"},
+		{"Test Large Responses Aren't Cached", "/large", "d", 200, strings.Repeat("a", 100) + "response 9"},
+	}
+
+	for _, testCase := range testCases {
+		status, _, body := send(testCase.path, testCase.key)
+		if status != testCase.expectedStatus || body != testCase.expectedOutput {
+			t.Errorf("Test '%s' failed - expected (%d, %s) but got (%d, %s)", testCase.name, testCase.expectedStatus, testCase.expectedOutput, status, body)
+		}
+	}
+
+	status, header, body := send("/api/v2/silences", "a")
+	if status != 200 || body != "response 7" {
+		t.Errorf("Expected the replay to be the original response, got (%d, %s)", status, body)
+	}
+
+	if header.Get("Content-Type") != "application/json" || header.Get("X-Backend-Hit") != "7" {
+		t.Errorf("Expected the replay to have the original headers, got %v", header)
+	}
+}
+
+func TestIdempotentReplayIsScopedToTheCaller(t *testing.T) {
+	var backendHits int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(fmt.Sprintf("response %d", atomic.AddInt32(&backendHits, 1))))
+	}))
+	defer backend.Close()
+	backendURL, err := url.Parse(backend.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newFrontend := func(dryRun bool) *httptest.Server {
+		bouncers := []bouncer.Bouncer{
+			{
+				Target:   bouncer.Target{Methods: []string{"POST"}, URIRegex: regexp.MustCompile(".*")},
+				Deciders: []bouncer.Decider{bouncer.IdempotentReplayDecider(map[string]string{})},
+				DryRun:   dryRun,
+			},
+		}
+
+		return httptest.NewServer(bouncer.NewBouncingReverseProxy(backendURL, bouncers, nil))
+	}
+
+	send := func(frontend *httptest.Server, user string) string {
+		request := mustMakeRequest(t, "POST", frontend.URL+"/api/v2/silences", "{}")
+		request.Header = http.Header{"Idempotency-Key": []string{"a"}}
+		if user != "" {
+			request.Header.Set("X-Forwarded-User", user)
+		}
+
+		response, err := frontend.Client().Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer response.Body.Close()
+
+		body, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return string(body)
+	}
+
+	frontend := newFrontend(false)
+	defer frontend.Close()
+
+	dryRun := newFrontend(true)
+	defer dryRun.Close()
+
+	testCases := []struct {
+		name           string
+		frontend       *httptest.Server
+		user           string
+		expectedOutput string
+	}{
+		{"Test First Request From A User Reaches Backend", frontend, "alice", "response 1"},
+		{"Test Same User Gets A Replay", frontend, "alice", "response 1"},
+		{"Test Other Users Don't Get The Replay", frontend, "bob", "response 2"},
+		{"Test Anonymous Callers Are Scoped By IP", frontend, "", "response 3"},
+		{"Test Anonymous Callers From The Same IP Get A Replay", frontend, "", "response 3"},
+		{"Test First Request To A Dry Run Bouncer Reaches Backend", dryRun, "alice", "response 4"},
+		{"Test Dry Run Bouncers Don't Replay", dryRun, "alice", "response 5"},
+	}
+
+	for _, testCase := range testCases {
+		if body := send(testCase.frontend, testCase.user); body != testCase.expectedOutput {
+			t.Errorf("Test '%s' failed - expected %s, got %s", testCase.name, testCase.expectedOutput, body)
+		}
+	}
+}
@@ -0,0 +1,511 @@
+package bouncer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+type jsonPathSegment struct {
+	key      string
+	index    int
+	isIndex  bool
+	wildcard bool
+}
+
+// jsonPath is a compiled path into a JSON document. The supported dialect is a small subset of JSONPath:
+// `$` is the root, `.name` selects an object key, `[n]` selects an array element, and `[*]` (or `.*`)
+// selects every element of an array (or every value of an object). e.g. `$[*].labels.severity`
+type jsonPath []jsonPathSegment
+
+func parseJSONPath(path string) (jsonPath, error) {
+	if !strings.HasPrefix(path, "$") {
+		return nil, fmt.Errorf("JSONPath %q must start with $", path)
+	}
+
+	segments := jsonPath{}
+	rest := path[1:]
+	for rest != "" {
+		switch rest[0] {
+		case '.':
+			end := strings.IndexAny(rest[1:], ".[")
+			if end == -1 {
+				end = len(rest) - 1
+			}
+
+			key := rest[1 : end+1]
+			if key == "" {
+				return nil, fmt.Errorf("JSONPath %q has an empty key", path)
+			}
+
+			segments = append(segments, jsonPathSegment{key: key, wildcard: key == "*"})
+			rest = rest[end+1:]
+		case '[':
+			end := strings.Index(rest, "]")
+			if end == -1 {
+				return nil, fmt.Errorf("JSONPath %q has an unclosed [", path)
+			}
+
+			inner := rest[1:end]
+			if inner == "*" {
+				segments = append(segments, jsonPathSegment{wildcard: true})
+			} else {
+				index, err := strconv.Atoi(inner)
+				if err != nil || index < 0 {
+					return nil, fmt.Errorf("JSONPath %q has an invalid index %q", path, inner)
+				}
+
+				segments = append(segments, jsonPathSegment{index: index, isIndex: true})
+			}
+			rest = rest[end+1:]
+		default:
+			return nil, fmt.Errorf("JSONPath %q is invalid at %q", path, rest)
+		}
+	}
+
+	return segments, nil
+}
+
+// Evaluate returns every value in the given decoded JSON document that the path selects.
+// Parts of the path that don't exist in the document select nothing, rather than erroring
+func (p jsonPath) Evaluate(document interface{}) []interface{} {
+	current := []interface{}{document}
+	for _, segment := range p {
+		next := []interface{}{}
+		for _, value := range current {
+			switch typed := value.(type) {
+			case map[string]interface{}:
+				if segment.wildcard {
+					for _, child := range typed {
+						next = append(next, child)
+					}
+				} else if child, ok := typed[segment.key]; ok && !segment.isIndex {
+					next = append(next, child)
+				}
+			case []interface{}:
+				if segment.wildcard {
+					next = append(next, typed...)
+				} else if segment.isIndex && segment.index < len(typed) {
+					next = append(next, typed[segment.index])
+				}
+			}
+		}
+		current = next
+	}
+
+	return current
+}
+
+// jsonValueString converts a decoded JSON value into the string we compare against config values.
+// Strings are used as is, and everything else is in its JSON encoding (e.g. `1`, `true`, `null`)
+func jsonValueString(value interface{}) string {
+	if str, ok := value.(string); ok {
+		return str
+	}
+
+	encoded, _ := json.Marshal(value)
+	return string(encoded)
+}
+
+// EnumFieldDecider returns a Decider which rejects requests where the value(s) at the JSONPath "path"
+// aren't one of the comma separated "values". If the path selects an array, "arrayMode" decides whether
+// "all" (the default) or "any" of its elements must be allowed. If "required" is "true", requests
+// where the path selects nothing are rejected too
+func EnumFieldDecider(config map[string]string) Decider {
+	return deciderOrNil("enum_field", newEnumFieldDecider, config)
+}
+
+func newEnumFieldDecider(config DeciderConfig) (Decider, error) {
+	path, err := parseJSONPath(config["path"])
+	if err != nil {
+		return nil, fmt.Errorf("path: %s", err)
+	}
+
+	allowed := map[string]bool{}
+	for _, value := range parseConfigList(config["values"]) {
+		allowed[value] = true
+	}
+
+	arrayMode := config["arrayMode"]
+	if arrayMode == "" {
+		arrayMode = "all"
+	}
+
+	if arrayMode != "all" && arrayMode != "any" {
+		return nil, fmt.Errorf("arrayMode: %s is not one of all or any", arrayMode)
+	}
+
+	required := config["required"] == "true"
+	return func(req *http.Request, context context.Context) *HTTPError {
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Failed to read body"),
+			}
+		}
+
+		var document interface{}
+		if err := json.Unmarshal(bodyBytes, &document); err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Body is not valid JSON: %s", err),
+			}
+		}
+
+		values := path.Evaluate(document)
+		if len(values) == 0 && required {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("%s is required", config["path"]),
+			}
+		}
+
+		for _, value := range values {
+			elements, isArray := value.([]interface{})
+			if !isArray {
+				elements = []interface{}{value}
+			}
+
+			anyAllowed := false
+			for _, element := range elements {
+				if allowed[jsonValueString(element)] {
+					anyAllowed = true
+				} else if !isArray || arrayMode == "all" {
+					return &HTTPError{
+						Status: 400,
+						Err:    fmt.Errorf("%s must be one of %s. Got %s", config["path"], config["values"], jsonValueString(element)),
+					}
+				}
+			}
+
+			if isArray && arrayMode == "any" && !anyAllowed {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("%s must contain at least one of %s", config["path"], config["values"]),
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// MaxArrayLengthDecider returns a Decider which rejects requests where an array at the JSONPath "path" has more than "max"
+// elements, e.g. `$` for the number of alerts in a batch, or `$.matchers` for the number of matchers in a silence. If the path
+// selects several arrays (e.g. `$[*].labels`), each is checked separately. Values at the path that aren't arrays are let through,
+// unless "nonArray" is "reject". Paths that select nothing are always let through
+func MaxArrayLengthDecider(config map[string]string) Decider {
+	return deciderOrNil("max_array_length", newMaxArrayLengthDecider, config)
+}
+
+func newMaxArrayLengthDecider(config DeciderConfig) (Decider, error) {
+	path, err := parseJSONPath(config["path"])
+	if err != nil {
+		return nil, fmt.Errorf("path: %s", err)
+	}
+
+	max, err := strconv.Atoi(config["max"])
+	if err != nil || max < 0 {
+		return nil, fmt.Errorf("max: %s is not a non negative integer", config["max"])
+	}
+
+	nonArray := config["nonArray"]
+	if nonArray == "" {
+		nonArray = "ignore"
+	}
+
+	if nonArray != "ignore" && nonArray != "reject" {
+		return nil, fmt.Errorf("nonArray: %s is not one of ignore or reject", nonArray)
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Failed to read body"),
+			}
+		}
+
+		var document interface{}
+		if err := json.Unmarshal(bodyBytes, &document); err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Body is not valid JSON: %s", err),
+			}
+		}
+
+		for _, value := range path.Evaluate(document) {
+			elements, isArray := value.([]interface{})
+			if !isArray {
+				if nonArray == "reject" {
+					return &HTTPError{
+						Status: 400,
+						Err:    fmt.Errorf("%s must be an array. Got %s", config["path"], jsonValueString(value)),
+					}
+				}
+				continue
+			}
+
+			if len(elements) > max {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("%s can have at most %d elements. Got %d", config["path"], max, len(elements)),
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// CleanLabelCharsDecider returns a Decider which handles control characters (including newlines) in alert label and
+// annotation values, and silence matcher values, as they corrupt logs and UIs. In the default "mode" of "reject", requests
+// containing them are rejected, naming the offending field. In "strip" mode, the characters are removed from the body
+// instead, and bodies that don't contain any are forwarded untouched. Tabs are treated as control characters unless "allowTabs" is "true"
+func CleanLabelCharsDecider(config map[string]string) Decider {
+	return deciderOrNil("clean_label_chars", newCleanLabelCharsDecider, config)
+}
+
+func newCleanLabelCharsDecider(config DeciderConfig) (Decider, error) {
+	mode := config["mode"]
+	if mode == "" {
+		mode = "reject"
+	}
+
+	if mode != "reject" && mode != "strip" {
+		return nil, fmt.Errorf("mode: %s is not one of reject or strip", mode)
+	}
+
+	allowTabs := config["allowTabs"] == "true"
+	isBad := func(r rune) bool {
+		return unicode.IsControl(r) && !(allowTabs && r == '\t')
+	}
+
+	// clean checks (and in strip mode, fixes) the string values of the given map, returning the first key, in sorted order
+	// so that rejections are stable, with a bad value. Returns "" if every value was clean
+	clean := func(values map[string]interface{}) string {
+		keys := make([]string, 0, len(values))
+		for key := range values {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+
+		first := ""
+		for _, key := range keys {
+			str, ok := values[key].(string)
+			if !ok || strings.IndexFunc(str, isBad) == -1 {
+				continue
+			}
+
+			if first == "" {
+				first = key
+			}
+
+			if mode == "reject" {
+				break
+			}
+
+			values[key] = strings.Map(func(r rune) rune {
+				if isBad(r) {
+					return -1
+				}
+				return r
+			}, str)
+		}
+
+		return first
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Failed to read body"),
+			}
+		}
+
+		var document interface{}
+		if err := json.Unmarshal(bodyBytes, &document); err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Body is not valid JSON: %s", err),
+			}
+		}
+
+		var field string
+		switch typed := document.(type) {
+		case []interface{}:
+			// A batch of alerts
+			for i, alert := range typed {
+				alertMap, _ := alert.(map[string]interface{})
+				for _, kind := range []string{"labels", "annotations"} {
+					values, _ := alertMap[kind].(map[string]interface{})
+					if key := clean(values); key != "" && field == "" {
+						field = fmt.Sprintf("alert %d %s %s", i, kind, key)
+					}
+				}
+			}
+		case map[string]interface{}:
+			// A silence
+			matchers, _ := typed["matchers"].([]interface{})
+			for i, m := range matchers {
+				matcherMap, ok := m.(map[string]interface{})
+				if !ok {
+					continue
+				}
+
+				value := map[string]interface{}{"value": matcherMap["value"]}
+				if clean(value) != "" && field == "" {
+					field = fmt.Sprintf("matcher %d (%v) value", i, matcherMap["name"])
+				}
+				matcherMap["value"] = value["value"]
+			}
+		}
+
+		if field == "" {
+			// Nothing needed cleaning, so the body is forwarded as it was sent
+			return nil
+		}
+
+		if mode == "reject" {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("The %s contains control characters, which aren't allowed", field),
+			}
+		}
+
+		cleaned, err := json.Marshal(document)
+		if err != nil {
+			return &HTTPError{
+				Status: 500,
+				Err:    fmt.Errorf("Failed to encode cleaned body: %s", err),
+			}
+		}
+
+		RewriteBody(req, cleaned)
+		return nil
+	}, nil
+}
+
+// foldJSONKey returns a key which is equal for two object keys iff encoding/json would match them to the same struct field,
+// which it does case insensitively, by mapping every rune to the smallest rune it case folds to
+func foldJSONKey(key string) string {
+	return strings.Map(func(r rune) rune {
+		smallest := r
+		for folded := unicode.SimpleFold(r); folded != r; folded = unicode.SimpleFold(folded) {
+			if folded < smallest {
+				smallest = folded
+			}
+		}
+		return smallest
+	}, key)
+}
+
+// findDuplicateJSONKey walks the next JSON value in the decoder token by token, returning
+// the path (e.g. `$.matchers[0].name`) of the first object key that appears twice in the same object, ignoring case
+func findDuplicateJSONKey(decoder *json.Decoder, path string) (string, error) {
+	token, err := decoder.Token()
+	if err != nil {
+		return "", err
+	}
+
+	delim, ok := token.(json.Delim)
+	if !ok {
+		// Scalars can't contain keys
+		return "", nil
+	}
+
+	switch delim {
+	case '{':
+		keys := map[string]bool{}
+		for decoder.More() {
+			keyToken, err := decoder.Token()
+			if err != nil {
+				return "", err
+			}
+
+			key := keyToken.(string)
+			keyPath := path + "." + key
+			if keys[foldJSONKey(key)] {
+				return keyPath, nil
+			}
+			keys[foldJSONKey(key)] = true
+
+			if duplicate, err := findDuplicateJSONKey(decoder, keyPath); duplicate != "" || err != nil {
+				return duplicate, err
+			}
+		}
+	case '[':
+		for i := 0; decoder.More(); i++ {
+			if duplicate, err := findDuplicateJSONKey(decoder, fmt.Sprintf("%s[%d]", path, i)); duplicate != "" || err != nil {
+				return duplicate, err
+			}
+		}
+	}
+
+	// Consume the closing delimiter
+	_, err = decoder.Token()
+	return "", err
+}
+
+// RejectDuplicateJSONKeysDecider returns a Decider which rejects bodies containing a JSON object with the same key twice.
+// JSON parsers disagree on which of the values wins (Go's takes the last), so a body that we check could be interpreted
+// differently by the backend. Keys are compared case insensitively, as Go matches them to struct fields that way, so
+// `createdBy` and `CreatedBy` are the same key to our deciders. The body is scanned token by token with a streaming decoder,
+// rather than being decoded, so that duplicates aren't silently collapsed. Bodies with anything after the first JSON value
+// are rejected too, as parsers disagree on whether to ignore it. Empty bodies are let through
+func RejectDuplicateJSONKeysDecider(config map[string]string) Decider {
+	return func(req *http.Request, context context.Context) *HTTPError {
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Failed to read body"),
+			}
+		}
+
+		if len(bytes.TrimSpace(bodyBytes)) == 0 {
+			return nil
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader(bodyBytes))
+		duplicate, err := findDuplicateJSONKey(decoder, "$")
+		if err == io.EOF {
+			// The body isn't empty, so running out of tokens means it was cut short
+			err = io.ErrUnexpectedEOF
+		}
+
+		if err == nil && duplicate == "" {
+			if _, trailing := decoder.Token(); trailing != io.EOF {
+				err = fmt.Errorf("unexpected data after the top level value")
+			}
+		}
+
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Body is not valid JSON: %s", err),
+			}
+		}
+
+		if duplicate != "" {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Body contains the duplicate key %s", duplicate),
+			}
+		}
+
+		return nil
+	}
+}
@@ -0,0 +1,327 @@
+package bouncer_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+func TestEnumFieldDecider(t *testing.T) {
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Allowed Value Passes",
+			decider:         bouncer.EnumFieldDecider(map[string]string{"path": "$.priority", "values": "high, low"}),
+			input:           `{"priority": "low"}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Disallowed Value Fails",
+			decider:         bouncer.EnumFieldDecider(map[string]string{"path": "$.priority", "values": "high,low"}),
+			input:           `{"priority": "medium"}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Missing Value Passes",
+			decider:         bouncer.EnumFieldDecider(map[string]string{"path": "$.priority", "values": "high,low"}),
+			input:           `{}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Missing Required Value Fails",
+			decider:         bouncer.EnumFieldDecider(map[string]string{"path": "$.priority", "values": "high,low", "required": "true"}),
+			input:           `{}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Wildcard Checks Every Alert",
+			decider:         bouncer.EnumFieldDecider(map[string]string{"path": "$[*].labels.severity", "values": "page,ticket"}),
+			input:           `[{"labels":{"severity":"page"}},{"labels":{"severity":"info"}}]`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Index Only Checks One Alert",
+			decider:         bouncer.EnumFieldDecider(map[string]string{"path": "$[0].labels.severity", "values": "page,ticket"}),
+			input:           `[{"labels":{"severity":"page"}},{"labels":{"severity":"info"}}]`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Array Requires All Elements By Default",
+			decider:         bouncer.EnumFieldDecider(map[string]string{"path": "$.tags", "values": "a,b"}),
+			input:           `{"tags": ["a", "c"]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Array Any Mode Passes",
+			decider:         bouncer.EnumFieldDecider(map[string]string{"path": "$.tags", "values": "a,b", "arrayMode": "any"}),
+			input:           `{"tags": ["a", "c"]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Array Any Mode Fails",
+			decider:         bouncer.EnumFieldDecider(map[string]string{"path": "$.tags", "values": "a,b", "arrayMode": "any"}),
+			input:           `{"tags": ["c"]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Non String Values Pass",
+			decider:         bouncer.EnumFieldDecider(map[string]string{"path": "$.level", "values": "1,2"}),
+			input:           `{"level": 2}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Invalid JSON Fails",
+			decider:         bouncer.EnumFieldDecider(map[string]string{"path": "$.level", "values": "1,2"}),
+			input:           `{"level": `,
+			expectedSuccess: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+
+	for _, path := range []string{"priority", "$.", "$[a]", "$[0"} {
+		if bouncer.EnumFieldDecider(map[string]string{"path": path, "values": "a"}) != nil {
+			t.Errorf("Expected invalid path %s to fail to construct a decider", path)
+		}
+	}
+}
+
+func TestCleanLabelCharsDecider(t *testing.T) {
+	testCases := []struct {
+		name           string
+		decider        bouncer.Decider
+		input          string
+		expectError    bool
+		expectedOutput string
+	}{
+		{
+			name:        "Test Clean Alerts Pass",
+			decider:     bouncer.CleanLabelCharsDecider(map[string]string{}),
+			input:       `[{"labels":{"alertname":"Foo"},"annotations":{"summary":"all good"}}]`,
+			expectError: false,
+		},
+		{
+			name:        "Test Newline In Annotation Fails",
+			decider:     bouncer.CleanLabelCharsDecider(map[string]string{}),
+			input:       `[{"labels":{"alertname":"Foo"},"annotations":{"summary":"line one\nline two"}}]`,
+			expectError: true,
+		},
+		{
+			name:        "Test Control Character In Matcher Fails",
+			decider:     bouncer.CleanLabelCharsDecider(map[string]string{}),
+			input:       `{"matchers":[{"name":"job","value":"api\u0007","isRegex":false}]}`,
+			expectError: true,
+		},
+		{
+			name:        "Test Tab Fails By Default",
+			decider:     bouncer.CleanLabelCharsDecider(map[string]string{}),
+			input:       `[{"labels":{"alertname":"Foo\tBar"}}]`,
+			expectError: true,
+		},
+		{
+			name:        "Test Tab Passes When Allowed",
+			decider:     bouncer.CleanLabelCharsDecider(map[string]string{"allowTabs": "true"}),
+			input:       `[{"labels":{"alertname":"Foo\tBar"}}]`,
+			expectError: false,
+		},
+		{
+			name:           "Test Strip Mode Cleans Alerts",
+			decider:        bouncer.CleanLabelCharsDecider(map[string]string{"mode": "strip"}),
+			input:          `[{"annotations":{"summary":"line one\nline two"},"labels":{"alertname":"Foo"}}]`,
+			expectError:    false,
+			expectedOutput: `[{"annotations":{"summary":"line oneline two"},"labels":{"alertname":"Foo"}}]`,
+		},
+		{
+			name:           "Test Strip Mode Cleans Matchers",
+			decider:        bouncer.CleanLabelCharsDecider(map[string]string{"mode": "strip"}),
+			input:          `{"matchers":[{"name":"job","value":"a\r\npi"}]}`,
+			expectError:    false,
+			expectedOutput: `{"matchers":[{"name":"job","value":"api"}]}`,
+		},
+		{
+			name:           "Test Strip Mode Leaves Clean Bodies Untouched",
+			decider:        bouncer.CleanLabelCharsDecider(map[string]string{"mode": "strip"}),
+			input:          `[{"labels":{"b":"<&>","a":"x"},"value":12345678901234567890}]`,
+			expectError:    false,
+			expectedOutput: `[{"labels":{"b":"<&>","a":"x"},"value":12345678901234567890}]`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		output, err := mustBounceBody(t, testCase.decider, testCase.input)
+		if (err != nil) != testCase.expectError {
+			t.Errorf("Test %s failed. Expected error: %t, got %v", testCase.name, testCase.expectError, err)
+			continue
+		}
+
+		if testCase.expectedOutput != "" && output != testCase.expectedOutput {
+			t.Errorf("Test %s failed. Expected %s, got %s", testCase.name, testCase.expectedOutput, output)
+		}
+	}
+
+	// With several bad values, the one that's reported is always the same
+	input := `[{"labels":{"d":"x\n","c":"x\n","b":"x\n","a":"x\n"}}]`
+	for i := 0; i < 20; i++ {
+		_, err := mustBounceBody(t, bouncer.CleanLabelCharsDecider(map[string]string{}), input)
+		if err == nil || !strings.Contains(err.Err.Error(), "alert 0 labels a ") {
+			t.Fatalf("Expected the first bad label in sorted order to be reported, got %v", err)
+		}
+	}
+
+	if bouncer.CleanLabelCharsDecider(map[string]string{"mode": "escape"}) != nil {
+		t.Errorf("Expected an unknown mode to fail to construct a decider")
+	}
+}
+
+func TestRejectDuplicateJSONKeysDecider(t *testing.T) {
+	testCases := []struct {
+		name          string
+		input         string
+		expectedError string
+	}{
+		{
+			name:  "Test Unique Keys Pass",
+			input: `{"matchers":[{"name":"a","value":"b"},{"name":"a","value":"c"}],"comment":"x"}`,
+		},
+		{
+			name:          "Test Top Level Duplicate Fails",
+			input:         `{"comment":"x","createdBy":"a","comment":"y"}`,
+			expectedError: "$.comment",
+		},
+		{
+			name:          "Test Nested Duplicate Fails",
+			input:         `[{"labels":{"a":"b"}},{"labels":{"a":"b","a":"c"}}]`,
+			expectedError: "$[1].labels.a",
+		},
+		{
+			name:  "Test Empty Body Passes",
+			input: ``,
+		},
+		{
+			name:          "Test Invalid JSON Fails",
+			input:         `{"a":`,
+			expectedError: "not valid JSON",
+		},
+		{
+			name:          "Test Duplicates Differing In Case Fail",
+			input:         `{"createdBy":"a","CreatedBy":"b"}`,
+			expectedError: "$.CreatedBy",
+		},
+		{
+			name:          "Test Unicode Case Folding Is Used",
+			input:         `{"sk":"a","\u017fK":"b"}`,
+			expectedError: "duplicate key",
+		},
+		{
+			name:  "Test Trailing Whitespace Passes",
+			input: "{\"a\":\"b\"}\n",
+		},
+		{
+			name:          "Test Trailing Values Fail",
+			input:         `{"a":"b"}{"a":"c"}`,
+			expectedError: "after the top level value",
+		},
+		{
+			name:          "Test Trailing Garbage Fails",
+			input:         `{"a":"b"}]`,
+			expectedError: "not valid JSON",
+		},
+	}
+
+	decider := bouncer.RejectDuplicateJSONKeysDecider(map[string]string{})
+	for _, testCase := range testCases {
+		response := decider(mustBuildRequest(testCase.input, t), context.Background())
+		if testCase.expectedError == "" {
+			if response != nil {
+				t.Errorf("Test %s failed. Expected success, got %s", testCase.name, response.Err)
+			}
+			continue
+		}
+
+		if response == nil || !strings.Contains(response.Err.Error(), testCase.expectedError) {
+			t.Errorf("Test %s failed. Expected an error containing %s, got %v", testCase.name, testCase.expectedError, response)
+		}
+	}
+}
+
+func TestMaxArrayLengthDecider(t *testing.T) {
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Short Batch Passes",
+			decider:         bouncer.MaxArrayLengthDecider(map[string]string{"path": "$", "max": "2"}),
+			input:           `[{"labels":{}},{"labels":{}}]`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Long Batch Fails",
+			decider:         bouncer.MaxArrayLengthDecider(map[string]string{"path": "$", "max": "2"}),
+			input:           `[{"labels":{}},{"labels":{}},{"labels":{}}]`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Every Selected Array Is Checked",
+			decider:         bouncer.MaxArrayLengthDecider(map[string]string{"path": "$[*].tags", "max": "1"}),
+			input:           `[{"tags":["a"]},{"tags":["a","b"]}]`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Missing Path Passes",
+			decider:         bouncer.MaxArrayLengthDecider(map[string]string{"path": "$.matchers", "max": "1"}),
+			input:           `{}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Non Array Passes By Default",
+			decider:         bouncer.MaxArrayLengthDecider(map[string]string{"path": "$.matchers", "max": "1"}),
+			input:           `{"matchers":"a"}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Non Array Fails When Rejected",
+			decider:         bouncer.MaxArrayLengthDecider(map[string]string{"path": "$.matchers", "max": "1", "nonArray": "reject"}),
+			input:           `{"matchers":"a"}`,
+			expectedSuccess: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+
+	for _, config := range []map[string]string{{"path": "$", "max": "-1"}, {"path": "$", "max": "1", "nonArray": "wrap"}} {
+		if bouncer.MaxArrayLengthDecider(config) != nil {
+			t.Errorf("Expected %v to fail to construct a decider", config)
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package bouncer
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Logger is what bouncers log their decisions through. Each method takes a message and alternating key value pairs
+// of the fields of the event, in the same way as *slog.Logger (which satisfies this interface), so that
+// operators can ship structured (e.g. JSON) logs
+type Logger interface {
+	Info(msg string, keysAndValues ...interface{})
+	Warn(msg string, keysAndValues ...interface{})
+	Error(msg string, keysAndValues ...interface{})
+}
+
+var (
+	loggerLock sync.RWMutex
+	logger     Logger = stdLogger{}
+)
+
+// SetLogger replaces the logger that bouncers log through. A nil logger discards everything, e.g. to silence tests
+func SetLogger(l Logger) {
+	if l == nil {
+		l = discardLogger{}
+	}
+
+	loggerLock.Lock()
+	defer loggerLock.Unlock()
+	logger = l
+}
+
+// currentLogger returns the logger set by SetLogger
+func currentLogger() Logger {
+	loggerLock.RLock()
+	defer loggerLock.RUnlock()
+	return logger
+}
+
+// stdLogger is the default Logger, which writes human readable lines like `Rejected request bouncer=foo method=POST` to the standard logger
+type stdLogger struct{}
+
+func (stdLogger) Info(msg string, keysAndValues ...interface{}) {
+	log.Println(formatLogLine(msg, keysAndValues))
+}
+
+func (stdLogger) Warn(msg string, keysAndValues ...interface{}) {
+	log.Println(formatLogLine(msg, keysAndValues))
+}
+
+func (stdLogger) Error(msg string, keysAndValues ...interface{}) {
+	log.Println(formatLogLine(msg, keysAndValues))
+}
+
+// formatLogLine formats the message and its fields as a logfmt style line, quoting values that contain spaces
+func formatLogLine(msg string, keysAndValues []interface{}) string {
+	var line strings.Builder
+	line.WriteString(msg)
+	for i := 0; i < len(keysAndValues); i += 2 {
+		key := fmt.Sprint(keysAndValues[i])
+		value := "<missing>"
+		if i+1 < len(keysAndValues) {
+			value = fmt.Sprint(keysAndValues[i+1])
+		}
+
+		if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+			value = strconv.Quote(value)
+		}
+
+		line.WriteString(" ")
+		line.WriteString(key)
+		line.WriteString("=")
+		line.WriteString(value)
+	}
+
+	return line.String()
+}
+
+// discardLogger is a Logger that drops everything
+type discardLogger struct{}
+
+func (discardLogger) Info(msg string, keysAndValues ...interface{})  {}
+func (discardLogger) Warn(msg string, keysAndValues ...interface{})  {}
+func (discardLogger) Error(msg string, keysAndValues ...interface{}) {}
@@ -0,0 +1,133 @@
+package bouncer_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+type logEntry struct {
+	msg    string
+	fields map[string]string
+}
+
+type recordingLogger struct {
+	entries []logEntry
+}
+
+func (r *recordingLogger) record(msg string, keysAndValues []interface{}) {
+	fields := map[string]string{}
+	for i := 0; i+1 < len(keysAndValues); i += 2 {
+		fields[fmt.Sprint(keysAndValues[i])] = fmt.Sprint(keysAndValues[i+1])
+	}
+
+	r.entries = append(r.entries, logEntry{msg, fields})
+}
+
+func (r *recordingLogger) Info(msg string, keysAndValues ...interface{}) {
+	r.record(msg, keysAndValues)
+}
+
+func (r *recordingLogger) Warn(msg string, keysAndValues ...interface{}) {
+	r.record(msg, keysAndValues)
+}
+
+func (r *recordingLogger) Error(msg string, keysAndValues ...interface{}) {
+	r.record(msg, keysAndValues)
+}
+
+func TestSetLogger(t *testing.T) {
+	logger := &recordingLogger{}
+	bouncer.SetLogger(logger)
+	defer bouncer.SetLogger(nil)
+
+	rejects := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		return &bouncer.HTTPError{Status: 403, Err: fmt.Errorf("No silences allowed")}
+	}
+
+	testCases := []struct {
+		name           string
+		bouncer        bouncer.Bouncer
+		expectedFields map[string]string
+	}{
+		{
+			name: "Test Rejections Are Logged With Fields",
+			bouncer: bouncer.Bouncer{
+				Name:     "silences",
+				Target:   bouncer.Target{URIRegex: regexp.MustCompile(".*")},
+				Deciders: []bouncer.Decider{rejects},
+			},
+			expectedFields: map[string]string{
+				"bouncer":  "silences",
+				"decider":  "decider 0",
+				"method":   "POST",
+				"path":     "/api/v2/silences",
+				"decision": "rejected",
+				"reason":   "No silences allowed",
+			},
+		},
+		{
+			name: "Test Dry Run Rejections Are Logged As Would Reject",
+			bouncer: bouncer.Bouncer{
+				Name:     "silences",
+				Target:   bouncer.Target{URIRegex: regexp.MustCompile(".*")},
+				Deciders: []bouncer.Decider{rejects},
+				DryRun:   true,
+			},
+			expectedFields: map[string]string{
+				"bouncer":  "silences",
+				"decider":  "decider 0",
+				"method":   "POST",
+				"path":     "/api/v2/silences",
+				"decision": "would_reject",
+				"reason":   "No silences allowed",
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		logger.entries = nil
+		testCase.bouncer.Bounce(mustMakeRequest(t, "POST", "http://localhost/api/v2/silences", "{}"))
+		if len(logger.entries) != 1 {
+			t.Errorf("Test '%s' failed - expected 1 log entry, got %d", testCase.name, len(logger.entries))
+			continue
+		}
+
+		if !reflect.DeepEqual(logger.entries[0].fields, testCase.expectedFields) {
+			t.Errorf("Test '%s' failed - expected fields %v, got %v", testCase.name, testCase.expectedFields, logger.entries[0].fields)
+		}
+	}
+}
+
+func TestDeciderWarningsAreLogged(t *testing.T) {
+	logger := &recordingLogger{}
+	bouncer.SetLogger(logger)
+	defer bouncer.SetLogger(nil)
+
+	if bouncer.MaxSilenceDurationDecider(map[string]string{"maxDuration": "forever"}) != nil {
+		t.Fatalf("Expected an invalid maxDuration to fail to construct a decider")
+	}
+
+	decider := bouncer.ClockSkewGuardDecider(map[string]string{"tolerance": "1m", "mode": "warn"})
+	input := fmt.Sprintf(`[{"labels":{"alertname":"A"},"startsAt":"%s"}]`, time.Now().Add(time.Hour).Format(time.RFC3339))
+	if err := decider(mustBuildRequest(input, t), context.Background()); err != nil {
+		t.Fatalf("Expected warn mode to let the alert through, got %s", err.Err)
+	}
+
+	expectedDeciders := []string{"max_silence_duration", "clock_skew_guard"}
+	if len(logger.entries) != len(expectedDeciders) {
+		t.Fatalf("Expected %d log entries, got %v", len(expectedDeciders), logger.entries)
+	}
+
+	for i, entry := range logger.entries {
+		if entry.fields["decider"] != expectedDeciders[i] || entry.fields["error"] == "" {
+			t.Errorf("Expected entry %d to be from %s with an error, got %v", i, expectedDeciders[i], entry.fields)
+		}
+	}
+}
@@ -0,0 +1,33 @@
+package bouncer
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// bounceDecisions counts the decisions of every decider, by bouncer and decider name. decision is
+	// one of accepted, rejected, or would_reject for rejections by deciders in dry run mode
+	bounceDecisions = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "bouncer_requests_total",
+		Help: "The number of requests each decider has made a decision on, by decision",
+	}, []string{"bouncer", "decider", "decision"})
+
+	// deciderDuration times how long each decider takes to make its decision
+	deciderDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "bouncer_decider_duration_seconds",
+		Help:    "How long deciders take to decide whether to accept a request",
+		Buckets: prometheus.ExponentialBuckets(0.0005, 4, 8),
+	}, []string{"decider"})
+)
+
+// RegisterMetrics registers the bouncer's metrics with the given registerer, e.g. prometheus.DefaultRegisterer,
+// so that they can be served alongside any other metrics. The metrics are recorded whether or not they're registered
+func RegisterMetrics(registerer prometheus.Registerer) error {
+	for _, collector := range []prometheus.Collector{bounceDecisions, deciderDuration} {
+		if err := registerer.Register(collector); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,155 @@
+package bouncer_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+// counterValue returns the value of the counter in the given registry with the given name and labels
+func counterValue(t *testing.T, registry *prometheus.Registry, name string, labels map[string]string) float64 {
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+	metrics:
+		for _, metric := range family.GetMetric() {
+			for _, label := range metric.GetLabel() {
+				if labels[label.GetName()] != label.GetValue() {
+					continue metrics
+				}
+			}
+
+			return metric.GetCounter().GetValue()
+		}
+	}
+
+	return 0
+}
+
+func TestBounceRecordsMetrics(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := bouncer.RegisterMetrics(registry); err != nil {
+		t.Fatalf("Failed to register metrics: %s", err)
+	}
+
+	b := bouncer.Bouncer{
+		Name: "metrics_test",
+		Target: bouncer.Target{
+			URIRegex: regexp.MustCompile(".*"),
+		},
+		Deciders: []bouncer.Decider{
+			func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+				return nil
+			},
+			func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+				return &bouncer.HTTPError{Status: 400, Err: fmt.Errorf("No")}
+			},
+			func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+				return &bouncer.HTTPError{Status: 400, Err: fmt.Errorf("No")}
+			},
+		},
+		DeciderOptions: []bouncer.DeciderOptions{{Name: "accepts"}, {Name: "dry", DryRun: true}, {Name: "rejects"}},
+	}
+
+	b.Bounce(mustBuildRequest("", t))
+
+	expected := map[string]string{"accepts": "accepted", "dry": "would_reject", "rejects": "rejected"}
+	for decider, decision := range expected {
+		value := counterValue(t, registry, "bouncer_requests_total", map[string]string{"bouncer": "metrics_test", "decider": decider, "decision": decision})
+		if value != 1 {
+			t.Errorf("Expected one %s decision from %s, got %f", decision, decider, value)
+		}
+	}
+
+	if err := bouncer.RegisterMetrics(registry); err == nil {
+		t.Errorf("Expected registering the metrics twice to fail")
+	}
+}
+
+func TestAnyBouncerRecordsEveryDecision(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := bouncer.RegisterMetrics(registry); err != nil {
+		t.Fatalf("Failed to register metrics: %s", err)
+	}
+
+	b := bouncer.Bouncer{
+		Name:  "any_metrics_test",
+		Logic: bouncer.LogicAny,
+		Deciders: []bouncer.Decider{
+			func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+				return &bouncer.HTTPError{Status: 400, Err: fmt.Errorf("No")}
+			},
+			func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+				return nil
+			},
+		},
+		DeciderOptions: []bouncer.DeciderOptions{{Name: "rejects"}, {Name: "accepts"}},
+	}
+
+	if err := b.Bounce(mustBuildRequest("", t)); err != nil {
+		t.Fatalf("Expected the request to be accepted, got %s", err.Err)
+	}
+
+	expected := map[string]string{"rejects": "rejected", "accepts": "accepted"}
+	for decider, decision := range expected {
+		value := counterValue(t, registry, "bouncer_requests_total", map[string]string{"bouncer": "any_metrics_test", "decider": decider, "decision": decision})
+		if value != 1 {
+			t.Errorf("Expected one %s decision from %s, got %f", decision, decider, value)
+		}
+	}
+}
+
+func TestDryRunAnyBouncerRecordsWouldReject(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	if err := bouncer.RegisterMetrics(registry); err != nil {
+		t.Fatalf("Failed to register metrics: %s", err)
+	}
+
+	rejects := func(req *http.Request, ctx context.Context) *bouncer.HTTPError {
+		return &bouncer.HTTPError{Status: 400, Err: fmt.Errorf("No")}
+	}
+
+	b := bouncer.Bouncer{
+		Name:           "dry_any_metrics_test",
+		Logic:          bouncer.LogicAny,
+		DryRun:         true,
+		Deciders:       []bouncer.Decider{rejects, rejects},
+		DeciderOptions: []bouncer.DeciderOptions{{Name: "first"}, {Name: "second"}},
+	}
+
+	err, results := b.BounceWithResult(mustBuildRequest("", t))
+	if err != nil {
+		t.Fatalf("Expected the dry run bouncer to accept the request, got %s", err.Err)
+	}
+
+	for _, result := range results {
+		if result.Decision != bouncer.DecisionWouldReject {
+			t.Errorf("Expected %s to be a would_reject decision, got %s", result.Name, result.Decision)
+		}
+	}
+
+	for _, decider := range []string{"first", "second"} {
+		labels := map[string]string{"bouncer": "dry_any_metrics_test", "decider": decider}
+		labels["decision"] = "would_reject"
+		if value := counterValue(t, registry, "bouncer_requests_total", labels); value != 1 {
+			t.Errorf("Expected one would_reject decision from %s, got %f", decider, value)
+		}
+
+		labels["decision"] = "rejected"
+		if value := counterValue(t, registry, "bouncer_requests_total", labels); value != 0 {
+			t.Errorf("Expected no rejected decisions from %s, got %f", decider, value)
+		}
+	}
+}
@@ -0,0 +1,704 @@
+package bouncer
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+// requestIdentity returns the identity of the caller (e.g. their username or team) from the given
+// header, as set by an authenticating proxy in front of us. Returns an empty string if it isn't set
+func requestIdentity(req *http.Request, header string) string {
+	return strings.TrimSpace(req.Header.Get(header))
+}
+
+// EnvGuardDecider returns a Decider which rejects requests whose environment header (X-Env by default,
+// or "header") doesn't equal the configured "environment". This catches clients configured for one
+// environment (e.g. staging) that have been pointed at another (e.g. prod)
+func EnvGuardDecider(config map[string]string) Decider {
+	environment := config["environment"]
+	header := config["header"]
+	if header == "" {
+		header = "X-Env"
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		if got := req.Header.Get(header); got != environment {
+			return &HTTPError{
+				Status: 421,
+				Err:    fmt.Errorf("This is the %s environment, but the request was for %q (from the %s header)", environment, got, header),
+			}
+		}
+
+		return nil
+	}
+}
+
+// parseByteSize parses a size in bytes, with an optional unit suffix (KB, KiB, MB, MiB, GB, GiB), e.g. `512KiB`
+func parseByteSize(size string) (int64, error) {
+	size = strings.TrimSpace(size)
+	multiplier := int64(1)
+	for _, unit := range []struct {
+		suffix     string
+		multiplier int64
+	}{
+		{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30},
+		{"KB", 1000}, {"MB", 1000 * 1000}, {"GB", 1000 * 1000 * 1000},
+		{"B", 1},
+	} {
+		if strings.HasSuffix(size, unit.suffix) {
+			size = strings.TrimSpace(strings.TrimSuffix(size, unit.suffix))
+			multiplier = unit.multiplier
+			break
+		}
+	}
+
+	value, err := strconv.ParseInt(size, 10, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("%q is not a valid size", size)
+	}
+
+	return value * multiplier, nil
+}
+
+type pathBodyLimit struct {
+	pathRegex *regexp.Regexp
+	limit     int64
+}
+
+// PathBodyLimitDecider returns a Decider which rejects request bodies larger than the limit for their path.
+// "limits" is a comma separated list of `<path regex>=<size>` pairs, e.g. `^/api/v2/alerts$=1MiB,^/api/v2/silences$=16KiB`,
+// where the first regex matching the request path wins. Paths that don't match any of them use the "default"
+// limit if one is set, and are otherwise unlimited
+func PathBodyLimitDecider(config map[string]string) Decider {
+	return deciderOrNil("path_body_limit", newPathBodyLimitDecider, config)
+}
+
+func newPathBodyLimitDecider(config DeciderConfig) (Decider, error) {
+	limits := []pathBodyLimit{}
+	for _, pair := range parseConfigList(config["limits"]) {
+		index := strings.LastIndex(pair, "=")
+		if index == -1 {
+			return nil, fmt.Errorf("limits: %q is not of the form <path regex>=<size>", pair)
+		}
+
+		pathRegex, err := regexp.Compile(strings.TrimSpace(pair[:index]))
+		if err != nil {
+			return nil, fmt.Errorf("path regex: %s", err)
+		}
+
+		limit, err := parseByteSize(pair[index+1:])
+		if err != nil {
+			return nil, fmt.Errorf("limit: %s", err)
+		}
+
+		limits = append(limits, pathBodyLimit{pathRegex, limit})
+	}
+
+	defaultLimit := int64(-1)
+	if config["default"] != "" {
+		limit, err := parseByteSize(config["default"])
+		if err != nil {
+			return nil, fmt.Errorf("default: %s", err)
+		}
+		defaultLimit = limit
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		limit := defaultLimit
+		for _, pathLimit := range limits {
+			if pathLimit.pathRegex.MatchString(req.URL.Path) {
+				limit = pathLimit.limit
+				break
+			}
+		}
+
+		if limit < 0 {
+			return nil
+		}
+
+		// Bounce has already buffered the body in memory, so reading it here is cheap
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Failed to read body"),
+			}
+		}
+
+		if int64(len(bodyBytes)) > limit {
+			return &HTTPError{
+				Status: 413,
+				Err:    fmt.Errorf("Request bodies for %s must be at most %d bytes. Got %d", req.URL.Path, limit, len(bodyBytes)),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// parseMethodSet parses a comma separated list of HTTP methods into a set, with the method names upper cased
+func parseMethodSet(methods string) map[string]bool {
+	set := map[string]bool{}
+	for _, method := range parseConfigList(methods) {
+		set[strings.ToUpper(method)] = true
+	}
+
+	return set
+}
+
+// BodyRequiredForMethodDecider returns a Decider which rejects requests whose body presence doesn't suit
+// their method. Methods in "requireBody" (default POST,PUT,PATCH) must have a non empty body, and methods in
+// "forbidBody" (default none, e.g. GET,DELETE) must have an empty one
+func BodyRequiredForMethodDecider(config map[string]string) Decider {
+	return deciderOrNil("body_required_for_method", newBodyRequiredForMethodDecider, config)
+}
+
+func newBodyRequiredForMethodDecider(config DeciderConfig) (Decider, error) {
+	requireBodyStr, ok := config["requireBody"]
+	if !ok {
+		requireBodyStr = "POST,PUT,PATCH"
+	}
+
+	requireBody := parseMethodSet(requireBodyStr)
+	forbidBody := parseMethodSet(config["forbidBody"])
+	for method := range requireBody {
+		if forbidBody[method] {
+			return nil, fmt.Errorf("%s can't both require and forbid a body", method)
+		}
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		method := strings.ToUpper(req.Method)
+		if !requireBody[method] && !forbidBody[method] {
+			return nil
+		}
+
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Failed to read body"),
+			}
+		}
+
+		if requireBody[method] && len(bodyBytes) == 0 {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("%s requests to %s must have a body", method, req.URL.Path),
+			}
+		}
+
+		if forbidBody[method] && len(bodyBytes) != 0 {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("%s requests to %s must not have a body", method, req.URL.Path),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// RequireFreshConfigDecider returns a Decider which rejects writes (requests using one of the comma separated
+// "methods", default POST,PUT,PATCH,DELETE) with a 503 when the bouncers config of the proxy the request is going through was
+// last successfully loaded more than "maxAge" ago, or if it isn't going through a BouncingReverseProxy. This is intended for deployments that reload the config periodically (e.g. a config management
+// agent sending a SIGHUP every few minutes), where a config that hasn't loaded in a while means reloads are failing,
+// and the rules being enforced may be out of date. During such an outage it's then safer to stop writes until the config
+// is fixed than to keep enforcing stale rules, while reads carry on as usual
+func RequireFreshConfigDecider(config map[string]string) Decider {
+	return deciderOrNil("require_fresh_config", newRequireFreshConfigDecider, config)
+}
+
+func newRequireFreshConfigDecider(config DeciderConfig) (Decider, error) {
+	maxAge, err := time.ParseDuration(config["maxAge"])
+	if err != nil {
+		return nil, fmt.Errorf("maxAge: %s", err)
+	}
+
+	methodsStr, ok := config["methods"]
+	if !ok {
+		methodsStr = "POST,PUT,PATCH,DELETE"
+	}
+	methods := parseMethodSet(methodsStr)
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		if !methods[strings.ToUpper(req.Method)] {
+			return nil
+		}
+
+		var lastLoad time.Time
+		if state, ok := req.Context().Value(transportStateKey).(*transportState); ok {
+			lastLoad = state.loadedAt
+		}
+
+		if age := time.Since(lastLoad); lastLoad.IsZero() || age > maxAge {
+			return &HTTPError{
+				Status: 503,
+				Err:    fmt.Errorf("The bouncer config hasn't been loaded for more than %s, so writes are disabled until it is", maxAge),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// ComplexityBudgetDecider returns a Decider which scores how expensive a request is for the backend, and rejects
+// it if the score is over the "budget". The score is the weighted sum of the body size in KiB ("bodyKiBWeight", default 1),
+// the number of silence matchers ("matcherWeight", default 1), the number of those that are regexes ("regexMatcherWeight",
+// default 5, on top of matcherWeight), and the number of alerts in an alert batch ("alertWeight", default 1). Requests where
+// the body size alone is over the budget are rejected with a 413, and everything else over it with a 400. The score is included
+// in the rejection so that the weights can be tuned
+func ComplexityBudgetDecider(config map[string]string) Decider {
+	return deciderOrNil("complexity_budget", newComplexityBudgetDecider, config)
+}
+
+func newComplexityBudgetDecider(config DeciderConfig) (Decider, error) {
+	budget, err := strconv.ParseFloat(config["budget"], 64)
+	if err != nil {
+		return nil, fmt.Errorf("budget: %s", err)
+	}
+
+	weights := map[string]float64{
+		"bodyKiBWeight":      1,
+		"matcherWeight":      1,
+		"regexMatcherWeight": 5,
+		"alertWeight":        1,
+	}
+
+	for name := range weights {
+		if config[name] == "" {
+			continue
+		}
+
+		weight, err := strconv.ParseFloat(config[name], 64)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		weights[name] = weight
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Failed to read body"),
+			}
+		}
+
+		bodyScore := weights["bodyKiBWeight"] * float64(len(bodyBytes)) / 1024
+		matchers, regexMatchers, alerts := 0, 0, 0
+
+		// Silences are objects with a list of matchers, and alerts come in arrays. Anything else only scores for its size
+		var silence alertmanagerSilenceSerialized
+		var alertBatch []json.RawMessage
+		if json.Unmarshal(bodyBytes, &alertBatch) == nil {
+			alerts = len(alertBatch)
+		} else if json.Unmarshal(bodyBytes, &silence) == nil {
+			matchers = len(silence.Matchers)
+			for _, m := range silence.Matchers {
+				if m.IsRegex {
+					regexMatchers++
+				}
+			}
+		}
+
+		score := bodyScore +
+			weights["matcherWeight"]*float64(matchers) +
+			weights["regexMatcherWeight"]*float64(regexMatchers) +
+			weights["alertWeight"]*float64(alerts)
+
+		if score > budget {
+			status := 400
+			if bodyScore > budget {
+				status = 413
+			}
+
+			return &HTTPError{
+				Status: status,
+				Err:    fmt.Errorf("Request is too complex, with a score of %.2f (%.2f from a %d byte body, %d matchers, %d regex matchers and %d alerts) over the budget of %.2f", score, bodyScore, len(bodyBytes), matchers, regexMatchers, alerts, budget),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// healthCache caches the result of a health check for a ttl
+type healthCache struct {
+	lock      sync.Mutex
+	ttl       time.Duration
+	lastErr   error
+	checkedAt time.Time
+}
+
+// check returns the cached health check result, running the given check if it's older than the ttl. Checks that were
+// cancelled say nothing about the backend, so they aren't cached
+func (h *healthCache) check(now time.Time, check func() error) error {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.checkedAt.IsZero() || now.Sub(h.checkedAt) >= h.ttl {
+		err := check()
+		if errors.Is(err, context.Canceled) {
+			return err
+		}
+
+		h.lastErr = err
+		h.checkedAt = now
+	}
+
+	return h.lastErr
+}
+
+// BackendPreflightDecider returns a Decider which rejects writes with a 503 while the backend is known to be down, so that clients
+// fail fast with a clear error instead of the request being accepted and then failing with a 502. The backend is considered up if
+// a GET of "healthURL" (e.g. `http://alertmanager:9093/-/healthy`) responds with a 2xx within the "timeout" (default 2s). The result is
+// cached for the "ttl" (default 5s), so most requests don't wait on a check. Only requests whose method is in "methods" (default POST,PUT,PATCH,DELETE) are checked
+func BackendPreflightDecider(config map[string]string) Decider {
+	return deciderOrNil("backend_preflight", newBackendPreflightDecider, config)
+}
+
+func newBackendPreflightDecider(config DeciderConfig) (Decider, error) {
+	healthURL := config["healthURL"]
+	ttl := 5 * time.Second
+	timeout := 2 * time.Second
+	for name, value := range map[string]*time.Duration{"ttl": &ttl, "timeout": &timeout} {
+		if config[name] == "" {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(config[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		*value = parsed
+	}
+
+	methodsStr, ok := config["methods"]
+	if !ok {
+		methodsStr = "POST,PUT,PATCH,DELETE"
+	}
+	methods := parseMethodSet(methodsStr)
+
+	health := &healthCache{ttl: ttl}
+	return func(req *http.Request, _ context.Context) *HTTPError {
+		if !methods[strings.ToUpper(req.Method)] {
+			return nil
+		}
+
+		err := health.check(time.Now(), func() error {
+			// The result is shared by every request for the ttl, so it mustn't be cut short by this request being cancelled
+			err := checkHealth(context.Background(), healthURL, timeout)
+			if err != nil {
+				// The error names the health URL and how reaching it failed, which clients have no business seeing
+				currentLogger().Warn("Backend health check failed", "decider", "backend_preflight", "error", err.Error())
+			}
+			return err
+		})
+
+		if err != nil {
+			return &HTTPError{
+				Status: 503,
+				Err:    fmt.Errorf("The backend is currently unavailable, try again later"),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// rateLimiters holds a token bucket for every key that's being rate limited, e.g. each client IP. Idle buckets
+// are forgotten once they would have refilled, as a new bucket is indistinguishable from a full one
+type rateLimiters struct {
+	lock      sync.Mutex
+	rate      rate.Limit
+	burst     int
+	idleTTL   time.Duration
+	limiters  map[string]*rateLimiterEntry
+	lastPrune time.Time
+}
+
+type rateLimiterEntry struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+func newRateLimiters(limit rate.Limit, burst int) *rateLimiters {
+	return &rateLimiters{
+		rate:     limit,
+		burst:    burst,
+		idleTTL:  time.Duration(float64(burst) / float64(limit) * float64(time.Second)),
+		limiters: map[string]*rateLimiterEntry{},
+	}
+}
+
+// allow takes a token from the bucket for the given key, returning whether there was one and, if not,
+// how long until there will be
+func (r *rateLimiters) allow(key string, now time.Time) (bool, time.Duration) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	// Idle buckets are swept out at most once per idleTTL, so this stays cheap per request
+	if now.Sub(r.lastPrune) > r.idleTTL {
+		for key, entry := range r.limiters {
+			if now.Sub(entry.lastSeen) > r.idleTTL {
+				delete(r.limiters, key)
+			}
+		}
+		r.lastPrune = now
+	}
+
+	entry, ok := r.limiters[key]
+	if !ok {
+		entry = &rateLimiterEntry{limiter: rate.NewLimiter(r.rate, r.burst)}
+		r.limiters[key] = entry
+	}
+	entry.lastSeen = now
+
+	reservation := entry.limiter.ReserveN(now, 1)
+	if delay := reservation.DelayFrom(now); delay > 0 {
+		// We're rejecting the request rather than waiting, so give the token back
+		reservation.CancelAt(now)
+		return false, delay
+	}
+
+	return true, 0
+}
+
+// RateLimitDecider returns a Decider which rejects requests with a 429 once more than "rate" requests per second (e.g. `0.5`
+// for one every two seconds) have been let through, allowing bursts of up to "burst" requests. The limit is global unless "key" is
+// "ip", in which case every client IP (from ClientIP, with the proxy's TrustedProxies) gets its own limit. Rejections have a Retry-After header saying when to try again. The
+// limiters are created with the decider, and shared by every request that it decides on
+func RateLimitDecider(config map[string]string) Decider {
+	return deciderOrNil("rate_limit", newRateLimitDecider, config)
+}
+
+func newRateLimitDecider(config DeciderConfig) (Decider, error) {
+	perSecond, err := strconv.ParseFloat(config["rate"], 64)
+	if err != nil || perSecond <= 0 {
+		return nil, fmt.Errorf("rate: %s is not a positive number", config["rate"])
+	}
+
+	burst, err := strconv.Atoi(config["burst"])
+	if err != nil || burst < 1 {
+		return nil, fmt.Errorf("burst: %s is not a positive integer", config["burst"])
+	}
+
+	key := config["key"]
+	if key == "" {
+		key = "global"
+	}
+
+	if key != "global" && key != "ip" {
+		return nil, fmt.Errorf("key: %s is not one of global or ip", key)
+	}
+
+	limiters := newRateLimiters(rate.Limit(perSecond), burst)
+	return func(req *http.Request, context context.Context) *HTTPError {
+		limiterKey := ""
+		if key == "ip" {
+			limiterKey = ClientIP(req, TrustedProxies(req)).String()
+		}
+
+		allowed, retryAfter := limiters.allow(limiterKey, time.Now())
+		if !allowed {
+			seconds := int(math.Ceil(retryAfter.Seconds()))
+			return &HTTPError{
+				Status: 429,
+				Err:    fmt.Errorf("Too many requests, try again in %ds", seconds),
+				Header: http.Header{"Retry-After": []string{strconv.Itoa(seconds)}},
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// clock returns the current time for deciders that care about the time of day, like time_window. Tests override it with SetClock
+var clock = time.Now
+
+// weekMinutes is the number of minutes in a week, which a timeWindow's minutes count up to
+const weekMinutes = 7 * 24 * 60
+
+// timeWindow is a window of time within a week, from start up to (but not including) end, in minutes since the start of Sunday.
+// Windows that run past the end of Saturday wrap round to Sunday
+type timeWindow struct {
+	start int
+	end   int
+}
+
+func (w timeWindow) contains(minute int) bool {
+	if w.end > weekMinutes {
+		return minute >= w.start || minute < w.end-weekMinutes
+	}
+
+	return minute >= w.start && minute < w.end
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// parseWeekdays parses a comma separated list of days or ranges of days, e.g. `Mon-Fri` or `Mon,Wed-Thu`. Ranges can wrap round the
+// end of the week, e.g. `Fri-Mon`
+func parseWeekdays(spec string) ([]time.Weekday, error) {
+	var days []time.Weekday
+	for _, part := range parseConfigList(spec) {
+		bounds := strings.SplitN(part, "-", 2)
+		first, ok := weekdays[strings.ToLower(bounds[0])]
+		if !ok {
+			return nil, fmt.Errorf("%s is not a day", bounds[0])
+		}
+
+		last := first
+		if len(bounds) == 2 {
+			if last, ok = weekdays[strings.ToLower(bounds[1])]; !ok {
+				return nil, fmt.Errorf("%s is not a day", bounds[1])
+			}
+		}
+
+		for day := first; ; day = (day + 1) % 7 {
+			days = append(days, day)
+			if day == last {
+				break
+			}
+		}
+	}
+
+	return days, nil
+}
+
+// parseClock parses a time of day like `09:30` into minutes since midnight. `24:00` is allowed as the end of the day
+func parseClock(clock string) (int, error) {
+	parts := strings.SplitN(clock, ":", 2)
+	if len(parts) != 2 {
+		return 0, fmt.Errorf("%s is not a time like 09:30", clock)
+	}
+
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("%s is not a time like 09:30", clock)
+	}
+
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil || len(parts[1]) != 2 || minutes < 0 || minutes > 59 || hours < 0 || hours > 24 || (hours == 24 && minutes != 0) {
+		return 0, fmt.Errorf("%s is not a time like 09:30", clock)
+	}
+
+	return hours*60 + minutes, nil
+}
+
+// parseTimeWindows parses a semicolon separated list of windows like `Mon-Fri 09:00-17:00;Sat 10:00-12:00`, each of which is a
+// list of days (see parseWeekdays) and the times between which they're allowed on those days. Windows whose end time is before
+// their start time run overnight into the next day, e.g. `Fri 22:00-02:00`
+func parseTimeWindows(spec string) ([]timeWindow, error) {
+	var windows []timeWindow
+	for _, window := range strings.Split(spec, ";") {
+		window = strings.TrimSpace(window)
+		if window == "" {
+			continue
+		}
+
+		fields := strings.Fields(window)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%q is not a window like Mon-Fri 09:00-17:00", window)
+		}
+
+		days, err := parseWeekdays(fields[0])
+		if err != nil {
+			return nil, err
+		}
+
+		clocks := strings.SplitN(fields[1], "-", 2)
+		if len(clocks) != 2 {
+			return nil, fmt.Errorf("%q is not a window like Mon-Fri 09:00-17:00", window)
+		}
+
+		start, err := parseClock(clocks[0])
+		if err != nil {
+			return nil, err
+		}
+
+		end, err := parseClock(clocks[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if start == end {
+			return nil, fmt.Errorf("%q starts and ends at the same time", window)
+		}
+
+		if end < start {
+			end += 24 * 60
+		}
+
+		for _, day := range days {
+			dayStart := int(day) * 24 * 60
+			windows = append(windows, timeWindow{start: dayStart + start, end: dayStart + end})
+		}
+	}
+
+	if len(windows) == 0 {
+		return nil, fmt.Errorf("at least one window is required")
+	}
+
+	return windows, nil
+}
+
+// TimeWindowDecider returns a Decider which only lets requests through during the "allow"ed windows, e.g. `Mon-Fri 09:00-17:00`
+// (see parseTimeWindows for the full format), in the "timezone" (default UTC, or e.g. `Australia/Sydney`). Requests outside the
+// windows are rejected with a 403, or the decider's "status"
+func TimeWindowDecider(config map[string]string) Decider {
+	return deciderOrNil("time_window", newTimeWindowDecider, config)
+}
+
+func newTimeWindowDecider(config DeciderConfig) (Decider, error) {
+	windows, err := parseTimeWindows(config["allow"])
+	if err != nil {
+		return nil, fmt.Errorf("allow: %s", err)
+	}
+
+	timezone := config["timezone"]
+	if timezone == "" {
+		timezone = "UTC"
+	}
+
+	location, err := time.LoadLocation(timezone)
+	if err != nil {
+		return nil, fmt.Errorf("timezone: %s", err)
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		now := clock().In(location)
+		minute := int(now.Weekday())*24*60 + now.Hour()*60 + now.Minute()
+		for _, window := range windows {
+			if window.contains(minute) {
+				return nil
+			}
+		}
+
+		return &HTTPError{
+			Status: 403,
+			Err:    fmt.Errorf("Requests are only allowed during %s (%s). It's currently %s", config["allow"], timezone, now.Format("Mon 15:04")),
+		}
+	}, nil
+}
@@ -0,0 +1,509 @@
+package bouncer_test
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+func TestEnvGuardDecider(t *testing.T) {
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		headers         map[string]string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Matching Env Passes",
+			decider:         bouncer.EnvGuardDecider(map[string]string{"environment": "prod"}),
+			headers:         map[string]string{"X-Env": "prod"},
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Mismatched Env Fails",
+			decider:         bouncer.EnvGuardDecider(map[string]string{"environment": "prod"}),
+			headers:         map[string]string{"X-Env": "staging"},
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Missing Env Fails",
+			decider:         bouncer.EnvGuardDecider(map[string]string{"environment": "prod"}),
+			headers:         map[string]string{},
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Custom Header Passes",
+			decider:         bouncer.EnvGuardDecider(map[string]string{"environment": "prod", "header": "X-Deployment"}),
+			headers:         map[string]string{"X-Deployment": "prod"},
+			expectedSuccess: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		req := mustBuildRequest("", t)
+		for name, value := range testCase.headers {
+			req.Header.Set(name, value)
+		}
+
+		response := testCase.decider(req, context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+}
+
+func TestPathBodyLimitDecider(t *testing.T) {
+	config := map[string]string{"limits": "^/api/v2/alerts$=1KiB, ^/api/v2/silences$=10B"}
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		path            string
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Small Body Passes",
+			decider:         bouncer.PathBodyLimitDecider(config),
+			path:            "/api/v2/silences",
+			input:           "0123456789",
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Large Body Fails",
+			decider:         bouncer.PathBodyLimitDecider(config),
+			path:            "/api/v2/silences",
+			input:           "0123456789a",
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Per Path Limit Is Used",
+			decider:         bouncer.PathBodyLimitDecider(config),
+			path:            "/api/v2/alerts",
+			input:           "0123456789a",
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Unmatched Path Is Unlimited",
+			decider:         bouncer.PathBodyLimitDecider(config),
+			path:            "/api/v2/status",
+			input:           "0123456789a",
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Unmatched Path Uses Default",
+			decider:         bouncer.PathBodyLimitDecider(map[string]string{"limits": "^/api/v2/alerts$=1KiB", "default": "1"}),
+			path:            "/api/v2/status",
+			input:           "01",
+			expectedSuccess: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		response := testCase.decider(mustMakeRequest(t, "POST", "http://localhost"+testCase.path, testCase.input), context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+
+	for _, limits := range []string{"/api", "/api=lots", "(=1"} {
+		if bouncer.PathBodyLimitDecider(map[string]string{"limits": limits}) != nil {
+			t.Errorf("Expected invalid limits %s to fail to construct a decider", limits)
+		}
+	}
+}
+
+func TestBodyRequiredForMethodDecider(t *testing.T) {
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		method          string
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test POST With Body Passes",
+			decider:         bouncer.BodyRequiredForMethodDecider(map[string]string{}),
+			method:          "POST",
+			input:           `{}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test POST Without Body Fails",
+			decider:         bouncer.BodyRequiredForMethodDecider(map[string]string{}),
+			method:          "post",
+			input:           "",
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test GET With Body Passes By Default",
+			decider:         bouncer.BodyRequiredForMethodDecider(map[string]string{}),
+			method:          "GET",
+			input:           `{}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Forbidden Body Fails",
+			decider:         bouncer.BodyRequiredForMethodDecider(map[string]string{"forbidBody": "GET, DELETE"}),
+			method:          "DELETE",
+			input:           `{}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Custom Required Methods Pass",
+			decider:         bouncer.BodyRequiredForMethodDecider(map[string]string{"requireBody": "PUT"}),
+			method:          "POST",
+			input:           "",
+			expectedSuccess: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		response := testCase.decider(mustMakeRequest(t, testCase.method, "http://localhost/api/v2/silences", testCase.input), context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+
+	if bouncer.BodyRequiredForMethodDecider(map[string]string{"requireBody": "POST", "forbidBody": "post"}) != nil {
+		t.Errorf("Expected a method that both requires and forbids a body to fail to construct a decider")
+	}
+}
+
+func TestRequireFreshConfigDecider(t *testing.T) {
+	bouncers := []bouncer.Bouncer{
+		{
+			Target:   bouncer.Target{URIRegex: regexp.MustCompile(".*")},
+			Deciders: []bouncer.Decider{bouncer.RequireFreshConfigDecider(map[string]string{"maxAge": "30m"})},
+		},
+	}
+
+	backend := roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		return &http.Response{
+			StatusCode: 200,
+			Header:     http.Header{},
+			Body:       ioutil.NopCloser(strings.NewReader("")),
+		}, nil
+	})
+
+	backendURL, _ := url.Parse("http://localhost")
+	testCases := []struct {
+		name            string
+		lastLoad        time.Time
+		method          string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Fresh Config Passes",
+			lastLoad:        time.Now(),
+			method:          "POST",
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Stale Config Rejects Writes",
+			lastLoad:        time.Now().Add(-time.Hour),
+			method:          "POST",
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Stale Config Allows Reads",
+			lastLoad:        time.Now().Add(-time.Hour),
+			method:          "GET",
+			expectedSuccess: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		proxy := bouncer.NewBouncingReverseProxy(backendURL, bouncers, backend)
+		bouncer.SetConfigLoaded(testCase.lastLoad, proxy)
+		recorder := httptest.NewRecorder()
+		proxy.ServeHTTP(recorder, httptest.NewRequest(testCase.method, "http://localhost/api/v2/silences", nil))
+		if (recorder.Code == 200) != testCase.expectedSuccess {
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, recorder.Body.String())
+		}
+	}
+
+	// Each proxy tracks its own loads, so a fresh proxy isn't affected by a stale one
+	stale := bouncer.NewBouncingReverseProxy(backendURL, bouncers, backend)
+	bouncer.SetConfigLoaded(time.Now().Add(-time.Hour), stale)
+	fresh := bouncer.NewBouncingReverseProxy(backendURL, bouncers, backend)
+	recorder := httptest.NewRecorder()
+	fresh.ServeHTTP(recorder, httptest.NewRequest("POST", "http://localhost/api/v2/silences", nil))
+	if recorder.Code != 200 {
+		t.Errorf("Expected a freshly loaded proxy to accept writes, got a %d", recorder.Code)
+	}
+
+	// Outside of a proxy there's no config load to go by, so writes are rejected
+	if bouncers[0].Bounce(mustMakeRequest(t, "POST", "http://localhost/api/v2/silences", "")) == nil {
+		t.Errorf("Expected writes outside of a proxy to be rejected")
+	}
+}
+
+func TestComplexityBudgetDecider(t *testing.T) {
+	testCases := []struct {
+		name           string
+		decider        bouncer.Decider
+		input          string
+		expectedStatus int
+	}{
+		{
+			name:           "Test Simple Silence Passes",
+			decider:        bouncer.ComplexityBudgetDecider(map[string]string{"budget": "10"}),
+			input:          `{"matchers":[{"name":"a","value":"b","isRegex":false}]}`,
+			expectedStatus: 0,
+		},
+		{
+			name:           "Test Regex Heavy Silence Fails",
+			decider:        bouncer.ComplexityBudgetDecider(map[string]string{"budget": "10"}),
+			input:          `{"matchers":[{"name":"a","value":"b.*","isRegex":true},{"name":"c","value":"d.*","isRegex":true}]}`,
+			expectedStatus: 400,
+		},
+		{
+			name:           "Test Weights Are Configurable",
+			decider:        bouncer.ComplexityBudgetDecider(map[string]string{"budget": "10", "regexMatcherWeight": "0"}),
+			input:          `{"matchers":[{"name":"a","value":"b.*","isRegex":true},{"name":"c","value":"d.*","isRegex":true}]}`,
+			expectedStatus: 0,
+		},
+		{
+			name:           "Test Large Alert Batch Fails",
+			decider:        bouncer.ComplexityBudgetDecider(map[string]string{"budget": "2"}),
+			input:          `[{"labels":{"a":"1"}},{"labels":{"a":"2"}},{"labels":{"a":"3"}}]`,
+			expectedStatus: 400,
+		},
+		{
+			name:           "Test Large Body Fails With 413",
+			decider:        bouncer.ComplexityBudgetDecider(map[string]string{"budget": "1"}),
+			input:          `"` + strings.Repeat("a", 2048) + `"`,
+			expectedStatus: 413,
+		},
+	}
+
+	for _, testCase := range testCases {
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
+		status := 0
+		if response != nil {
+			status = response.Status
+		}
+
+		if status != testCase.expectedStatus {
+			t.Errorf("Test %s failed. Expected status %d got %d", testCase.name, testCase.expectedStatus, status)
+		}
+	}
+}
+
+func TestBackendPreflightDecider(t *testing.T) {
+	var healthy int32 = 1
+	var checks int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&checks, 1)
+		if atomic.LoadInt32(&healthy) == 0 {
+			w.WriteHeader(503)
+		}
+	}))
+	defer backend.Close()
+
+	request := func(decider bouncer.Decider, method string) *bouncer.HTTPError {
+		req := mustMakeRequest(t, method, "http://localhost/api/v2/silences", "")
+		req.Header = map[string][]string{}
+		return decider(req, context.Background())
+	}
+
+	uncached := bouncer.BackendPreflightDecider(map[string]string{"healthURL": backend.URL, "ttl": "0s"})
+	if err := request(uncached, "POST"); err != nil {
+		t.Errorf("Expected writes to pass while the backend is healthy, got %s", err.Err)
+	}
+
+	atomic.StoreInt32(&healthy, 0)
+	if err := request(uncached, "POST"); err == nil || err.Status != 503 {
+		t.Errorf("Expected writes to fail with a 503 while the backend is down, got %v", err)
+	}
+
+	if err := request(uncached, "GET"); err != nil {
+		t.Errorf("Expected reads not to be checked, got %s", err.Err)
+	}
+
+	if err := request(uncached, "post"); err == nil || err.Status != 503 {
+		t.Errorf("Expected methods to be matched case insensitively, got %v", err)
+	}
+
+	if err := request(uncached, "POST"); err == nil || strings.Contains(err.Err.Error(), backend.URL) || strings.Contains(err.Err.Error(), "503") {
+		t.Errorf("Expected the health check's error not to be sent to the client, got %v", err)
+	}
+
+	cached := bouncer.BackendPreflightDecider(map[string]string{"healthURL": backend.URL, "ttl": "1h"})
+	request(cached, "POST")
+	before := atomic.LoadInt32(&checks)
+	atomic.StoreInt32(&healthy, 1)
+	if err := request(cached, "POST"); err == nil {
+		t.Errorf("Expected the down state to be cached for the ttl")
+	}
+
+	if atomic.LoadInt32(&checks) != before {
+		t.Errorf("Expected the health check not to be repeated within the ttl")
+	}
+
+	// A request that's cancelled shouldn't make every other request think the backend is down
+	shared := bouncer.BackendPreflightDecider(map[string]string{"healthURL": backend.URL, "ttl": "1h"})
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+	req := mustMakeRequest(t, "POST", "http://localhost/api/v2/silences", "")
+	req.Header = map[string][]string{}
+	if err := shared(req, cancelled); err != nil {
+		t.Errorf("Expected the health check not to use the request's context, got %s", err.Err)
+	}
+
+	if err := request(shared, "POST"); err != nil {
+		t.Errorf("Expected writes to pass while the backend is healthy, got %s", err.Err)
+	}
+
+	if bouncer.BackendPreflightDecider(map[string]string{"healthURL": backend.URL, "ttl": "soon"}) != nil {
+		t.Errorf("Expected an invalid ttl to fail to construct a decider")
+	}
+}
+
+func TestRateLimitDecider(t *testing.T) {
+	decider := bouncer.RateLimitDecider(map[string]string{"rate": "0.001", "burst": "2"})
+	fromIP := func(ip string) *http.Request {
+		req := mustBuildRequest("", t)
+		req.RemoteAddr = ip + ":5000"
+		return req
+	}
+
+	for i := 0; i < 2; i++ {
+		if response := decider(fromIP("192.0.2.1"), context.Background()); response != nil {
+			t.Fatalf("Expected requests within the burst to pass, got %s", response.Err)
+		}
+	}
+
+	response := decider(fromIP("192.0.2.2"), context.Background())
+	if response == nil || response.Status != 429 {
+		t.Fatalf("Expected requests over the global limit to be rejected with a 429, got %v", response)
+	}
+
+	if retryAfter := response.Header.Get("Retry-After"); retryAfter == "" || retryAfter == "0" {
+		t.Errorf("Expected a Retry-After header, got %q", retryAfter)
+	}
+
+	perIP := bouncer.RateLimitDecider(map[string]string{"rate": "0.001", "burst": "1", "key": "ip"})
+	if response := perIP(fromIP("192.0.2.1"), context.Background()); response != nil {
+		t.Errorf("Expected the first request from an IP to pass, got %s", response.Err)
+	}
+
+	if response := perIP(fromIP("192.0.2.1"), context.Background()); response == nil {
+		t.Errorf("Expected the second request from an IP to be rejected")
+	}
+
+	if response := perIP(fromIP("192.0.2.2"), context.Background()); response != nil {
+		t.Errorf("Expected other IPs to have their own limit, got %s", response.Err)
+	}
+
+	// The limiter is shared by every request, so concurrent requests shouldn't get more than the burst between them
+	concurrent := bouncer.RateLimitDecider(map[string]string{"rate": "0.001", "burst": "10"})
+	var passed int32
+	done := make(chan struct{})
+	for i := 0; i < 50; i++ {
+		go func() {
+			if concurrent(mustBuildRequest("", t), context.Background()) == nil {
+				atomic.AddInt32(&passed, 1)
+			}
+			done <- struct{}{}
+		}()
+	}
+
+	for i := 0; i < 50; i++ {
+		<-done
+	}
+
+	if passed != 10 {
+		t.Errorf("Expected exactly the burst of 10 concurrent requests to pass, got %d", passed)
+	}
+
+	for _, config := range []map[string]string{
+		{"rate": "0", "burst": "1"},
+		{"rate": "cats", "burst": "1"},
+		{"rate": "1", "burst": "0"},
+		{"rate": "1", "burst": "1", "key": "user"},
+	} {
+		if bouncer.RateLimitDecider(config) != nil {
+			t.Errorf("Expected %v to fail to construct a decider", config)
+		}
+	}
+}
+
+func TestTimeWindowDecider(t *testing.T) {
+
+	decider := bouncer.TimeWindowDecider(map[string]string{"allow": "Mon-Fri 09:00-17:00; Sat 22:00-02:00", "timezone": "Pacific/Auckland"})
+	testCases := []struct {
+		name            string
+		now             string
+		expectedSuccess bool
+	}{
+		{"Test Weekday Business Hours Pass", "2020-01-21T10:00:00+13:00", true},
+		{"Test Start Of The Window Passes", "2020-01-21T09:00:00+13:00", true},
+		{"Test End Of The Window Fails", "2020-01-21T17:00:00+13:00", false},
+		{"Test Weekday Evening Fails", "2020-01-21T20:00:00+13:00", false},
+		{"Test Sunday Fails", "2020-01-19T10:00:00+13:00", false},
+		{"Test Times Are In The Timezone", "2020-01-20T22:00:00Z", true},
+		{"Test Overnight Windows Pass Before Midnight", "2020-01-25T23:00:00+13:00", true},
+		{"Test Overnight Windows Wrap Into The Next Week", "2020-01-26T01:00:00+13:00", true},
+		{"Test Overnight Windows End", "2020-01-26T02:00:00+13:00", false},
+	}
+
+	for _, testCase := range testCases {
+		now, err := time.Parse(time.RFC3339, testCase.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		restore := bouncer.SetClock(func() time.Time { return now })
+		response := decider(mustBuildRequest("", t), context.Background())
+		restore()
+		if (response == nil) != testCase.expectedSuccess {
+			t.Errorf("Test '%s' failed - expected success to be %t, got %v", testCase.name, testCase.expectedSuccess, response)
+		}
+
+		if response != nil && response.Status != 403 {
+			t.Errorf("Test '%s' failed - expected a 403, got a %d", testCase.name, response.Status)
+		}
+	}
+
+	for _, config := range []map[string]string{
+		{"allow": ""},
+		{"allow": "Mon-Fri"},
+		{"allow": "Mon-Funday 09:00-17:00"},
+		{"allow": "Mon 9am-5pm"},
+		{"allow": "Mon 09:00-25:00"},
+		{"allow": "Mon 09:00-09:00"},
+		{"allow": "Mon-Fri 09:00-17:00", "timezone": "Mars/Olympus_Mons"},
+	} {
+		if bouncer.TimeWindowDecider(config) != nil {
+			t.Errorf("Expected %v to fail to construct a decider", config)
+		}
+	}
+}
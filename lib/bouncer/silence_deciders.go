@@ -0,0 +1,980 @@
+package bouncer
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// silenceCouldCover returns whether the given silence matchers could silence an alert
+// identified by the given labels. Matchers on labels that we know the value of must match
+// that value, but matchers on any other label are assumed to be able to match, as the
+// alert could carry any value for it. i.e. a silence only avoids covering the alert if at least
+// one of its matchers definitely excludes it
+func silenceCouldCover(matchers []matcher, labels map[string]string) (bool, error) {
+	for _, m := range matchers {
+		value, known := labels[m.Name]
+		if !known {
+			continue
+		}
+
+		matches, err := m.Matches(value)
+		if err != nil {
+			return false, err
+		}
+
+		if !matches {
+			return false, nil
+		}
+	}
+
+	return true, nil
+}
+
+// ProtectSelfMonitoringDecider returns a Decider which rejects silences that could
+// silence the alerts that monitor the bouncer itself. "selectors" is a semicolon
+// separated list of label sets (e.g. `job=alertmanager_bouncer;alertname=BouncerDown`)
+// identifying those alerts. A silence is rejected if it could cover any of them, as
+// evaluated by silenceCouldCover
+func ProtectSelfMonitoringDecider(config map[string]string) Decider {
+	return deciderOrNil("protect_self_monitoring", newProtectSelfMonitoringDecider, config)
+}
+
+func newProtectSelfMonitoringDecider(config DeciderConfig) (Decider, error) {
+	selectors, err := parseLabelSelectors(config["selectors"])
+	if err != nil {
+		return nil, fmt.Errorf("selectors: %s", err)
+	}
+
+	protected := make([]map[string]string, len(selectors))
+	for i, selector := range selectors {
+		protected[i] = map[string]string{}
+		for _, m := range selector {
+			if m.IsRegex || !m.isEqual() {
+				return nil, fmt.Errorf("selectors: %s must be an equality matcher", m.Name)
+			}
+
+			protected[i][m.Name] = m.Value
+		}
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		silence, err := parseAlertmanagerSilence(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		for _, labels := range protected {
+			covers, err := silenceCouldCover(silence.Matchers, labels)
+			if err != nil {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("Invalid silence matcher: %s", err),
+				}
+			}
+
+			if covers {
+				return &HTTPError{
+					Status: 403,
+					Err:    fmt.Errorf("This silence could silence the alerts monitoring the bouncer itself (%v), which isn't allowed", labels),
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// MatcherOperatorAllowlistDecider returns a Decider which rejects silences using matcher operators
+// that aren't in the comma separated "allowed" list, e.g. `=,=~` to forbid the error prone negative matchers
+func MatcherOperatorAllowlistDecider(config map[string]string) Decider {
+	return deciderOrNil("matcher_operator_allowlist", newMatcherOperatorAllowlistDecider, config)
+}
+
+func newMatcherOperatorAllowlistDecider(config DeciderConfig) (Decider, error) {
+	allowed := map[string]bool{}
+	for _, operator := range parseConfigList(config["allowed"]) {
+		if operator != "=" && operator != "!=" && operator != "=~" && operator != "!~" {
+			return nil, fmt.Errorf("allowed: %s is not one of =, !=, =~ or !~", operator)
+		}
+
+		allowed[operator] = true
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		silence, err := parseAlertmanagerSilence(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		for _, m := range silence.Matchers {
+			if !allowed[m.operator()] {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("Matcher %s uses the %s operator, but only %s are allowed", m, m.operator(), config["allowed"]),
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// MatcherLabelPatternDecider returns a Decider which rejects silences with a matcher on a label whose name
+// doesn't match the "pattern" regex, e.g. `^teamA_` to limit a team to silencing their own labels. Note that
+// the pattern isn't anchored for you
+func MatcherLabelPatternDecider(config map[string]string) Decider {
+	return deciderOrNil("matcher_label_pattern", newMatcherLabelPatternDecider, config)
+}
+
+func newMatcherLabelPatternDecider(config DeciderConfig) (Decider, error) {
+	pattern, err := regexp.Compile(config["pattern"])
+	if err != nil {
+		return nil, fmt.Errorf("pattern: %s", err)
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		silence, err := parseAlertmanagerSilence(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		for _, m := range silence.Matchers {
+			if !pattern.MatchString(m.Name) {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("Silence matchers can only use labels matching %s. Got %s", pattern, m.Name),
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// MatcherRegexRatioDecider returns a Decider which rejects silences where more than "maxRatio" (between 0 and 1) of the matchers
+// are regex matchers, as regex heavy silences tend to be broader than intended. e.g. with a maxRatio of 0.5, a silence could
+// have one regex matcher and one equality matcher, but not two regex matchers. Silences without any matchers have a ratio of 0
+func MatcherRegexRatioDecider(config map[string]string) Decider {
+	return deciderOrNil("matcher_regex_ratio", newMatcherRegexRatioDecider, config)
+}
+
+func newMatcherRegexRatioDecider(config DeciderConfig) (Decider, error) {
+	maxRatio, err := strconv.ParseFloat(config["maxRatio"], 64)
+	if err != nil || maxRatio < 0 || maxRatio > 1 {
+		return nil, fmt.Errorf("maxRatio: %s is not a number between 0 and 1", config["maxRatio"])
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		silence, err := parseAlertmanagerSilence(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		if len(silence.Matchers) == 0 {
+			return nil
+		}
+
+		regexMatchers := 0
+		for _, m := range silence.Matchers {
+			if m.IsRegex {
+				regexMatchers++
+			}
+		}
+
+		if ratio := float64(regexMatchers) / float64(len(silence.Matchers)); ratio > maxRatio {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("%d of this silence's %d matchers are regexes, but at most %g%% may be. Try replacing some with equality matchers", regexMatchers, len(silence.Matchers), maxRatio*100),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// matchersKey returns a key which is equal for two sets of matchers iff they match the same alerts
+// in the same way, regardless of the order they're given in
+func matchersKey(matchers []matcher) string {
+	parts := make([]string, len(matchers))
+	for i, m := range matchers {
+		parts[i] = m.String()
+	}
+	sort.Strings(parts)
+
+	return strings.Join(parts, ",")
+}
+
+// SilenceRenewalGuardDecider returns a Decider which stops silences being recreated just before they expire.
+// New silences (those without an ID) are rejected with a 409 if the Alertmanager at "alertmanagerURL" already has an active
+// silence with the same matchers with more than "minRemaining" (default 1h) left on it, pointing at that silence so it can be
+// updated instead. If the Alertmanager can't be queried within the "timeout" (default 5s), the silence is let through
+func SilenceRenewalGuardDecider(config map[string]string) Decider {
+	return deciderOrNil("silence_renewal_guard", newSilenceRenewalGuardDecider, config)
+}
+
+func newSilenceRenewalGuardDecider(config DeciderConfig) (Decider, error) {
+	alertmanagerURL := config["alertmanagerURL"]
+	minRemaining := time.Hour
+	timeout := 5 * time.Second
+	for name, value := range map[string]*time.Duration{"minRemaining": &minRemaining, "timeout": &timeout} {
+		if config[name] == "" {
+			continue
+		}
+
+		parsed, err := time.ParseDuration(config[name])
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		*value = parsed
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		silence, err := parseAlertmanagerSilence(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		if silence.ID != "" {
+			// Updating an existing silence is exactly what we want people to do
+			return nil
+		}
+
+		existing, err := fetchSilences(context, alertmanagerURL, timeout)
+		if err != nil {
+			currentLogger().Warn("Failed to check for existing silences, letting the silence through", "decider", "silence_renewal_guard", "error", err.Error())
+			return nil
+		}
+
+		key := matchersKey(silence.Matchers)
+		now := time.Now()
+		for _, other := range existing {
+			if other.Status.State != "active" || matchersKey(other.Matchers) != key {
+				continue
+			}
+
+			endsAt, err := time.Parse(time.RFC3339, other.EndsAt)
+			if err != nil {
+				continue
+			}
+
+			if remaining := endsAt.Sub(now); remaining > minRemaining {
+				return &HTTPError{
+					Status: 409,
+					Err:    fmt.Errorf("Silence %s already silences these matchers for another %s. Update it instead of creating a new one", other.ID, remaining.Round(time.Second)),
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// RequireAnchorMatcherDecider returns a Decider which rejects silences that don't pin down at least one "anchor" label,
+// i.e. one that narrows a silence to a specific thing, with a non empty equality matcher. "anchors" is a comma separated list of
+// labels, each optionally weighted like `service:2`. Weights (default 1) of the anchored labels are summed, and must reach
+// "minWeight" (default 1), so that weaker anchors (e.g. `cluster:1`) can be required to be combined
+func RequireAnchorMatcherDecider(config map[string]string) Decider {
+	return deciderOrNil("require_anchor_matcher", newRequireAnchorMatcherDecider, config)
+}
+
+func newRequireAnchorMatcherDecider(config DeciderConfig) (Decider, error) {
+	anchors := map[string]int{}
+	var names []string
+	for _, anchor := range parseConfigList(config["anchors"]) {
+		name, weight := anchor, 1
+		if i := strings.LastIndex(anchor, ":"); i != -1 {
+			parsed, err := strconv.Atoi(anchor[i+1:])
+			if err != nil || parsed <= 0 {
+				return nil, fmt.Errorf("anchors: %s doesn't have a positive integer weight", anchor)
+			}
+			name, weight = anchor[:i], parsed
+		}
+
+		anchors[name] = weight
+		names = append(names, name)
+	}
+
+	if len(anchors) == 0 {
+		return nil, fmt.Errorf("anchors: at least one anchor is required")
+	}
+
+	minWeight := 1
+	if config["minWeight"] != "" {
+		parsed, err := strconv.Atoi(config["minWeight"])
+		if err != nil {
+			return nil, fmt.Errorf("minWeight: %s", err)
+		}
+		minWeight = parsed
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		silence, err := parseAlertmanagerSilence(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		weight := 0
+		anchored := map[string]bool{}
+		for _, m := range silence.Matchers {
+			if m.IsRegex || !m.isEqual() || m.Value == "" || anchored[m.Name] {
+				continue
+			}
+
+			if anchorWeight, ok := anchors[m.Name]; ok {
+				anchored[m.Name] = true
+				weight += anchorWeight
+			}
+		}
+
+		if weight < minWeight {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Silences must equality match anchor labels with a total weight of at least %d (got %d). Try adding a matcher on one of %s", minWeight, weight, strings.Join(names, ", ")),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// fingerprintWindow tracks the distinct fingerprints seen from each identity, forgetting
+// each fingerprint once it's older than the window
+type fingerprintWindow struct {
+	lock      sync.Mutex
+	window    time.Duration
+	seen      map[string]map[uint64]time.Time
+	lastPrune time.Time
+}
+
+func newFingerprintWindow(window time.Duration) *fingerprintWindow {
+	return &fingerprintWindow{
+		window: window,
+		seen:   map[string]map[uint64]time.Time{},
+	}
+}
+
+// add records the fingerprint for the given identity, unless that would give the identity more than limit
+// distinct fingerprints in the window. Returns whether it was recorded (or already had been)
+func (f *fingerprintWindow) add(identity string, fingerprint uint64, limit int, now time.Time) bool {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+
+	// Expired fingerprints of every identity are swept out at most once per window, so idle identities don't build up
+	if now.Sub(f.lastPrune) >= f.window {
+		for seenIdentity, fingerprints := range f.seen {
+			for seen, firstSeen := range fingerprints {
+				if now.Sub(firstSeen) >= f.window {
+					delete(fingerprints, seen)
+				}
+			}
+
+			if len(fingerprints) == 0 {
+				delete(f.seen, seenIdentity)
+			}
+		}
+		f.lastPrune = now
+	}
+
+	fingerprints := f.seen[identity]
+	for seen, firstSeen := range fingerprints {
+		if now.Sub(firstSeen) >= f.window {
+			delete(fingerprints, seen)
+		}
+	}
+
+	if _, ok := fingerprints[fingerprint]; ok {
+		return true
+	}
+
+	if len(fingerprints) >= limit {
+		return false
+	}
+
+	if fingerprints == nil {
+		fingerprints = map[uint64]time.Time{}
+		f.seen[identity] = fingerprints
+	}
+
+	fingerprints[fingerprint] = now
+	return true
+}
+
+// MatcherFingerprintRateDecider returns a Decider which rejects (with a 429) silences from an identity (taken from the
+// "identityHeader", default X-Forwarded-User) once it has created silences with "limit" distinct sets of matchers in the last "window".
+// Rapidly churning through slightly different matchers usually means a misbehaving client, whereas re-posting the same matchers
+// doesn't count against the limit. Requests without an identity share a single limit
+func MatcherFingerprintRateDecider(config map[string]string) Decider {
+	return deciderOrNil("matcher_fingerprint_rate", newMatcherFingerprintRateDecider, config)
+}
+
+func newMatcherFingerprintRateDecider(config DeciderConfig) (Decider, error) {
+	limit, err := strconv.Atoi(config["limit"])
+	if err != nil || limit <= 0 {
+		return nil, fmt.Errorf("limit: %s is not a positive integer", config["limit"])
+	}
+
+	window, err := time.ParseDuration(config["window"])
+	if err != nil {
+		return nil, fmt.Errorf("window: %s", err)
+	}
+
+	identityHeader := config["identityHeader"]
+	if identityHeader == "" {
+		identityHeader = "X-Forwarded-User"
+	}
+
+	seen := newFingerprintWindow(window)
+	return func(req *http.Request, context context.Context) *HTTPError {
+		silence, err := parseAlertmanagerSilence(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		hash := fnv.New64a()
+		hash.Write([]byte(matchersKey(silence.Matchers)))
+
+		identity := requestIdentity(req, identityHeader)
+		if !seen.add(identity, hash.Sum64(), limit, time.Now()) {
+			return &HTTPError{
+				Status: 429,
+				Err:    fmt.Errorf("Too many distinct silences. At most %d different sets of matchers can be silenced per %s", limit, window),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// RequireUpdateReasonDecider returns a Decider which requires updates to existing silences to explain why they were changed, for
+// the audit trail. Updates are silences with an ID, or that are PUT, and their comment must match the "reasonRegex" (default
+// `(?i)reason:\s*\S`, i.e. containing e.g. "Reason: extending until the migration finishes"). New silences don't need one
+func RequireUpdateReasonDecider(config map[string]string) Decider {
+	return deciderOrNil("require_update_reason", newRequireUpdateReasonDecider, config)
+}
+
+func newRequireUpdateReasonDecider(config DeciderConfig) (Decider, error) {
+	reasonRegexStr, ok := config["reasonRegex"]
+	if !ok {
+		reasonRegexStr = `(?i)reason:\s*\S`
+	}
+
+	reasonRegex, err := regexp.Compile(reasonRegexStr)
+	if err != nil {
+		return nil, fmt.Errorf("reasonRegex: %s", err)
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		silence, err := parseAlertmanagerSilence(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		if silence.ID == "" && req.Method != http.MethodPut {
+			return nil
+		}
+
+		if !reasonRegex.MatchString(silence.Comment) {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Updates to silences must give a reason for the change in the comment, matching %s", reasonRegex),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// MaxSilenceDurationDecider returns a Decider which rejects silences that last longer than the "maxDuration" (e.g. `72h`),
+// i.e. whose endsAt is more than maxDuration after their startsAt, so that silences can't be left to run for months
+func MaxSilenceDurationDecider(config map[string]string) Decider {
+	return deciderOrNil("max_silence_duration", newMaxSilenceDurationDecider, config)
+}
+
+func newMaxSilenceDurationDecider(config DeciderConfig) (Decider, error) {
+	maxDuration, err := config.GetDuration("maxDuration", 0)
+	if err != nil || maxDuration <= 0 {
+		return nil, fmt.Errorf("maxDuration: %s is not a positive duration", config["maxDuration"])
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Failed to read body"),
+			}
+		}
+
+		var silence alertmanagerSilenceSerialized
+		if err := json.Unmarshal(bodyBytes, &silence); err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Body is not a valid silence: %s", err),
+			}
+		}
+
+		times := map[string]time.Time{}
+		for _, field := range []struct {
+			name  string
+			value string
+		}{{"startsAt", silence.StartsAt}, {"endsAt", silence.EndsAt}} {
+			if field.value == "" {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("Silences must have a %s", field.name),
+				}
+			}
+
+			parsed, err := time.Parse(time.RFC3339, field.value)
+			if err != nil {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("%s %s is not a valid RFC3339 time string", field.name, field.value),
+				}
+			}
+			times[field.name] = parsed
+		}
+
+		if duration := times["endsAt"].Sub(times["startsAt"]); duration > maxDuration {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Silences can last at most %s, but this one lasts %s", maxDuration, duration),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// RequireSilenceMetadataDecider returns a Decider which rejects silences with a blank (empty or whitespace only) comment or
+// createdBy, so that every silence can be traced back to someone and a reason. Each is required unless "requireComment" or
+// "requireCreatedBy" respectively are "false"
+func RequireSilenceMetadataDecider(config map[string]string) Decider {
+	return deciderOrNil("require_silence_metadata", newRequireSilenceMetadataDecider, config)
+}
+
+func newRequireSilenceMetadataDecider(config DeciderConfig) (Decider, error) {
+	requireComment, err := config.GetBool("requireComment", true)
+	if err != nil {
+		return nil, fmt.Errorf("requireComment: %s", err)
+	}
+
+	requireCreatedBy, err := config.GetBool("requireCreatedBy", true)
+	if err != nil {
+		return nil, fmt.Errorf("requireCreatedBy: %s", err)
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		bodyBytes, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Failed to read body"),
+			}
+		}
+
+		var silence alertmanagerSilenceSerialized
+		if err := json.Unmarshal(bodyBytes, &silence); err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Body is not a valid silence: %s", err),
+			}
+		}
+
+		if requireComment && strings.TrimSpace(silence.Comment) == "" {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Silences must have a comment explaining why they were created"),
+			}
+		}
+
+		if requireCreatedBy && strings.TrimSpace(silence.Author) == "" {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Silences must have a createdBy saying who created them"),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// SilenceMatcherPolicyDecider returns a Decider which rejects overly broad silences. Silences with fewer than "minMatchers"
+// matchers (default 0, i.e. any number) are rejected, as are silences with a regex matcher whose value is `.*` or empty, which
+// matches every alert, unless "rejectMatchAll" is "false". Literal matchers with the same values only match those exact values, so are allowed
+func SilenceMatcherPolicyDecider(config map[string]string) Decider {
+	return deciderOrNil("silence_matcher_policy", newSilenceMatcherPolicyDecider, config)
+}
+
+func newSilenceMatcherPolicyDecider(config DeciderConfig) (Decider, error) {
+	minMatchers, err := config.GetInt("minMatchers", 0)
+	if err != nil || minMatchers < 0 {
+		return nil, fmt.Errorf("minMatchers: %s is not a non negative integer", config["minMatchers"])
+	}
+
+	rejectMatchAll, err := config.GetBool("rejectMatchAll", true)
+	if err != nil {
+		return nil, fmt.Errorf("rejectMatchAll: %s", err)
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		silence, err := parseAlertmanagerSilence(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		if len(silence.Matchers) < minMatchers {
+			return &HTTPError{
+				Status: 400,
+				Err:    fmt.Errorf("Silences must have at least %d matchers, but this one has %d", minMatchers, len(silence.Matchers)),
+			}
+		}
+
+		if !rejectMatchAll {
+			return nil
+		}
+
+		for _, m := range silence.Matchers {
+			if m.IsRegex && m.isEqual() && (m.Value == "" || m.Value == ".*") {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("Matcher %s matches every alert. Silences can't use match all regexes", m),
+				}
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// SilenceOwnerGuardDecider returns a Decider which only lets users expire (DELETE) silences they created. The silence's ID is
+// taken from the first capture group of "idRegex" (default `/api/v2/silence/([^/]+)$`) matched against the request path, and the
+// silence is fetched from the Alertmanager at "alertmanagerURL" to compare its createdBy with the user in the "identityHeader"
+// (default X-Forwarded-User). Silences that don't exist are let through for Alertmanager to 404, unless "missing" is "reject".
+// If the Alertmanager can't be queried within the "timeout" (default 5s), requests get a 503, unless "failOpen" is "true"
+func SilenceOwnerGuardDecider(config map[string]string) Decider {
+	return deciderOrNil("silence_owner_guard", newSilenceOwnerGuardDecider, config)
+}
+
+func newSilenceOwnerGuardDecider(config DeciderConfig) (Decider, error) {
+	alertmanagerURL := config.GetString("alertmanagerURL", "")
+	identityHeader := config.GetString("identityHeader", "X-Forwarded-User")
+
+	idRegex, err := regexp.Compile(config.GetString("idRegex", `/api/v2/silence/([^/]+)$`))
+	if err != nil {
+		return nil, fmt.Errorf("idRegex: %s", err)
+	}
+
+	if idRegex.NumSubexp() < 1 {
+		return nil, fmt.Errorf("idRegex: %s has no capture group for the silence ID", idRegex)
+	}
+
+	missing := config.GetString("missing", "allow")
+	if missing != "allow" && missing != "reject" {
+		return nil, fmt.Errorf("missing: %s is not allow or reject", missing)
+	}
+
+	timeout, err := config.GetDuration("timeout", 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("timeout: %s", err)
+	}
+
+	failOpen, err := config.GetBool("failOpen", false)
+	if err != nil {
+		return nil, fmt.Errorf("failOpen: %s", err)
+	}
+
+	return func(req *http.Request, context context.Context) *HTTPError {
+		match := idRegex.FindStringSubmatch(req.URL.Path)
+		if match == nil || match[1] == "" {
+			// Not a request for a single silence, so there's no owner to check
+			return nil
+		}
+
+		id := match[1]
+		user := requestIdentity(req, identityHeader)
+		if user == "" {
+			return &HTTPError{
+				Status: 403,
+				Err:    fmt.Errorf("Expiring silences requires a user in the %s header", identityHeader),
+			}
+		}
+
+		silence, err := fetchSilence(context, alertmanagerURL, id, timeout)
+		if err != nil {
+			if failOpen {
+				currentLogger().Warn("Failed to look up silence, letting the request through", "decider", "silence_owner_guard", "silence", id, "error", err.Error())
+				return nil
+			}
+
+			return &HTTPError{
+				Status: 503,
+				Err:    fmt.Errorf("Failed to look up the owner of silence %s", id),
+			}
+		}
+
+		if silence == nil {
+			if missing == "reject" {
+				return &HTTPError{
+					Status: 404,
+					Err:    fmt.Errorf("Silence %s doesn't exist", id),
+				}
+			}
+
+			return nil
+		}
+
+		if silence.Author != user {
+			return &HTTPError{
+				Status: 403,
+				Err:    fmt.Errorf("Silence %s was created by %s, so %s can't expire it", id, silence.Author, user),
+			}
+		}
+
+		return nil
+	}, nil
+}
+
+// activeSilenceCount caches the number of unexpired silences in an Alertmanager for a ttl. The count is refreshed by
+// at most one fetch at a time, without holding the lock, and requests that need it while it's being fetched wait for that fetch
+type activeSilenceCount struct {
+	lock      sync.Mutex
+	ttl       time.Duration
+	count     int
+	fetchedAt time.Time
+	inFlight  *silenceCountFetch
+
+	// reserved is the number of silences that have been let through, but that Alertmanager hasn't responded to yet.
+	// They're kept apart from the count so that refreshing it doesn't forget them
+	reserved int
+}
+
+// silenceCountFetch is a fetch of the silence count, shared by every request that's waiting on it
+type silenceCountFetch struct {
+	done  chan struct{}
+	count int
+	err   error
+}
+
+// refresh uses the given fetch to refresh the cached count, if it's older than the ttl
+func (a *activeSilenceCount) refresh(now time.Time, fetch func() (int, error)) error {
+	a.lock.Lock()
+	if !a.fetchedAt.IsZero() && now.Sub(a.fetchedAt) < a.ttl {
+		defer a.lock.Unlock()
+		return nil
+	}
+
+	if call := a.inFlight; call != nil {
+		a.lock.Unlock()
+		<-call.done
+		return call.err
+	}
+
+	call := &silenceCountFetch{done: make(chan struct{})}
+	a.inFlight = call
+	a.lock.Unlock()
+
+	call.count, call.err = fetch()
+
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	if call.err == nil {
+		a.count = call.count
+		a.fetchedAt = now
+	}
+	a.inFlight = nil
+	close(call.done)
+	return call.err
+}
+
+// reserve takes a slot for a new silence, returning false (and the number of silences) if there are already max of them,
+// counting the ones that have been reserved but not created yet. Every successful reserve must be followed by a release
+func (a *activeSilenceCount) reserve(max int) (int, bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	if total := a.count + a.reserved; total >= max {
+		return total, false
+	}
+
+	a.reserved++
+	return 0, true
+}
+
+// release gives up a reserved slot, counting the silence if it was created
+func (a *activeSilenceCount) release(created bool) {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	a.reserved--
+	if created {
+		a.count++
+	}
+}
+
+// MaxActiveSilencesDecider returns a Decider which caps the number of silences in the Alertmanager at "alertmanagerURL".
+// New silences (those without an ID) are rejected with a 429 once there are "max" unexpired (active or pending) silences.
+// The count is cached for the "cacheTTL" (default 10s). Each new silence that's let through reserves a slot until Alertmanager has
+// responded, and silences that it accepts (with a 2xx) are added to the count, so that a burst of silences within the cacheTTL can't
+// overshoot the max. If the Alertmanager can't be queried within the "timeout" (default 5s), new silences get a 503, unless "failOpen" is "true"
+func MaxActiveSilencesDecider(config map[string]string) Decider {
+	return deciderOrNil("max_active_silences", newMaxActiveSilencesDecider, config)
+}
+
+func newMaxActiveSilencesDecider(config DeciderConfig) (Decider, error) {
+	alertmanagerURL := config.GetString("alertmanagerURL", "")
+
+	max, err := config.GetInt("max", 0)
+	if err != nil {
+		return nil, fmt.Errorf("max: %s", err)
+	}
+
+	if max < 0 {
+		return nil, fmt.Errorf("max: %d is negative", max)
+	}
+
+	cacheTTL, err := config.GetDuration("cacheTTL", 10*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("cacheTTL: %s", err)
+	}
+
+	timeout, err := config.GetDuration("timeout", 5*time.Second)
+	if err != nil {
+		return nil, fmt.Errorf("timeout: %s", err)
+	}
+
+	failOpen, err := config.GetBool("failOpen", false)
+	if err != nil {
+		return nil, fmt.Errorf("failOpen: %s", err)
+	}
+
+	active := &activeSilenceCount{ttl: cacheTTL}
+	return func(req *http.Request, _ context.Context) *HTTPError {
+		silence, err := parseAlertmanagerSilence(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		if silence.ID != "" {
+			// Updates replace an existing silence, so they don't add to the count
+			return nil
+		}
+
+		err = active.refresh(time.Now(), func() (int, error) {
+			// The count is shared by every request, so it mustn't be cut short by this request being cancelled
+			silences, err := fetchSilences(context.Background(), alertmanagerURL, timeout)
+			if err != nil {
+				return 0, err
+			}
+
+			count := 0
+			for _, other := range silences {
+				if other.Status.State != "expired" {
+					count++
+				}
+			}
+
+			return count, nil
+		})
+
+		if err != nil {
+			if failOpen {
+				currentLogger().Warn("Failed to count active silences, letting the silence through", "decider", "max_active_silences", "error", err.Error())
+				return nil
+			}
+
+			return &HTTPError{
+				Status: 503,
+				Err:    fmt.Errorf("Failed to count the active silences"),
+			}
+		}
+
+		count, ok := active.reserve(max)
+		if !ok {
+			return &HTTPError{
+				Status: 429,
+				Err:    fmt.Errorf("There are already %d active silences, which is the most allowed. Expire some before creating more", count),
+			}
+		}
+
+		// Only count the silence once Alertmanager has created it, as bouncers after this one (or Alertmanager) could still reject it
+		if !OnResponse(req, func(resp *http.Response, err error) {
+			active.release(err == nil && resp.StatusCode >= 200 && resp.StatusCode <= 299)
+		}) {
+			// There won't be a response to wait for, so there's no way of telling whether the silence gets created
+			active.release(false)
+		}
+
+		return nil
+	}, nil
+}
+
+// ValidateSilenceRegexDecider returns a Decider which rejects silences with a regex matcher (=~ or !~) whose value doesn't compile,
+// with a 400 naming the matcher and the compile error, rather than leaving Alertmanager to reject it less clearly. Values are compiled
+// fully anchored, as Alertmanager does. Literal matchers aren't checked
+func ValidateSilenceRegexDecider(config map[string]string) Decider {
+	return func(req *http.Request, context context.Context) *HTTPError {
+		silence, err := parseAlertmanagerSilence(req.Body)
+		if err != nil {
+			return &HTTPError{
+				Status: 400,
+				Err:    err,
+			}
+		}
+
+		for _, m := range silence.Matchers {
+			if !m.IsRegex {
+				continue
+			}
+
+			if _, err := regexp.Compile("^(?:" + m.Value + ")$"); err != nil {
+				return &HTTPError{
+					Status: 400,
+					Err:    fmt.Errorf("Matcher %s has an invalid regex: %s", m, err),
+				}
+			}
+		}
+
+		return nil
+	}
+}
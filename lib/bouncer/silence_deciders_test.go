@@ -0,0 +1,956 @@
+package bouncer_test
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sinkingpoint/alertmanager_bouncer/lib/bouncer"
+)
+
+func TestProtectSelfMonitoringDecider(t *testing.T) {
+	config := map[string]string{"selectors": "job=alertmanager_bouncer,alertname=BouncerDown;alertname=BouncerRejectingEverything"}
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Unrelated Silence Passes",
+			decider:         bouncer.ProtectSelfMonitoringDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"alertname","value":"InstanceDown","isRegex":false}]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Exact Silence Fails",
+			decider:         bouncer.ProtectSelfMonitoringDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"alertname","value":"BouncerDown","isRegex":false}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Regex Silence Fails",
+			decider:         bouncer.ProtectSelfMonitoringDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"alertname","value":"Bouncer.*","isRegex":true}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Negative Matcher Fails",
+			decider:         bouncer.ProtectSelfMonitoringDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"alertname","value":"InstanceDown","isRegex":false,"isEqual":false}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Matcher On Unknown Label Fails",
+			decider:         bouncer.ProtectSelfMonitoringDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"instance","value":"localhost","isRegex":false}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Excluding Regex Passes",
+			decider:         bouncer.ProtectSelfMonitoringDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"instance","value":"localhost","isRegex":false},{"name":"alertname","value":"Bouncer.*","isRegex":true,"isEqual":false}]}`,
+			expectedSuccess: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+
+	if bouncer.ProtectSelfMonitoringDecider(map[string]string{"selectors": "alertname=~Bouncer.*"}) != nil {
+		t.Errorf("Expected a regex selector to fail to construct a decider")
+	}
+}
+
+func TestMatcherOperatorAllowlistDecider(t *testing.T) {
+	config := map[string]string{"allowed": "=, =~"}
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Positive Matchers Pass",
+			decider:         bouncer.MatcherOperatorAllowlistDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"a","value":"b","isRegex":false,"isEqual":true},{"name":"c","value":"d.*","isRegex":true}]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Not Equal Matcher Fails",
+			decider:         bouncer.MatcherOperatorAllowlistDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"a","value":"b","isRegex":false,"isEqual":false}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Negative Regex Matcher Fails",
+			decider:         bouncer.MatcherOperatorAllowlistDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"a","value":"b","isRegex":true,"isEqual":false}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Regex Can Be Forbidden",
+			decider:         bouncer.MatcherOperatorAllowlistDecider(map[string]string{"allowed": "="}),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"a","value":"b","isRegex":true}]}`,
+			expectedSuccess: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+
+	if bouncer.MatcherOperatorAllowlistDecider(map[string]string{"allowed": "==="}) != nil {
+		t.Errorf("Expected an invalid operator to fail to construct a decider")
+	}
+}
+
+func TestMatcherLabelPatternDecider(t *testing.T) {
+	config := map[string]string{"pattern": "^teamA_"}
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Matching Labels Pass",
+			decider:         bouncer.MatcherLabelPatternDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"teamA_service","value":"web","isRegex":false},{"name":"teamA_env","value":"prod","isRegex":false}]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Non Matching Label Fails",
+			decider:         bouncer.MatcherLabelPatternDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"teamA_service","value":"web","isRegex":false},{"name":"alertname","value":"InstanceDown","isRegex":false}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Prefix Must Be At Start",
+			decider:         bouncer.MatcherLabelPatternDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"not_teamA_service","value":"web","isRegex":false}]}`,
+			expectedSuccess: false,
+		},
+	}
+
+	for _, testCase := range testCases {
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+
+	if bouncer.MatcherLabelPatternDecider(map[string]string{"pattern": "("}) != nil {
+		t.Errorf("Expected an invalid pattern to fail to construct a decider")
+	}
+}
+
+func TestSilenceRenewalGuardDecider(t *testing.T) {
+	endsAt := time.Now().Add(48 * time.Hour).Format(time.RFC3339)
+	soon := time.Now().Add(10 * time.Minute).Format(time.RFC3339)
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/silences" {
+			w.WriteHeader(404)
+			return
+		}
+
+		fmt.Fprintf(w, `[
+			{"id":"long","status":{"state":"active"},"endsAt":"%s","matchers":[{"name":"a","value":"b","isRegex":false},{"name":"c","value":"d","isRegex":true}]},
+			{"id":"short","status":{"state":"active"},"endsAt":"%s","matchers":[{"name":"e","value":"f","isRegex":false}]},
+			{"id":"expired","status":{"state":"expired"},"endsAt":"%s","matchers":[{"name":"g","value":"h","isRegex":false}]}
+		]`, endsAt, soon, endsAt)
+	}))
+	defer backend.Close()
+
+	decider := bouncer.SilenceRenewalGuardDecider(map[string]string{"alertmanagerURL": backend.URL})
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test New Matchers Pass",
+			decider:         decider,
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"a","value":"b","isRegex":false}]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Duplicate Of Long Silence Fails",
+			decider:         decider,
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"c","value":"d","isRegex":true},{"name":"a","value":"b","isRegex":false}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Updating Long Silence Passes",
+			decider:         decider,
+			input:           `{"id":"long","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"c","value":"d","isRegex":true},{"name":"a","value":"b","isRegex":false}]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Duplicate Of Expiring Silence Passes",
+			decider:         decider,
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"e","value":"f","isRegex":false}]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Duplicate Of Expired Silence Passes",
+			decider:         decider,
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"g","value":"h","isRegex":false}]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Unreachable Alertmanager Passes",
+			decider:         bouncer.SilenceRenewalGuardDecider(map[string]string{"alertmanagerURL": backend.URL + "/nothing"}),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"a","value":"b","isRegex":false},{"name":"c","value":"d","isRegex":true}]}`,
+			expectedSuccess: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+}
+
+func TestRequireAnchorMatcherDecider(t *testing.T) {
+	config := map[string]string{"anchors": "service:2, instance:2, cluster", "minWeight": "2"}
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Strong Anchor Passes",
+			decider:         bouncer.RequireAnchorMatcherDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"service","value":"web","isRegex":false}]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Weak Anchor Alone Fails",
+			decider:         bouncer.RequireAnchorMatcherDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"cluster","value":"prod","isRegex":false},{"name":"alertname","value":"Foo","isRegex":false}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Repeated Weak Anchor Fails",
+			decider:         bouncer.RequireAnchorMatcherDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"cluster","value":"prod","isRegex":false},{"name":"cluster","value":"prod","isRegex":false}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Regex Anchor Fails",
+			decider:         bouncer.RequireAnchorMatcherDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"service","value":"web.*","isRegex":true}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Negative Anchor Fails",
+			decider:         bouncer.RequireAnchorMatcherDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"service","value":"web","isRegex":false,"isEqual":false}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Default Weight Passes With One Anchor",
+			decider:         bouncer.RequireAnchorMatcherDecider(map[string]string{"anchors": "service,instance"}),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"instance","value":"host:9100","isRegex":false}]}`,
+			expectedSuccess: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+
+	if bouncer.RequireAnchorMatcherDecider(map[string]string{"anchors": "service:heavy"}) != nil {
+		t.Errorf("Expected an invalid weight to fail to construct a decider")
+	}
+}
+
+func TestMatcherFingerprintRateDecider(t *testing.T) {
+	decider := bouncer.MatcherFingerprintRateDecider(map[string]string{"limit": "2", "window": "1h"})
+	silence := func(value string) string {
+		return fmt.Sprintf(`{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"instance","value":"%s","isRegex":false}]}`, value)
+	}
+
+	request := func(user string, value string) *bouncer.HTTPError {
+		req := mustBuildRequest(silence(value), t)
+		req.Header.Set("X-Forwarded-User", user)
+		return decider(req, context.Background())
+	}
+
+	for _, value := range []string{"a", "b", "a", "b"} {
+		if err := request("alice", value); err != nil {
+			t.Errorf("Expected fingerprints within the limit to pass, got %s", err.Err)
+		}
+	}
+
+	if err := request("alice", "c"); err == nil || err.Status != 429 {
+		t.Errorf("Expected a 429 for a third distinct fingerprint, got %v", err)
+	}
+
+	if err := request("bob", "c"); err != nil {
+		t.Errorf("Expected the limit to be per identity, got %s", err.Err)
+	}
+
+	expiring := bouncer.MatcherFingerprintRateDecider(map[string]string{"limit": "1", "window": "1ns"})
+	for _, value := range []string{"a", "b"} {
+		if err := expiring(mustBuildRequest(silence(value), t), context.Background()); err != nil {
+			t.Errorf("Expected fingerprints outside the window to be forgotten, got %s", err.Err)
+		}
+	}
+
+	if bouncer.MatcherFingerprintRateDecider(map[string]string{"limit": "0", "window": "1h"}) != nil {
+		t.Errorf("Expected a non positive limit to fail to construct a decider")
+	}
+}
+
+func TestMatcherRegexRatioDecider(t *testing.T) {
+	config := map[string]string{"maxRatio": "0.5"}
+	testCases := []struct {
+		name            string
+		decider         bouncer.Decider
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Ratio At Limit Passes",
+			decider:         bouncer.MatcherRegexRatioDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"a","value":"b.*","isRegex":true},{"name":"c","value":"d","isRegex":false}]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Ratio Over Limit Fails",
+			decider:         bouncer.MatcherRegexRatioDecider(config),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"a","value":"b.*","isRegex":true},{"name":"c","value":"d.*","isRegex":true},{"name":"e","value":"f","isRegex":false}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Zero Ratio Forbids Any Regex",
+			decider:         bouncer.MatcherRegexRatioDecider(map[string]string{"maxRatio": "0"}),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"a","value":"b.*","isRegex":true},{"name":"c","value":"d","isRegex":false}]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test No Matchers Passes",
+			decider:         bouncer.MatcherRegexRatioDecider(map[string]string{"maxRatio": "0"}),
+			input:           `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+
+	for _, maxRatio := range []string{"1.5", "-0.1", "half"} {
+		if bouncer.MatcherRegexRatioDecider(map[string]string{"maxRatio": maxRatio}) != nil {
+			t.Errorf("Expected maxRatio %s to fail to construct a decider", maxRatio)
+		}
+	}
+}
+
+func TestRequireUpdateReasonDecider(t *testing.T) {
+	testCases := []struct {
+		name            string
+		method          string
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test New Silence Passes",
+			method:          "POST",
+			input:           `{"comment":"maintenance","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Update Without Reason Fails",
+			method:          "POST",
+			input:           `{"id":"abc","comment":"maintenance","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Update With Reason Passes",
+			method:          "POST",
+			input:           `{"id":"abc","comment":"maintenance. Reason: migration overran","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test PUT Without Reason Fails",
+			method:          "PUT",
+			input:           `{"comment":"maintenance","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: false,
+		},
+	}
+
+	decider := bouncer.RequireUpdateReasonDecider(map[string]string{})
+	for _, testCase := range testCases {
+		req := mustMakeRequest(t, testCase.method, "http://localhost/api/v2/silences", testCase.input)
+		response := decider(req, context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+
+	if bouncer.RequireUpdateReasonDecider(map[string]string{"reasonRegex": "("}) != nil {
+		t.Errorf("Expected an invalid reasonRegex to fail to construct a decider")
+	}
+}
+
+func TestMaxSilenceDurationDecider(t *testing.T) {
+	testCases := []struct {
+		name            string
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Short Silence Passes",
+			input:           `{"comment":"maintenance","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Silence At The Limit Passes",
+			input:           `{"comment":"maintenance","startsAt":"2020-01-21T00:00:00Z", "endsAt":"2020-01-24T00:00:00Z", "matchers":[]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Long Silence Fails",
+			input:           `{"comment":"maintenance","startsAt":"2020-01-21T00:00:00Z", "endsAt":"2020-04-21T00:00:00Z", "matchers":[]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Missing endsAt Fails",
+			input:           `{"comment":"maintenance","startsAt":"2020-01-21T00:00:00Z", "matchers":[]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Malformed JSON Fails",
+			input:           `{"comment":"maintenance",`,
+			expectedSuccess: false,
+		},
+	}
+
+	decider := bouncer.MaxSilenceDurationDecider(map[string]string{"maxDuration": "72h"})
+	for _, testCase := range testCases {
+		response := decider(mustBuildRequest(testCase.input, t), context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+
+		if response != nil && response.Status != 400 {
+			t.Errorf("Test %s failed. Expected a 400, got a %d", testCase.name, response.Status)
+		}
+	}
+
+	if bouncer.MaxSilenceDurationDecider(map[string]string{"maxDuration": "forever"}) != nil {
+		t.Errorf("Expected an invalid maxDuration to fail to construct a decider")
+	}
+}
+
+func TestRequireSilenceMetadataDecider(t *testing.T) {
+	testCases := []struct {
+		name            string
+		config          map[string]string
+		input           string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Complete Silence Passes",
+			config:          map[string]string{},
+			input:           `{"comment":"maintenance","createdBy":"colin","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Blank Comment Fails",
+			config:          map[string]string{},
+			input:           `{"comment":"  ","createdBy":"colin","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Missing createdBy Fails",
+			config:          map[string]string{},
+			input:           `{"comment":"maintenance","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Update Without Comment Fails",
+			config:          map[string]string{},
+			input:           `{"id":"abc","comment":"","createdBy":"colin","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Update With Metadata Passes",
+			config:          map[string]string{},
+			input:           `{"id":"abc","comment":"extending","createdBy":"colin","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Disabled Comment Check Passes",
+			config:          map[string]string{"requireComment": "false"},
+			input:           `{"comment":"","createdBy":"colin","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Disabled createdBy Check Passes",
+			config:          map[string]string{"requireCreatedBy": "false"},
+			input:           `{"comment":"maintenance","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`,
+			expectedSuccess: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		b := bouncer.Bouncer{
+			Deciders: []bouncer.Decider{bouncer.RequireSilenceMetadataDecider(testCase.config)},
+		}
+
+		req := mustMakeRequest(t, "POST", "http://localhost/api/v2/silences", testCase.input)
+		response := b.Bounce(req)
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+
+		if forwarded, _ := ioutil.ReadAll(req.Body); string(forwarded) != testCase.input {
+			t.Errorf("Test %s failed. Expected the body to be left intact, got %s", testCase.name, forwarded)
+		}
+	}
+
+	if bouncer.RequireSilenceMetadataDecider(map[string]string{"requireComment": "maybe"}) != nil {
+		t.Errorf("Expected an invalid requireComment to fail to construct a decider")
+	}
+}
+
+func TestSilenceMatcherPolicyDecider(t *testing.T) {
+	testCases := []struct {
+		name            string
+		config          map[string]string
+		matchers        string
+		expectedSuccess bool
+	}{
+		{
+			name:            "Test Specific Silence Passes",
+			config:          map[string]string{"minMatchers": "2"},
+			matchers:        `[{"name":"alertname","value":"HighLatency","isRegex":false},{"name":"service","value":"api.*","isRegex":true}]`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Too Few Matchers Fails",
+			config:          map[string]string{"minMatchers": "2"},
+			matchers:        `[{"name":"alertname","value":"HighLatency","isRegex":false}]`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Match All Regex Fails",
+			config:          map[string]string{},
+			matchers:        `[{"name":"alertname","value":".*","isRegex":true}]`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Empty Regex Fails",
+			config:          map[string]string{},
+			matchers:        `[{"name":"service","value":"api","isRegex":false},{"name":"alertname","value":"","isRegex":true}]`,
+			expectedSuccess: false,
+		},
+		{
+			name:            "Test Literal Match All Value Passes",
+			config:          map[string]string{},
+			matchers:        `[{"name":"alertname","value":".*","isRegex":false}]`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Negative Match All Regex Passes",
+			config:          map[string]string{},
+			matchers:        `[{"name":"service","value":"api","isRegex":false},{"name":"alertname","value":".*","isRegex":true,"isEqual":false}]`,
+			expectedSuccess: true,
+		},
+		{
+			name:            "Test Disabled Match All Check Passes",
+			config:          map[string]string{"rejectMatchAll": "false"},
+			matchers:        `[{"name":"alertname","value":".*","isRegex":true}]`,
+			expectedSuccess: true,
+		},
+	}
+
+	for _, testCase := range testCases {
+		decider := bouncer.SilenceMatcherPolicyDecider(testCase.config)
+		input := fmt.Sprintf(`{"comment":"maintenance","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":%s}`, testCase.matchers)
+		response := decider(mustBuildRequest(input, t), context.Background())
+		if (response == nil) != testCase.expectedSuccess {
+			var errorText string
+			if response != nil {
+				errorText = response.Err.Error()
+			} else {
+				errorText = ""
+			}
+			t.Errorf("Test %s failed. Expected %t got %t. Debug: %s", testCase.name, testCase.expectedSuccess, !testCase.expectedSuccess, errorText)
+		}
+	}
+
+	if bouncer.SilenceMatcherPolicyDecider(map[string]string{"minMatchers": "-1"}) != nil {
+		t.Errorf("Expected an invalid minMatchers to fail to construct a decider")
+	}
+}
+
+func TestSilenceOwnerGuardDecider(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v2/silence/mine":
+			fmt.Fprint(w, `{"id":"mine","createdBy":"colin","status":{"state":"active"}}`)
+		case "/api/v2/silence/broken":
+			w.WriteHeader(500)
+		default:
+			w.WriteHeader(404)
+		}
+	}))
+	defer backend.Close()
+
+	decider := bouncer.SilenceOwnerGuardDecider(map[string]string{"alertmanagerURL": backend.URL})
+	testCases := []struct {
+		name           string
+		decider        bouncer.Decider
+		path           string
+		user           string
+		expectedStatus int
+	}{
+		{"Test Owners Can Expire Their Silences", decider, "/api/v2/silence/mine", "colin", 0},
+		{"Test Others Can't Expire Silences", decider, "/api/v2/silence/mine", "someone", 403},
+		{"Test Requests Without A User Fail", decider, "/api/v2/silence/mine", "", 403},
+		{"Test Missing Silences Pass By Default", decider, "/api/v2/silence/gone", "colin", 0},
+		{"Test Missing Silences Can Be Rejected", bouncer.SilenceOwnerGuardDecider(map[string]string{"alertmanagerURL": backend.URL, "missing": "reject"}), "/api/v2/silence/gone", "colin", 404},
+		{"Test Lookup Failures Fail Closed", decider, "/api/v2/silence/broken", "colin", 503},
+		{"Test Lookup Failures Can Fail Open", bouncer.SilenceOwnerGuardDecider(map[string]string{"alertmanagerURL": backend.URL, "failOpen": "true"}), "/api/v2/silence/broken", "colin", 0},
+		{"Test Other Paths Pass", decider, "/api/v2/silences", "someone", 0},
+		{"Test Custom ID Regexes Are Used", bouncer.SilenceOwnerGuardDecider(map[string]string{"alertmanagerURL": backend.URL, "idRegex": `^/am/silence/(\w+)$`}), "/am/silence/mine", "someone", 403},
+	}
+
+	for _, testCase := range testCases {
+		req := httptest.NewRequest("DELETE", "http://localhost"+testCase.path, nil)
+		if testCase.user != "" {
+			req.Header.Set("X-Forwarded-User", testCase.user)
+		}
+
+		response := testCase.decider(req, context.Background())
+		status := 0
+		if response != nil {
+			status = response.Status
+		}
+
+		if status != testCase.expectedStatus {
+			t.Errorf("Test '%s' failed - expected status %d, got %v", testCase.name, testCase.expectedStatus, response)
+		}
+	}
+
+	for _, invalid := range []map[string]string{
+		{"alertmanagerURL": backend.URL, "idRegex": "/api/v2/silence/.*"},
+		{"alertmanagerURL": backend.URL, "missing": "ignore"},
+		{"alertmanagerURL": backend.URL, "timeout": "soon"},
+	} {
+		if bouncer.SilenceOwnerGuardDecider(invalid) != nil {
+			t.Errorf("Expected %v to fail to construct a decider", invalid)
+		}
+	}
+}
+
+func TestMaxActiveSilencesDecider(t *testing.T) {
+	fetches := 0
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/api/v2/silences" {
+			w.WriteHeader(404)
+			return
+		}
+
+		fetches++
+		fmt.Fprint(w, `[
+			{"id":"a","status":{"state":"active"}},
+			{"id":"b","status":{"state":"pending"}},
+			{"id":"c","status":{"state":"expired"}}
+		]`)
+	}))
+	defer backend.Close()
+
+	broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(500)
+	}))
+	defer broken.Close()
+
+	newSilence := `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"a","value":"b","isRegex":false}]}`
+	update := `{"id":"a","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"a","value":"b","isRegex":false}]}`
+
+	decider := bouncer.MaxActiveSilencesDecider(map[string]string{"alertmanagerURL": backend.URL, "max": "3"})
+	testCases := []struct {
+		name           string
+		decider        bouncer.Decider
+		input          string
+		expectedStatus int
+	}{
+		{"Test Silences Under The Max Pass", decider, newSilence, 0},
+		{"Test Silences Aren't Counted Until Alertmanager Accepts Them", decider, newSilence, 0},
+		{"Test Updates Pass", decider, update, 0},
+		{"Test Invalid Silences Fail", decider, "{", 400},
+		{"Test Silences At The Max Fail", bouncer.MaxActiveSilencesDecider(map[string]string{"alertmanagerURL": backend.URL, "max": "2"}), newSilence, 429},
+		{"Test Updates Pass At The Max", bouncer.MaxActiveSilencesDecider(map[string]string{"alertmanagerURL": backend.URL, "max": "2"}), update, 0},
+		{"Test Count Failures Fail Closed", bouncer.MaxActiveSilencesDecider(map[string]string{"alertmanagerURL": broken.URL, "max": "2"}), newSilence, 503},
+		{"Test Count Failures Can Fail Open", bouncer.MaxActiveSilencesDecider(map[string]string{"alertmanagerURL": broken.URL, "max": "2", "failOpen": "true"}), newSilence, 0},
+	}
+
+	for _, testCase := range testCases {
+		response := testCase.decider(mustBuildRequest(testCase.input, t), context.Background())
+		status := 0
+		if response != nil {
+			status = response.Status
+		}
+
+		if status != testCase.expectedStatus {
+			t.Errorf("Test '%s' failed - expected status %d, got %v", testCase.name, testCase.expectedStatus, response)
+		}
+	}
+
+	// Each decider should have only counted the silences once, and then used its cache
+	if fetches != 2 {
+		t.Errorf("Expected the count to be cached, but the silences were fetched %d times", fetches)
+	}
+
+	for _, invalid := range []map[string]string{
+		{"alertmanagerURL": backend.URL, "max": "lots"},
+		{"alertmanagerURL": backend.URL, "max": "-1"},
+		{"alertmanagerURL": backend.URL, "max": "3", "cacheTTL": "soon"},
+	} {
+		if bouncer.MaxActiveSilencesDecider(invalid) != nil {
+			t.Errorf("Expected %v to fail to construct a decider", invalid)
+		}
+	}
+}
+
+func TestValidateSilenceRegexDecider(t *testing.T) {
+	decider := bouncer.ValidateSilenceRegexDecider(map[string]string{})
+	testCases := []struct {
+		name           string
+		input          string
+		expectedStatus int
+	}{
+		{"Test Valid Regexes Pass", `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"alertname","value":"Instance.*","isRegex":true},{"name":"job","value":"(web|api)","isRegex":true,"isEqual":false}]}`, 0},
+		{"Test Invalid Regexes Fail", `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"alertname","value":"Instance.*","isRegex":true},{"name":"job","value":"(web|api","isRegex":true}]}`, 400},
+		{"Test Invalid Negative Regexes Fail", `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"job","value":"*web","isRegex":true,"isEqual":false}]}`, 400},
+		{"Test Literal Matchers Aren't Parsed", `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"job","value":"(web|api","isRegex":false}]}`, 0},
+		{"Test Regexes Are Compiled Anchored Like Alertmanager", `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"job","value":"web)|(api","isRegex":true}]}`, 0},
+		{"Test Invalid Silences Fail", `{`, 400},
+	}
+
+	for _, testCase := range testCases {
+		response := decider(mustBuildRequest(testCase.input, t), context.Background())
+		status := 0
+		if response != nil {
+			status = response.Status
+		}
+
+		if status != testCase.expectedStatus {
+			t.Errorf("Test '%s' failed - expected status %d, got %v", testCase.name, testCase.expectedStatus, response)
+		}
+	}
+
+	response := decider(mustBuildRequest(`{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[{"name":"job","value":"(web|api","isRegex":true}]}`, t), context.Background())
+	if response == nil || !strings.Contains(response.Err.Error(), `job=~"(web|api"`) || !strings.Contains(response.Err.Error(), "missing closing )") {
+		t.Errorf("Expected the error to name the matcher and the compile error, got %v", response)
+	}
+}
+
+func TestMaxActiveSilencesCountsCreatedSilences(t *testing.T) {
+	var fetches int32
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			atomic.AddInt32(&fetches, 1)
+			time.Sleep(10 * time.Millisecond)
+			fmt.Fprint(w, `[{"id":"a","status":{"state":"active"}},{"id":"b","status":{"state":"active"}}]`)
+			return
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		if strings.Contains(string(body), "reject") {
+			w.WriteHeader(400)
+			return
+		}
+		fmt.Fprint(w, `{"silenceID":"c"}`)
+	}))
+	defer backend.Close()
+
+	decider := bouncer.MaxActiveSilencesDecider(map[string]string{"alertmanagerURL": backend.URL, "max": "3", "cacheTTL": "1h"})
+
+	// Requests that need the count while it's being fetched should share the fetch
+	var requests sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			decider(mustBuildRequest(`{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`, t), context.Background())
+		}()
+	}
+	requests.Wait()
+
+	if atomic.LoadInt32(&fetches) != 1 {
+		t.Errorf("Expected concurrent requests to share one fetch of the count, got %d", atomic.LoadInt32(&fetches))
+	}
+
+	backendURL, _ := url.Parse(backend.URL)
+	bouncers := []bouncer.Bouncer{
+		{
+			Target:   bouncer.Target{Methods: []string{"POST"}, URIRegex: regexp.MustCompile("^/api/v2/silences$")},
+			Deciders: []bouncer.Decider{decider},
+		},
+	}
+
+	frontend := httptest.NewServer(bouncer.NewBouncingReverseProxy(backendURL, bouncers, nil))
+	defer frontend.Close()
+
+	create := func(comment string) int {
+		body := fmt.Sprintf(`{"comment":"%s","startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`, comment)
+		resp, err := http.Post(frontend.URL+"/api/v2/silences", "application/json", strings.NewReader(body))
+		if err != nil {
+			t.Fatalf("Failed to make request: %s", err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	testCases := []struct {
+		name           string
+		comment        string
+		expectedStatus int
+	}{
+		{"Test Silences Alertmanager Rejects Aren't Counted", "reject", 400},
+		{"Test Silences Under The Max Are Created", "create", 200},
+		{"Test Created Silences Are Counted", "create", 429},
+	}
+
+	for _, testCase := range testCases {
+		if status := create(testCase.comment); status != testCase.expectedStatus {
+			t.Errorf("Test '%s' failed - expected status %d, got %d", testCase.name, testCase.expectedStatus, status)
+		}
+	}
+}
+
+func TestMaxActiveSilencesBurstsCantOvershoot(t *testing.T) {
+	backend := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "GET" {
+			fmt.Fprint(w, `[]`)
+			return
+		}
+
+		// Slow enough that every request in the burst has been decided on before any silence is created
+		time.Sleep(50 * time.Millisecond)
+		fmt.Fprint(w, `{"silenceID":"a"}`)
+	}))
+	defer backend.Close()
+
+	backendURL, _ := url.Parse(backend.URL)
+	bouncers := []bouncer.Bouncer{
+		{
+			Target:   bouncer.Target{Methods: []string{"POST"}, URIRegex: regexp.MustCompile("^/api/v2/silences$")},
+			Deciders: []bouncer.Decider{bouncer.MaxActiveSilencesDecider(map[string]string{"alertmanagerURL": backend.URL, "max": "2", "cacheTTL": "1h"})},
+		},
+	}
+
+	frontend := httptest.NewServer(bouncer.NewBouncingReverseProxy(backendURL, bouncers, nil))
+	defer frontend.Close()
+
+	var created int32
+	var requests sync.WaitGroup
+	for i := 0; i < 6; i++ {
+		requests.Add(1)
+		go func() {
+			defer requests.Done()
+			body := `{"startsAt":"2020-01-21T00:23:55.242Z", "endsAt":"2020-01-21T01:23:55.242Z", "matchers":[]}`
+			resp, err := http.Post(frontend.URL+"/api/v2/silences", "application/json", strings.NewReader(body))
+			if err != nil {
+				t.Errorf("Failed to make request: %s", err)
+				return
+			}
+			resp.Body.Close()
+			if resp.StatusCode == 200 {
+				atomic.AddInt32(&created, 1)
+			}
+		}()
+	}
+	requests.Wait()
+
+	if created != 2 {
+		t.Errorf("Expected a burst of silences to stop at the max of 2, but %d were created", created)
+	}
+}